@@ -0,0 +1,158 @@
+package tapedb
+
+import (
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/blocks"
+	"time"
+)
+
+// Batch stages values of many keys of a tape, and records them all or nothing by Commit.
+type Batch interface {
+	// Record stages values of key, they are not visible until Commit.
+	Record(key []byte, values ...[]byte) (err error)
+	// Commit records staged values, poss are grouped by keys in order of their first Record.
+	// When a crash happens in Commit, the batch is recorded completely or not at all after the tape is opened again.
+	// When Commit fails after the batch was logged, such as applying it to indexes failed, the batch can still take effect,
+	// because it is redone when the tape is opened again.
+	Commit() (poss []Position, err error)
+	// Discard drops staged values.
+	Discard()
+}
+
+type batchEntry struct {
+	key    []byte
+	values [][]byte
+}
+
+type batch struct {
+	tape    *tape
+	entries []*batchEntry
+	done    bool
+}
+
+func (b *batch) Record(key []byte, values ...[]byte) (err error) {
+	if b.done {
+		err = fmt.Errorf("batch was committed or discarded")
+		return
+	}
+	keyErr := validateKey(key)
+	if keyErr != nil {
+		err = fmt.Errorf("batch record failed, %v", keyErr)
+		return
+	}
+	if len(values) == 0 {
+		return
+	}
+	for _, entry := range b.entries {
+		if string(entry.key) == string(key) {
+			entry.values = append(entry.values, values...)
+			return
+		}
+	}
+	b.entries = append(b.entries, &batchEntry{
+		key:    append(make([]byte, 0, len(key)), key...),
+		values: append(make([][]byte, 0, len(values)), values...),
+	})
+	return
+}
+
+func (b *batch) Discard() {
+	b.done = true
+	b.entries = nil
+}
+
+func (b *batch) Commit() (poss []Position, err error) {
+	if b.done {
+		err = fmt.Errorf("batch was committed or discarded")
+		return
+	}
+	b.done = true
+	if len(b.entries) == 0 {
+		return
+	}
+	t := b.tape
+	if err = t.acquire(); err != nil {
+		return
+	}
+	defer t.release()
+	segments := make([]blocks.Segment, 0, len(b.entries))
+	for _, entry := range b.entries {
+		for _, value := range entry.values {
+			segments = append(segments, blocks.NewSegment(value, t.blockCapacity))
+		}
+	}
+	written, writeErr := t.writeSegments(segments)
+	if writeErr != nil {
+		err = fmt.Errorf("commit batch failed, %v", writeErr)
+		return
+	}
+	keys := make([][]byte, 0, len(b.entries))
+	for _, entry := range b.entries {
+		keys = append(keys, entry.key)
+	}
+	unlock := t.locks.lock(keys...)
+	poss, ends, recordErr := t.recordBatch(b.entries, segments, written)
+	unlock()
+	if recordErr != nil {
+		poss = nil
+		err = fmt.Errorf("commit batch failed, %v", recordErr)
+		return
+	}
+	commitErr := t.commit()
+	for i, entry := range b.entries {
+		t.watermark.end(entry.key, ends[i], commitErr == nil)
+	}
+	if commitErr != nil {
+		poss = nil
+		err = fmt.Errorf("commit batch failed, %v", commitErr)
+		return
+	}
+	b.entries = nil
+	return
+}
+
+// recordBatch adds written of entries to their keys by one operation, so they are recorded all or nothing after a crash,
+// ends are lengths of keys of entries after the batch, which the caller ends in the watermark after the commit,
+// t.locks of keys of entries must be held.
+func (t *tape) recordBatch(entries []*batchEntry, segments []blocks.Segment, written [][]byte) (poss []Position, ends []int64, err error) {
+	now := time.Now().UnixNano()
+	op := t.operation(segments, written)
+	poss = make([]Position, 0, len(written))
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		offset, lenErr := t.records.Len(entry.key)
+		if lenErr != nil {
+			err = lenErr
+			return
+		}
+		offsets = append(offsets, offset)
+		entryPoss := written[:len(entry.values)]
+		written = written[len(entry.values):]
+		timeKey, timeEntry, timeErr := t.timeEntry(entry.key, offset, entryPoss, now)
+		if timeErr != nil {
+			err = timeErr
+			return
+		}
+		op.append(indexRecords, entry.key, entryPoss)
+		if timeKey != nil {
+			op.append(indexTimeline, timeKey, [][]byte{timeEntry})
+		}
+		for i, pos := range entryPoss {
+			poss = append(poss, newPosition(offset+int64(i), pos))
+		}
+	}
+	for i, entry := range entries {
+		t.watermark.begin(entry.key, offsets[i])
+	}
+	if err = t.apply(op); err != nil {
+		for i, entry := range entries {
+			t.watermark.end(entry.key, offsets[i], false)
+		}
+		return
+	}
+	ends = make([]int64, 0, len(entries))
+	for i, entry := range entries {
+		ends = append(ends, offsets[i]+int64(len(entry.values)))
+	}
+	return
+}
@@ -0,0 +1,176 @@
+package tapedb
+
+import (
+	"context"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/blocks"
+	"github.com/aacfactory/tapedb/internal/crashtest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func playAll(t *testing.T, tp Tape, key string) (values []string) {
+	raw, err := tp.Player([]byte(key)).Play(0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range raw {
+		values = append(values, string(value))
+	}
+	return
+}
+
+func TestTape_Batch(t *testing.T) {
+	db, openErr := Open(t.TempDir(), Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	tp, _ := db.Tape(DefaultTapeName)
+	if _, err := tp.Recorder([]byte("a")).Record([]byte("a:0")); err != nil {
+		t.Fatal(err)
+	}
+	b := tp.Batch()
+	_ = b.Record([]byte("a"), []byte("a:1"))
+	_ = b.Record([]byte("b"), []byte("b:0"), []byte("b:1"))
+	_ = b.Record([]byte("a"), []byte("a:2"))
+	if values := playAll(t, tp, "b"); len(values) != 0 {
+		t.Fatal("staged values must not be visible", values)
+	}
+	poss, commitErr := b.Commit()
+	if commitErr != nil {
+		t.Fatal(commitErr)
+	}
+	if len(poss) != 4 || poss[0].Seq != 1 || poss[1].Seq != 2 || poss[2].Seq != 0 || poss[3].Seq != 1 {
+		t.Fatal("unexpected positions", poss)
+	}
+	if _, err := b.Commit(); err == nil {
+		t.Fatal("expected committed batch error")
+	}
+	if values := playAll(t, tp, "a"); len(values) != 3 || values[2] != "a:2" {
+		t.Fatal("unexpected values of a", values)
+	}
+	if err := db.Update(func(tx Batch) error {
+		_ = tx.Record([]byte("c"), []byte("c:0"))
+		return fmt.Errorf("rollback")
+	}); err == nil {
+		t.Fatal("expected error of fn")
+	}
+	if values := playAll(t, tp, "c"); len(values) != 0 {
+		t.Fatal("discarded values must not be visible", values)
+	}
+	if err := db.Update(func(tx Batch) error {
+		return tx.Record([]byte("c"), []byte("c:0"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if values := playAll(t, tp, "c"); len(values) != 1 {
+		t.Fatal("unexpected values of c", values)
+	}
+}
+
+func TestTape_ReadCommitted(t *testing.T) {
+	db, openErr := Open(t.TempDir(), Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	tp, _ := db.Tape(DefaultTapeName)
+	key := []byte("a")
+	if _, err := tp.Recorder(key).Record([]byte("a:0")); err != nil {
+		t.Fatal(err)
+	}
+	follower, followErr := tp.Player(key).Follow(context.Background(), 0)
+	if followErr != nil {
+		t.Fatal(followErr)
+	}
+	defer follower.Close()
+	if !follower.Next() || string(follower.Value()) != "a:0" {
+		t.Fatal("expected the committed value", follower.Err())
+	}
+	// a value which was applied but not committed yet
+	internal := tp.(*tape)
+	segments := []blocks.Segment{blocks.NewSegment([]byte("a:1"), internal.blockCapacity)}
+	written, writeErr := internal.writeSegments(segments)
+	if writeErr != nil {
+		t.Fatal(writeErr)
+	}
+	if _, _, err := internal.record(key, segments, written, -1); err != nil {
+		t.Fatal(err)
+	}
+	if values := playAll(t, tp, "a"); len(values) != 1 {
+		t.Fatal("expected the applied value is not read before its commit", values)
+	}
+	internal.watermark.end(key, 2, true)
+	if values := playAll(t, tp, "a"); len(values) != 2 || values[1] != "a:1" {
+		t.Fatal("expected the value is read after its commit", values)
+	}
+	if !follower.Next() || string(follower.Value()) != "a:1" {
+		t.Fatal("expected the follower reads the committed value", follower.Err())
+	}
+}
+
+func TestTape_BatchCrash(t *testing.T) {
+	keys := []string{"order", "stock", "account"}
+	if dir, child := crashtest.Child(); child {
+		db, openErr := Open(dir, Option{SyncMode: SyncNone})
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		tp, _ := db.Tape(DefaultTapeName)
+		n := len(playAll(t, tp, keys[0]))
+		if n == 0 {
+			// killed after the batch was logged and before any key of it was applied
+			tp.(*tape).logged = crashtest.Ready
+		}
+		if err := db.Update(func(tx Batch) error {
+			for _, key := range keys {
+				_ = tx.Record([]byte(key), []byte(fmt.Sprintf("%s:%d", key, n)))
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		crashtest.Ready()
+	}
+	dir := t.TempDir()
+	// the batch was logged, and the crash happened before it was applied to indexes, so all of it is redone.
+	crashtest.Kill(t, "TestTape_BatchCrash", dir)
+	db, openErr := Open(dir, Option{SyncMode: SyncNone})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	tp, _ := db.Tape(DefaultTapeName)
+	for _, key := range keys {
+		if values := playAll(t, tp, key); len(values) != 1 || values[0] != key+":0" {
+			t.Fatal("expected the committed batch after recovery", key, values)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the crash happened in writing the frame of the batch, so none of it was committed.
+	crashtest.Kill(t, "TestTape_BatchCrash", dir)
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal", "*.wal"))
+	path := segments[len(segments)-1]
+	stat, _ := os.Stat(path)
+	if err := os.Truncate(path, stat.Size()-8); err != nil {
+		t.Fatal(err)
+	}
+
+	db, openErr = Open(dir, Option{SyncMode: SyncNone})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	tp, _ = db.Tape(DefaultTapeName)
+	for _, key := range keys {
+		if values := playAll(t, tp, key); len(values) != 1 {
+			t.Fatal("expected no partial batch after recovery", key, values)
+		}
+	}
+	if r := db.Recovery(); !r.Unclean || len(r.Files) == 0 || r.Files[0].Discarded == 0 {
+		t.Fatal("expected the discarded frame", r)
+	}
+}
@@ -0,0 +1,167 @@
+package tapedb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	catalogVersion       = 1
+	catalogHeadSize      = 64
+	catalogEntrySize     = 128
+	maxTapeNameLen       = 64
+	catalogNameOffset    = 16
+	catalogOptionsOffset = catalogNameOffset + maxTapeNameLen
+)
+
+// [version][count][...entries]
+// entry: [name_len][created_at][name][max_cache_nodes][max_cache_lists][saved_history_retention]
+type catalog struct {
+	path    string
+	entries []*catalogEntry
+}
+
+type catalogEntry struct {
+	name      string
+	createdAt int64
+	options   TapeOptions
+}
+
+func openCatalog(path string) (c *catalog, err error) {
+	c = &catalog{
+		path:    path,
+		entries: make([]*catalogEntry, 0, 1),
+	}
+	if !ioutils.ExistFile(path) {
+		return
+	}
+	p, readErr := os.ReadFile(path)
+	if readErr != nil {
+		err = fmt.Errorf("open catalog failed, %v", readErr)
+		return
+	}
+	if len(p) < catalogHeadSize {
+		err = fmt.Errorf("open catalog failed, catalog is broken")
+		return
+	}
+	version := binary.BigEndian.Uint64(p[0:8])
+	if version != catalogVersion {
+		err = fmt.Errorf("open catalog failed, version %d is not supported", version)
+		return
+	}
+	count := int(binary.BigEndian.Uint64(p[8:16]))
+	if len(p) != catalogHeadSize+count*catalogEntrySize {
+		err = fmt.Errorf("open catalog failed, catalog is broken")
+		return
+	}
+	for i := 0; i < count; i++ {
+		e := p[catalogHeadSize+i*catalogEntrySize : catalogHeadSize+(i+1)*catalogEntrySize]
+		nameLen := binary.BigEndian.Uint64(e[0:8])
+		if nameLen == 0 || nameLen > maxTapeNameLen {
+			err = fmt.Errorf("open catalog failed, catalog is broken")
+			return
+		}
+		c.entries = append(c.entries, &catalogEntry{
+			name:      string(e[catalogNameOffset : catalogNameOffset+nameLen]),
+			createdAt: int64(binary.BigEndian.Uint64(e[8:16])),
+			options: TapeOptions{
+				MaxCacheNodes:         int64(binary.BigEndian.Uint64(e[catalogOptionsOffset : catalogOptionsOffset+8])),
+				MaxCacheLists:         int64(binary.BigEndian.Uint64(e[catalogOptionsOffset+8 : catalogOptionsOffset+16])),
+				SavedHistoryRetention: int64(binary.BigEndian.Uint64(e[catalogOptionsOffset+16 : catalogOptionsOffset+24])),
+			},
+		})
+	}
+	return
+}
+
+func (c *catalog) get(name string) (entry *catalogEntry, has bool) {
+	for _, e := range c.entries {
+		if e.name == name {
+			entry = e
+			has = true
+			return
+		}
+	}
+	return
+}
+
+func (c *catalog) add(name string, options TapeOptions) (entry *catalogEntry, err error) {
+	entry = &catalogEntry{
+		name:      name,
+		createdAt: time.Now().UnixNano(),
+		options:   options,
+	}
+	entries := append(append(make([]*catalogEntry, 0, len(c.entries)+1), c.entries...), entry)
+	err = c.save(entries)
+	if err != nil {
+		entry = nil
+		return
+	}
+	c.entries = entries
+	return
+}
+
+func (c *catalog) remove(name string) (err error) {
+	entries := make([]*catalogEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		if e.name != name {
+			entries = append(entries, e)
+		}
+	}
+	err = c.save(entries)
+	if err != nil {
+		return
+	}
+	c.entries = entries
+	return
+}
+
+func (c *catalog) names() (names []string) {
+	names = make([]string, 0, len(c.entries))
+	for _, e := range c.entries {
+		names = append(names, e.name)
+	}
+	return
+}
+
+// save writes entries into a temp file then renames it to catalog, so the catalog is always complete.
+func (c *catalog) save(entries []*catalogEntry) (err error) {
+	p := make([]byte, catalogHeadSize+len(entries)*catalogEntrySize)
+	binary.BigEndian.PutUint64(p[0:8], catalogVersion)
+	binary.BigEndian.PutUint64(p[8:16], uint64(len(entries)))
+	for i, entry := range entries {
+		e := p[catalogHeadSize+i*catalogEntrySize : catalogHeadSize+(i+1)*catalogEntrySize]
+		binary.BigEndian.PutUint64(e[0:8], uint64(len(entry.name)))
+		binary.BigEndian.PutUint64(e[8:16], uint64(entry.createdAt))
+		copy(e[catalogNameOffset:catalogNameOffset+maxTapeNameLen], entry.name)
+		binary.BigEndian.PutUint64(e[catalogOptionsOffset:catalogOptionsOffset+8], uint64(entry.options.MaxCacheNodes))
+		binary.BigEndian.PutUint64(e[catalogOptionsOffset+8:catalogOptionsOffset+16], uint64(entry.options.MaxCacheLists))
+		binary.BigEndian.PutUint64(e[catalogOptionsOffset+16:catalogOptionsOffset+24], uint64(entry.options.SavedHistoryRetention))
+	}
+	tmp := c.path + ".tmp"
+	file, openErr := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if openErr != nil {
+		err = fmt.Errorf("save catalog failed, %v", openErr)
+		return
+	}
+	writeErr := ioutils.WriteRegion(file, 0, p)
+	if writeErr == nil {
+		writeErr = file.Sync()
+	}
+	_ = file.Close()
+	if writeErr != nil {
+		err = fmt.Errorf("save catalog failed, %v", writeErr)
+		return
+	}
+	renameErr := os.Rename(tmp, c.path)
+	if renameErr != nil {
+		err = fmt.Errorf("save catalog failed, %v", renameErr)
+		return
+	}
+	err = ioutils.SyncDir(filepath.Dir(c.path))
+	return
+}
@@ -0,0 +1,192 @@
+package tapedb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/blocks"
+	"github.com/aacfactory/tapedb/internal/checksum"
+	"github.com/aacfactory/tapedb/internal/index"
+	"github.com/aacfactory/tapedb/internal/index/blist"
+	"github.com/aacfactory/tapedb/internal/index/btree"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"path/filepath"
+)
+
+// CheckReport is what Check found in a tapedb directory.
+type CheckReport struct {
+	// Unclean is true when the tapedb was not closed safely,
+	// index files may be behind the write-ahead log until the tapedb is opened and recovered.
+	Unclean bool
+	// Volumes is the number of checked volume files.
+	Volumes int64
+	// Segments is the number of segments which were decoded.
+	Segments int64
+	// Tapes are names of checked tapes.
+	Tapes []string
+	// Positions is the number of indexed positions which were checked.
+	Positions int64
+	// Issues are inconsistencies which were found, the tapedb is consistent when there is no issue.
+	Issues []CheckIssue
+}
+
+// CheckIssue is an inconsistency, Offset is the offset of the broken structure in File.
+type CheckIssue struct {
+	File string
+	// Offset is the offset of the broken structure in File.
+	Offset int64
+	// Structure is one of volume, block, segment, btree, blist and position.
+	Structure string
+	Problem   string
+}
+
+func (issue CheckIssue) String() string {
+	return fmt.Sprintf("%s at %d of %s: %s", issue.Structure, issue.Offset, issue.File, issue.Problem)
+}
+
+// OK returns true when there is no issue.
+func (r *CheckReport) OK() (ok bool) {
+	ok = len(r.Issues) == 0
+	return
+}
+
+func (r *CheckReport) add(file string, offset int64, structure string, problem string) {
+	r.Issues = append(r.Issues, CheckIssue{
+		File:      file,
+		Offset:    offset,
+		Structure: structure,
+		Problem:   problem,
+	})
+}
+
+// checkedIndexes are indexes of a tape, items of timeline are not positions.
+var checkedIndexes = []struct {
+	name      string
+	positions bool
+}{
+	{name: "records", positions: true},
+	{name: "saves", positions: true},
+	{name: "consumers", positions: true},
+	{name: "snapshots", positions: true},
+	{name: "timeline", positions: false},
+}
+
+type segmentKey struct {
+	volume uint32
+	no     int64
+}
+
+// Check verifies files of the tapedb in dir which is not opened, the files are not changed.
+// It decodes every segment of volumes, walks btrees of indexes from their roots, follows chains of blist lists,
+// and confirms every indexed position points at a decodable segment of the same size.
+// err is returned when files can not be read, inconsistencies are reported by issues of the report.
+func Check(dir string) (report *CheckReport, err error) {
+	if dir == "" {
+		err = fmt.Errorf("check tapedb failed, dir is required")
+		return
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		err = fmt.Errorf("check tapedb failed, %v", err)
+		return
+	}
+	m, manifestErr := readManifest(filepath.Join(dir, "manifest"))
+	if manifestErr != nil {
+		err = fmt.Errorf("check tapedb failed, %v", manifestErr)
+		return
+	}
+	ctl, catalogErr := openCatalog(filepath.Join(dir, "catalog"))
+	if catalogErr != nil {
+		err = fmt.Errorf("check tapedb failed, %v", catalogErr)
+		return
+	}
+	report = &CheckReport{
+		Unclean: m.unclean,
+		Tapes:   make([]string, 0, 1),
+		Issues:  make([]CheckIssue, 0, 1),
+	}
+	// volumes, segments are decodable when they are true.
+	segments := make(map[segmentKey]bool)
+	sizes := make(map[segmentKey]uint32)
+	volumesDir := filepath.Join(dir, "volumes")
+	for no := int64(1); no <= m.volumes; no++ {
+		path := volumePath(volumesDir, no)
+		if !ioutils.ExistFile(path) {
+			report.add(path, 0, "volume", "volume file is missing")
+			continue
+		}
+		scanErr := blocks.ScanVolume(path, no, m.blockCapacity, func(pos blocks.Position, seg blocks.Segment, segErr error) {
+			key := segmentKey{volume: pos.Idx(), no: pos.No()}
+			sizes[key] = pos.Size()
+			segments[key] = segErr == nil
+			if segErr == nil {
+				report.Segments++
+				return
+			}
+			var corrupted *checksum.Error
+			if errors.As(segErr, &corrupted) {
+				report.add(corrupted.File, corrupted.Offset, corrupted.Structure, "checksum is not matched")
+				return
+			}
+			report.add(path, (pos.No()-1)*m.blockCapacity, "segment", segErr.Error())
+		})
+		if scanErr != nil {
+			err = fmt.Errorf("check tapedb failed, %v", scanErr)
+			report = nil
+			return
+		}
+		report.Volumes++
+	}
+	// indexes
+	names := ctl.names()
+	if _, has := ctl.get(DefaultTapeName); !has && ioutils.ExistFile(filepath.Join(dir, "tapes", DefaultTapeName)) {
+		names = append([]string{DefaultTapeName}, names...)
+	}
+	for _, name := range names {
+		tapeDir := filepath.Join(dir, "tapes", name)
+		for _, checked := range checkedIndexes {
+			options := index.Options{
+				BTree: btree.Options{Path: filepath.Join(tapeDir, checked.name+".bt")},
+				BList: blist.Options{Path: filepath.Join(tapeDir, checked.name+".bl")},
+			}
+			if !ioutils.ExistFile(options.BTree.Path) {
+				// indexes which were added by later versions are created when the tape is opened
+				continue
+			}
+			if !ioutils.ExistFile(options.BList.Path) {
+				report.add(options.BList.Path, 0, "blist", "blist file of the btree file is missing")
+				continue
+			}
+			positions := checked.positions
+			checkErr := index.Check(options, func(key []byte, offset int64, item []byte) {
+				if !positions {
+					return
+				}
+				report.Positions++
+				pos := blocks.Position(item)
+				k := segmentKey{volume: pos.Idx(), no: pos.No()}
+				decodable, has := segments[k]
+				switch {
+				case !has:
+					report.add(options.BList.Path, offset, "position", fmt.Sprintf("position %s of %q does not point at a segment", pos, key))
+				case !decodable:
+					report.add(options.BList.Path, offset, "position", fmt.Sprintf("position %s of %q points at a broken segment", pos, key))
+				case sizes[k] != pos.Size():
+					report.add(options.BList.Path, offset, "position", fmt.Sprintf("position %s of %q points at a segment of %d blocks", pos, key, sizes[k]))
+				}
+			}, func(path string, offset int64, problem string) {
+				structure := "blist"
+				if path == options.BTree.Path {
+					structure = "btree"
+				}
+				report.add(path, offset, structure, problem)
+			})
+			if checkErr != nil {
+				err = fmt.Errorf("check tapedb failed, %v", checkErr)
+				report = nil
+				return
+			}
+		}
+		report.Tapes = append(report.Tapes, name)
+	}
+	return
+}
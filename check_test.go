@@ -0,0 +1,62 @@
+package tapedb_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aacfactory/tapedb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	key := []byte("checked")
+	tape := defaultTape(t, db)
+	r := tape.Recorder(key)
+	for i := 0; i < 100; i++ {
+		if _, err := r.Record([]byte(fmt.Sprintf("event:%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tape.Player(key).Save(10, []byte("saved")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := tapedb.Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Unclean || report.Segments != 101 || report.Positions != 101 {
+		t.Fatal("unexpected report", report)
+	}
+	// a corrupted value, and the corrupted tail list of records which holds the last 2 positions
+	volume := filepath.Join(dir, "volumes", "00000001.vol")
+	p, _ := os.ReadFile(volume)
+	if err = os.WriteFile(volume, bytes.ReplaceAll(p, []byte("event:42"), []byte("EVENT:42")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	records := filepath.Join(dir, "tapes", tapedb.DefaultTapeName, "records.bl")
+	p, _ = os.ReadFile(records)
+	p[4096+7*256+40] ^= 0xff
+	if err = os.WriteFile(records, p, 0600); err != nil {
+		t.Fatal(err)
+	}
+	report, err = tapedb.Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	structures := make(map[string]int)
+	for _, issue := range report.Issues {
+		structures[issue.Structure]++
+	}
+	if structures["block"] != 1 || structures["position"] != 1 || structures["blist"] != 1 || len(report.Issues) != 3 {
+		t.Fatal("unexpected issues", report.Issues)
+	}
+}
@@ -0,0 +1,74 @@
+// Command tapedb is the tool of tapedb directories.
+//
+//	tapedb check [-json] dir
+//
+// check verifies files of the tapedb in dir which is not opened, see tapedb.Check,
+// it exits with 1 when inconsistencies are found, and 2 when the files can not be checked.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/aacfactory/tapedb"
+	"os"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "check":
+		os.Exit(check(os.Args[2:]))
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	_, _ = fmt.Fprintln(os.Stderr, "usage: tapedb check [-json] dir")
+}
+
+func check(args []string) (code int) {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "print the report as json")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		usage()
+		code = 2
+		return
+	}
+	report, err := tapedb.Check(flags.Arg(0))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		code = 2
+		return
+	}
+	if !report.OK() {
+		code = 1
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(report); encodeErr != nil {
+			_, _ = fmt.Fprintln(os.Stderr, encodeErr)
+			code = 2
+		}
+		return
+	}
+	if report.Unclean {
+		fmt.Println("tapedb was not closed safely, index files may be behind the write-ahead log until it is opened")
+	}
+	fmt.Printf("checked %d volumes, %d segments, %d positions of tapes %v\n", report.Volumes, report.Segments, report.Positions, report.Tapes)
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+	}
+	if report.OK() {
+		fmt.Println("no issue was found")
+	} else {
+		fmt.Printf("%d issues were found\n", len(report.Issues))
+	}
+	return
+}
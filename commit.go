@@ -0,0 +1,107 @@
+package tapedb
+
+import (
+	"sync"
+	"time"
+)
+
+type syncer interface {
+	Sync() (err error)
+}
+
+func newCommitter(mode SyncMode, window time.Duration) (c *committer) {
+	c = &committer{
+		mode:   mode,
+		window: window,
+		mutex:  new(sync.Mutex),
+		group:  nil,
+		wg:     new(sync.WaitGroup),
+	}
+	return
+}
+
+// committer makes written files durable before writes are acknowledged, according to the sync mode.
+type committer struct {
+	mode   SyncMode
+	window time.Duration
+	mutex  *sync.Mutex
+	group  *commitGroup
+	wg     *sync.WaitGroup
+}
+
+type commitGroup struct {
+	files []syncer
+	done  chan struct{}
+	err   error
+}
+
+func (g *commitGroup) add(files []syncer) {
+	for _, file := range files {
+		has := false
+		for _, f := range g.files {
+			if f == file {
+				has = true
+				break
+			}
+		}
+		if !has {
+			g.files = append(g.files, file)
+		}
+	}
+}
+
+func (g *commitGroup) sync() (err error) {
+	for _, file := range g.files {
+		if syncErr := file.Sync(); syncErr != nil {
+			err = syncErr
+		}
+	}
+	return
+}
+
+// commit returns after files are synced when mode is SyncAlways or SyncGroupCommit, otherwise returns directly.
+func (c *committer) commit(files ...syncer) (err error) {
+	switch c.mode {
+	case SyncAlways:
+		g := &commitGroup{}
+		g.add(files)
+		err = g.sync()
+	case SyncGroupCommit:
+		c.mutex.Lock()
+		g := c.group
+		if g == nil {
+			g = &commitGroup{
+				done: make(chan struct{}),
+			}
+			c.group = g
+			c.wg.Add(1)
+			go c.flush(g)
+		}
+		g.add(files)
+		c.mutex.Unlock()
+		<-g.done
+		err = g.err
+	default:
+		break
+	}
+	return
+}
+
+// flush waits for the window to collect concurrent writers, then syncs their files once.
+func (c *committer) flush(g *commitGroup) {
+	defer c.wg.Done()
+	if c.window > 0 {
+		time.Sleep(c.window)
+	}
+	c.mutex.Lock()
+	if c.group == g {
+		c.group = nil
+	}
+	c.mutex.Unlock()
+	g.err = g.sync()
+	close(g.done)
+}
+
+func (c *committer) Close() {
+	c.wg.Wait()
+}
@@ -0,0 +1,99 @@
+package tapedb
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// crashFile simulates a file whose unsynced writes are lost by a crash.
+type crashFile struct {
+	mutex   sync.Mutex
+	written int
+	synced  int
+	syncs   int
+}
+
+func (f *crashFile) write() (n int) {
+	f.mutex.Lock()
+	f.written++
+	n = f.written
+	f.mutex.Unlock()
+	return
+}
+
+func (f *crashFile) Sync() (err error) {
+	f.mutex.Lock()
+	f.synced = f.written
+	f.syncs++
+	f.mutex.Unlock()
+	return
+}
+
+// crash returns the number of writes which survive a crash.
+func (f *crashFile) crash() (n int) {
+	f.mutex.Lock()
+	n = f.synced
+	f.mutex.Unlock()
+	return
+}
+
+func runCommitCrash(t *testing.T, c *committer, writers int) (f *crashFile, lost int) {
+	f = &crashFile{}
+	lostCh := make(chan int, writers)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := f.write()
+			if err := c.commit(f); err != nil {
+				t.Error(err)
+				return
+			}
+			// acknowledged, crash now
+			if f.crash() < n {
+				lostCh <- n
+			}
+		}()
+	}
+	wg.Wait()
+	close(lostCh)
+	for range lostCh {
+		lost++
+	}
+	return
+}
+
+func TestCommitter_SyncAlways(t *testing.T) {
+	c := newCommitter(SyncAlways, defaultCommitWindow)
+	defer c.Close()
+	f, lost := runCommitCrash(t, c, 64)
+	if lost > 0 {
+		t.Fatal("acknowledged writes were lost by crash", lost)
+	}
+	if f.syncs != 64 {
+		t.Fatal("expected 64 syncs, got", f.syncs)
+	}
+}
+
+func TestCommitter_SyncGroupCommit(t *testing.T) {
+	c := newCommitter(SyncGroupCommit, 5*time.Millisecond)
+	defer c.Close()
+	f, lost := runCommitCrash(t, c, 64)
+	if lost > 0 {
+		t.Fatal("acknowledged writes were lost by crash", lost)
+	}
+	if f.syncs >= 64 {
+		t.Fatal("expected writes were grouped, got", f.syncs, "syncs")
+	}
+}
+
+func TestCommitter_SyncNone(t *testing.T) {
+	c := newCommitter(SyncNone, defaultCommitWindow)
+	defer c.Close()
+	f, lost := runCommitCrash(t, c, 64)
+	if lost != 64 || f.syncs != 0 {
+		t.Fatal("expected all acknowledged writes were lost by crash, got", lost, f.syncs)
+	}
+}
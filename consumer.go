@@ -0,0 +1,127 @@
+package tapedb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Consumer is a named reader of a key, it keeps its own checkpoints independently of other consumers.
+type Consumer interface {
+	Name() (name string)
+	Save(pos int64, comment []byte) (err error)
+	// Latest returns -1 as pos when nothing was saved.
+	Latest() (pos int64, comment []byte, err error)
+	// Lag returns the number of values of the key after the latest saved pos.
+	Lag() (lag int64, err error)
+}
+
+type ConsumerInfo struct {
+	Name      string
+	CreatedAt time.Time
+	// Pos is -1 when nothing was saved.
+	Pos     int64
+	Comment []byte
+	Lag     int64
+}
+
+// consumerIndexKey returns the key of checkpoints of the consumer in the consumers index,
+// it is a hash because a key and a name can be longer than a key of the index.
+func consumerIndexKey(key []byte, name string) (v []byte) {
+	h := sha256.New()
+	p := make([]byte, 8)
+	binary.BigEndian.PutUint64(p, uint64(len(key)))
+	h.Write(p)
+	h.Write(key)
+	h.Write([]byte(name))
+	v = h.Sum(nil)
+	return
+}
+
+func consumerLag(head int64, pos int64) (lag int64) {
+	lag = head - pos - 1
+	if lag < 0 {
+		lag = 0
+	}
+	return
+}
+
+type consumer struct {
+	name   string
+	player *player
+}
+
+func (c *consumer) Name() (name string) {
+	name = c.name
+	return
+}
+
+func (c *consumer) Save(pos int64, comment []byte) (err error) {
+	t := c.player.tape
+	key := c.player.key
+	if pos < 0 {
+		err = fmt.Errorf("save consumer %s of %s failed, pos must not be negative", c.name, key)
+		return
+	}
+	if err = t.acquire(); err != nil {
+		return
+	}
+	defer t.release()
+	idxKey := consumerIndexKey(key, c.name)
+	_, registerErr := t.consumers.register(key, c.name, func() (err error) {
+		// checkpoints of a deleted consumer with the same name are left when the tapedb crashed after deleting it
+		err = t.dropCheckpoints(indexConsumers, idxKey)
+		return
+	})
+	if registerErr != nil {
+		err = fmt.Errorf("save consumer %s of %s failed, %v", c.name, key, registerErr)
+		return
+	}
+	saveErr := t.saveCheckpoint(indexConsumers, idxKey, pos, comment)
+	if saveErr != nil {
+		err = fmt.Errorf("save consumer %s of %s failed, %v", c.name, key, saveErr)
+		return
+	}
+	return
+}
+
+func (c *consumer) Latest() (pos int64, comment []byte, err error) {
+	pos = -1
+	t := c.player.tape
+	key := c.player.key
+	if err = t.acquire(); err != nil {
+		return
+	}
+	defer t.release()
+	_, has := t.consumers.get(key, c.name)
+	if !has {
+		return
+	}
+	pos, comment, err = t.latestCheckpoint(t.checkpoints, consumerIndexKey(key, c.name))
+	if err != nil {
+		err = fmt.Errorf("get latest of consumer %s of %s failed, %v", c.name, key, err)
+		return
+	}
+	return
+}
+
+func (c *consumer) Lag() (lag int64, err error) {
+	pos, _, latestErr := c.Latest()
+	if latestErr != nil {
+		err = latestErr
+		return
+	}
+	t := c.player.tape
+	if err = t.acquire(); err != nil {
+		return
+	}
+	defer t.release()
+	head, lenErr := t.committed(c.player.key)
+	if lenErr != nil {
+		err = fmt.Errorf("get lag of consumer %s of %s failed, %v", c.name, c.player.key, lenErr)
+		return
+	}
+	lag = consumerLag(head, pos)
+	return
+}
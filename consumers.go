@@ -0,0 +1,320 @@
+package tapedb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/checksum"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	consumersVersion       = 1
+	consumersHeadSize      = 64
+	consumersEntrySize     = 152
+	maxConsumerNameLen     = 64
+	consumersKeyOffset     = 24
+	consumersNameOffset    = consumersKeyOffset + maxKeyLen
+	consumersEntryUsedSize = consumersNameOffset + maxConsumerNameLen
+	consumersKindOffset    = consumersEntryUsedSize
+	consumersCRCOffset     = consumersKindOffset + 8
+	// consumersCompactSlack is the number of records of removed consumers which are kept in the log before it is compacted.
+	consumersCompactSlack = 64
+)
+
+const (
+	consumerRegistered = uint64(1)
+	consumerRemoved    = uint64(2)
+)
+
+// consumers is the registry of named consumers of keys of a tape, it is a log of registering and removing consumers.
+// [version][...records]
+// record: [key_len][name_len][created_at][key][name][kind][crc32c]
+// A record is appended for each change, so a torn last record was not acknowledged and is ignored when opening.
+// The log is rewritten with registered consumers only when its overwritten records are more than registered consumers by consumersCompactSlack.
+type consumers struct {
+	mutex *sync.Mutex
+	path  string
+	// keys are registered consumers by their names by keys.
+	keys map[string]map[string]*consumerEntry
+	// seq is the registration order of the last consumer.
+	seq int64
+	// size is the size of the log, records are appended at it, it is 0 when the log does not exist.
+	size    int64
+	records int64
+	live    int64
+}
+
+// consumerEntry is a registered consumer, seq is its registration order.
+type consumerEntry struct {
+	key       []byte
+	name      string
+	createdAt int64
+	seq       int64
+}
+
+func validateConsumerName(name string) (err error) {
+	if name == "" || len(name) > maxConsumerNameLen {
+		err = fmt.Errorf("invalid consumer name, length of name must be in [1, %d]", maxConsumerNameLen)
+		return
+	}
+	return
+}
+
+func openConsumers(path string) (c *consumers, err error) {
+	c = &consumers{
+		mutex: new(sync.Mutex),
+		path:  path,
+		keys:  make(map[string]map[string]*consumerEntry),
+	}
+	if !ioutils.ExistFile(path) {
+		return
+	}
+	p, readErr := os.ReadFile(path)
+	if readErr != nil {
+		err = fmt.Errorf("open consumers failed, %v", readErr)
+		return
+	}
+	if len(p) < consumersHeadSize {
+		err = fmt.Errorf("open consumers failed, consumers is broken")
+		return
+	}
+	version := binary.BigEndian.Uint64(p[0:8])
+	if version != consumersVersion {
+		err = fmt.Errorf("open consumers failed, version %d is not supported", version)
+		return
+	}
+	offset := consumersHeadSize
+	for ; offset+consumersEntrySize <= len(p); offset = offset + consumersEntrySize {
+		e := p[offset : offset+consumersEntrySize]
+		if checksum.Sum(e[:consumersCRCOffset]) != binary.BigEndian.Uint32(e[consumersCRCOffset:consumersCRCOffset+4]) {
+			if offset+consumersEntrySize == len(p) {
+				// torn by a crash while appending
+				break
+			}
+			err = fmt.Errorf("open consumers failed, %v", &checksum.Error{File: path, Offset: int64(offset), Structure: "consumer"})
+			return
+		}
+		entry, decodeErr := decodeConsumerEntry(e)
+		if decodeErr != nil {
+			err = fmt.Errorf("open consumers failed, %v", decodeErr)
+			return
+		}
+		switch binary.BigEndian.Uint64(e[consumersKindOffset : consumersKindOffset+8]) {
+		case consumerRegistered:
+			c.add(entry)
+		case consumerRemoved:
+			c.delete(entry.key, entry.name)
+		default:
+			err = fmt.Errorf("open consumers failed, consumers is broken")
+			return
+		}
+		c.records++
+	}
+	c.size = int64(offset)
+	return
+}
+
+func decodeConsumerEntry(e []byte) (entry *consumerEntry, err error) {
+	keyLen := binary.BigEndian.Uint64(e[0:8])
+	nameLen := binary.BigEndian.Uint64(e[8:16])
+	if keyLen == 0 || keyLen > maxKeyLen || nameLen == 0 || nameLen > maxConsumerNameLen {
+		err = fmt.Errorf("consumers is broken")
+		return
+	}
+	key := make([]byte, keyLen)
+	copy(key, e[consumersKeyOffset:consumersKeyOffset+keyLen])
+	entry = &consumerEntry{
+		key:       key,
+		name:      string(e[consumersNameOffset : consumersNameOffset+nameLen]),
+		createdAt: int64(binary.BigEndian.Uint64(e[16:24])),
+	}
+	return
+}
+
+func encodeConsumerEntry(e []byte, entry *consumerEntry, kind uint64) {
+	binary.BigEndian.PutUint64(e[0:8], uint64(len(entry.key)))
+	binary.BigEndian.PutUint64(e[8:16], uint64(len(entry.name)))
+	binary.BigEndian.PutUint64(e[16:24], uint64(entry.createdAt))
+	copy(e[consumersKeyOffset:consumersKeyOffset+maxKeyLen], entry.key)
+	copy(e[consumersNameOffset:consumersEntryUsedSize], entry.name)
+	binary.BigEndian.PutUint64(e[consumersKindOffset:consumersKindOffset+8], kind)
+	binary.BigEndian.PutUint32(e[consumersCRCOffset:consumersCRCOffset+4], checksum.Sum(e[:consumersCRCOffset]))
+}
+
+// add puts entry into keys, it replaces the registered one which has the same key and name, seq of a new entry is assigned.
+func (c *consumers) add(entry *consumerEntry) {
+	names, has := c.keys[string(entry.key)]
+	if !has {
+		names = make(map[string]*consumerEntry)
+		c.keys[string(entry.key)] = names
+	}
+	if _, registered := names[entry.name]; !registered {
+		c.live++
+	}
+	if entry.seq == 0 {
+		c.seq++
+		entry.seq = c.seq
+	}
+	names[entry.name] = entry
+}
+
+func (c *consumers) delete(key []byte, name string) (entry *consumerEntry, has bool) {
+	names, hasNames := c.keys[string(key)]
+	if !hasNames {
+		return
+	}
+	entry, has = names[name]
+	if !has {
+		return
+	}
+	delete(names, name)
+	if len(names) == 0 {
+		delete(c.keys, string(key))
+	}
+	c.live--
+	return
+}
+
+func (c *consumers) get(key []byte, name string) (entry *consumerEntry, has bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, has = c.keys[string(key)][name]
+	return
+}
+
+// register adds the consumer when it does not exist, dropLeftovers is called before adding it to drop checkpoints
+// which were left by a deleted consumer with the same name.
+func (c *consumers) register(key []byte, name string, dropLeftovers func() (err error)) (entry *consumerEntry, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	has := false
+	entry, has = c.keys[string(key)][name]
+	if has {
+		return
+	}
+	if dropErr := dropLeftovers(); dropErr != nil {
+		err = fmt.Errorf("register consumer failed, %v", dropErr)
+		return
+	}
+	entry = &consumerEntry{
+		key:       append(make([]byte, 0, len(key)), key...),
+		name:      name,
+		createdAt: time.Now().UnixNano(),
+	}
+	c.add(entry)
+	err = c.append(entry, consumerRegistered)
+	if err != nil {
+		c.delete(key, name)
+		entry = nil
+		return
+	}
+	return
+}
+
+func (c *consumers) remove(key []byte, name string) (has bool, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, removed := c.delete(key, name)
+	if !removed {
+		return
+	}
+	err = c.append(entry, consumerRemoved)
+	if err != nil {
+		c.add(entry)
+		return
+	}
+	has = true
+	return
+}
+
+func (c *consumers) list(key []byte) (entries []*consumerEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	names := c.keys[string(key)]
+	entries = make([]*consumerEntry, 0, len(names))
+	for _, e := range names {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	return
+}
+
+// append writes the record of the change of entry at the end of the log, keys must be changed already.
+// The log is rewritten instead when it does not exist or has too many records of removed consumers.
+func (c *consumers) append(entry *consumerEntry, kind uint64) (err error) {
+	if c.size == 0 || c.records+1 > 2*c.live+consumersCompactSlack {
+		err = c.save()
+		return
+	}
+	p := make([]byte, consumersEntrySize)
+	encodeConsumerEntry(p, entry, kind)
+	file, openErr := os.OpenFile(c.path, os.O_WRONLY, 0600)
+	if openErr != nil {
+		err = fmt.Errorf("save consumers failed, %v", openErr)
+		return
+	}
+	writeErr := ioutils.WriteRegion(file, c.size, p)
+	if writeErr == nil {
+		writeErr = file.Sync()
+	}
+	_ = file.Close()
+	if writeErr != nil {
+		// the torn record is overwritten by the next one
+		err = fmt.Errorf("save consumers failed, %v", writeErr)
+		return
+	}
+	c.size = c.size + consumersEntrySize
+	c.records++
+	return
+}
+
+// save writes registered consumers into a temp file then renames it to consumers, so the registry is always complete.
+func (c *consumers) save() (err error) {
+	entries := make([]*consumerEntry, 0, c.live)
+	for _, names := range c.keys {
+		for _, e := range names {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	p := make([]byte, consumersHeadSize+len(entries)*consumersEntrySize)
+	binary.BigEndian.PutUint64(p[0:8], consumersVersion)
+	for i, entry := range entries {
+		encodeConsumerEntry(p[consumersHeadSize+i*consumersEntrySize:consumersHeadSize+(i+1)*consumersEntrySize], entry, consumerRegistered)
+	}
+	tmp := c.path + ".tmp"
+	file, openErr := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if openErr != nil {
+		err = fmt.Errorf("save consumers failed, %v", openErr)
+		return
+	}
+	writeErr := ioutils.WriteRegion(file, 0, p)
+	if writeErr == nil {
+		writeErr = file.Sync()
+	}
+	_ = file.Close()
+	if writeErr != nil {
+		err = fmt.Errorf("save consumers failed, %v", writeErr)
+		return
+	}
+	renameErr := os.Rename(tmp, c.path)
+	if renameErr != nil {
+		err = fmt.Errorf("save consumers failed, %v", renameErr)
+		return
+	}
+	if err = ioutils.SyncDir(filepath.Dir(c.path)); err != nil {
+		return
+	}
+	c.size = int64(len(p))
+	c.records = int64(len(entries))
+	return
+}
@@ -2,16 +2,432 @@ package tapedb
 
 import (
 	"errors"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/checksum"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"github.com/aacfactory/tapedb/internal/lru"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	maxKeyLen = 48
+)
+
+const (
+	DefaultTapeName = "default"
 )
 
 var (
-	NotSafelyClosedErr = errors.New("tapedb is not safely closed")
+	// Deprecated: a tapedb which was not closed safely is recovered when it is opened, see DB.Recovery.
+	NotSafelyClosedErr  = errors.New("tapedb is not safely closed")
+	ClosedErr           = errors.New("tapedb was closed")
+	TapeNotFoundErr     = errors.New("tape was not found")
+	TapeExistsErr       = errors.New("tape already exists")
+	ConsumerNotFoundErr = errors.New("consumer was not found")
 )
 
-type Option struct {
-}
+// ErrCorrupted is returned when the checksum of a block, a btree node or a blist list is not matched,
+// it carries the file, the offset in the file and the kind of the corrupted structure, use errors.As to get it.
+type ErrCorrupted = checksum.Error
 
 type DB interface {
-	Tape() (v Tape)
+	Tape(name string) (v Tape, err error)
+	CreateTape(name string, options TapeOptions) (v Tape, err error)
+	DropTape(name string) (err error)
+	Tapes() (names []string, err error)
+	// Update calls fn with a batch of the default tape, and commits it when fn returns nil, otherwise discards it.
+	Update(fn func(tx Batch) (err error)) (err error)
+	// Recovery returns what was recovered when the tapedb was opened.
+	Recovery() (r Recovery)
 	Close() (err error)
 }
+
+// Recovery is what was recovered when a tapedb was opened after it was not closed safely, such as killed or crashed.
+type Recovery struct {
+	// Unclean is true when the tapedb was not closed safely.
+	Unclean bool
+	// Files has the write-ahead log when it was redone.
+	Files []RecoveredFile
+}
+
+// RecoveredFile is the write-ahead log which was redone.
+type RecoveredFile struct {
+	Path string
+	// Operations is the number of committed operations which were redone.
+	Operations int64
+	// Discarded is the size of frames which were not written completely, they were dropped.
+	Discarded int64
+}
+
+// Open opens the tapedb in dir, it will be created when it does not exist.
+//
+//	dir
+//	├── manifest
+//	├── catalog
+//	├── wal
+//	│   └── 00000001.wal
+//	├── volumes
+//	│   ├── 00000001.vol
+//	│   └── quarantine
+//	│       └── 00000001-00000042.blocks
+//	└── tapes
+//	    └── default
+//	        ├── records.bt
+//	        ├── records.bl
+//	        ├── saves.bt
+//	        ├── saves.bl
+//	        ├── consumers
+//	        ├── consumers.bt
+//	        ├── consumers.bl
+//	        ├── snapshots.bt
+//	        ├── snapshots.bl
+//	        ├── timeline.bt
+//	        └── timeline.bl
+//
+// Blocks and index mutations of each operation are logged in the write-ahead log before they are applied,
+// and index files are flushed by checkpoints of the log, so they never refer to blocks which were lost.
+// A tapedb which was not closed safely is recovered when it is opened, committed operations are redone from the log,
+// and DB.Recovery reports what was recovered.
+func Open(dir string, opt Option) (v DB, err error) {
+	if dir == "" {
+		err = fmt.Errorf("open tapedb failed, dir is required")
+		return
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		err = fmt.Errorf("open tapedb failed, %v", err)
+		return
+	}
+	mkdirErr := os.MkdirAll(dir, 0700)
+	if mkdirErr != nil {
+		err = fmt.Errorf("open tapedb failed, %v", mkdirErr)
+		return
+	}
+	opts, optsErr := newOptions(opt)
+	if optsErr != nil {
+		err = fmt.Errorf("open tapedb failed, %v", optsErr)
+		return
+	}
+	m, manifestErr := openManifest(filepath.Join(dir, "manifest"), opts.blockCapacity, opts.volumeMaxSize/opts.blockCapacity)
+	if manifestErr != nil {
+		err = fmt.Errorf("open tapedb failed, %v", manifestErr)
+		return
+	}
+	if m.blockCapacity != opts.blockCapacity {
+		if opts.blockCapacityFixed {
+			_ = m.Close()
+			err = fmt.Errorf("open tapedb failed, block capacity can not be changed from %s to %s", ioutils.ByteSize(uint64(m.blockCapacity)), ioutils.ByteSize(uint64(opts.blockCapacity)))
+			return
+		}
+		opts.blockCapacity = m.blockCapacity
+	}
+	if volumeMaxBlocksErr := m.setVolumeMaxBlocks(opts.volumeMaxSize / opts.blockCapacity); volumeMaxBlocksErr != nil {
+		_ = m.Close()
+		err = fmt.Errorf("open tapedb failed, %v", volumeMaxBlocksErr)
+		return
+	}
+	log, logErr := openWriteAheadLog(dir, opts)
+	if logErr != nil {
+		_ = m.Close()
+		err = fmt.Errorf("open tapedb failed, %v", logErr)
+		return
+	}
+	// blocks are redone before volumes are opened, so volumes know them
+	redoFrom, redoFilesErr := log.redoFiles(opts.blockCapacity)
+	if redoFilesErr != nil {
+		_ = log.Abandon()
+		_ = m.Close()
+		err = fmt.Errorf("open tapedb failed, redo write-ahead log failed, %v", redoFilesErr)
+		return
+	}
+	maxCachePages := opts.pageCacheSize / (opts.blockCapacity * opts.pageBlocks)
+	if maxCachePages < 1 {
+		maxCachePages = 1
+	}
+	cache, cacheErr := lru.NewLRU(maxCachePages, nil)
+	if cacheErr != nil {
+		_ = log.Abandon()
+		_ = m.Close()
+		err = fmt.Errorf("open tapedb failed, %v", cacheErr)
+		return
+	}
+	vs, volumesErr := openVolumes(filepath.Join(dir, "volumes"), m, opts, cache)
+	if volumesErr != nil {
+		_ = log.Abandon()
+		_ = m.Close()
+		err = fmt.Errorf("open tapedb failed, %v", volumesErr)
+		return
+	}
+	log.attach(vs)
+	ctl, catalogErr := openCatalog(filepath.Join(dir, "catalog"))
+	if catalogErr != nil {
+		_ = log.Abandon()
+		_ = vs.Close()
+		_ = m.Close()
+		err = fmt.Errorf("open tapedb failed, %v", catalogErr)
+		return
+	}
+	if _, has := ctl.get(DefaultTapeName); !has {
+		if _, addErr := ctl.add(DefaultTapeName, TapeOptions{}); addErr != nil {
+			_ = log.Abandon()
+			_ = vs.Close()
+			_ = m.Close()
+			err = fmt.Errorf("open tapedb failed, %v", addErr)
+			return
+		}
+	}
+	committer := newCommitter(opts.syncMode, opts.commitWindow)
+	tapesDir := filepath.Join(dir, "tapes")
+	tapes := make(map[string]*tape)
+	for _, entry := range ctl.entries {
+		t, tapeErr := openTape(tapesDir, entry.name, vs, committer, log, opts, entry.options)
+		if tapeErr != nil {
+			_ = log.Abandon()
+			for _, opened := range tapes {
+				_ = opened.Close()
+			}
+			_ = vs.Close()
+			_ = m.Close()
+			err = fmt.Errorf("open tapedb failed, %v", tapeErr)
+			return
+		}
+		t.createdAt = entry.createdAt
+		log.add(t)
+		tapes[entry.name] = t
+	}
+	redone, redoErr := log.redo(redoFrom)
+	if redoErr == nil {
+		redoErr = log.Checkpoint()
+	}
+	if redoErr != nil {
+		_ = log.Abandon()
+		for _, opened := range tapes {
+			_ = opened.Close()
+		}
+		_ = vs.Close()
+		_ = m.Close()
+		err = fmt.Errorf("open tapedb failed, redo write-ahead log failed, %v", redoErr)
+		return
+	}
+	recovery := Recovery{
+		Unclean: m.unclean,
+	}
+	if logRecovery := log.Recovery(); redone > 0 || logRecovery.Discarded > 0 {
+		recovery.Files = append(recovery.Files, RecoveredFile{
+			Path:       logRecovery.Path,
+			Operations: redone,
+			Discarded:  logRecovery.Discarded,
+		})
+	}
+	v = &db{
+		mutex:     new(sync.RWMutex),
+		dir:       dir,
+		opts:      opts,
+		manifest:  m,
+		volumes:   vs,
+		catalog:   ctl,
+		committer: committer,
+		log:       log,
+		tapesDir:  tapesDir,
+		tapes:     tapes,
+		recovery:  recovery,
+		closed:    false,
+	}
+	return
+}
+
+type db struct {
+	mutex     *sync.RWMutex
+	dir       string
+	opts      *options
+	manifest  *manifest
+	volumes   *volumes
+	catalog   *catalog
+	committer *committer
+	log       *writeAheadLog
+	tapesDir  string
+	tapes     map[string]*tape
+	recovery  Recovery
+	closed    bool
+}
+
+func (db *db) Tape(name string) (v Tape, err error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.closed {
+		err = ClosedErr
+		return
+	}
+	t, has := db.tapes[name]
+	if !has {
+		err = TapeNotFoundErr
+		return
+	}
+	v = t
+	return
+}
+
+func (db *db) CreateTape(name string, options TapeOptions) (v Tape, err error) {
+	if err = validateTapeName(name); err != nil {
+		err = fmt.Errorf("create tape failed, %v", err)
+		return
+	}
+	if err = options.validate(); err != nil {
+		err = fmt.Errorf("create %s tape failed, %v", name, err)
+		return
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		err = ClosedErr
+		return
+	}
+	if _, has := db.tapes[name]; has {
+		err = TapeExistsErr
+		return
+	}
+	// remove files of the tape which was not created completely
+	if removeErr := os.RemoveAll(filepath.Join(db.tapesDir, name)); removeErr != nil {
+		err = fmt.Errorf("create %s tape failed, %v", name, removeErr)
+		return
+	}
+	t, openErr := openTape(db.tapesDir, name, db.volumes, db.committer, db.log, db.opts, options)
+	if openErr != nil {
+		err = fmt.Errorf("create %s tape failed, %v", name, openErr)
+		return
+	}
+	entry, addErr := db.catalog.add(name, options)
+	if addErr != nil {
+		_ = t.Close()
+		_ = os.RemoveAll(t.dir)
+		err = fmt.Errorf("create %s tape failed, %v", name, addErr)
+		return
+	}
+	t.createdAt = entry.createdAt
+	db.log.add(t)
+	db.tapes[name] = t
+	v = t
+	return
+}
+
+// DropTape removes the tape and its indexes, values of the tape in volumes are not reclaimed.
+func (db *db) DropTape(name string) (err error) {
+	if name == DefaultTapeName {
+		err = fmt.Errorf("drop tape failed, %s tape can not be dropped", name)
+		return
+	}
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		err = ClosedErr
+		return
+	}
+	t, has := db.tapes[name]
+	if !has {
+		err = TapeNotFoundErr
+		return
+	}
+	if removeErr := db.catalog.remove(name); removeErr != nil {
+		err = fmt.Errorf("drop %s tape failed, %v", name, removeErr)
+		return
+	}
+	delete(db.tapes, name)
+	db.log.remove(t)
+	_ = t.Close()
+	if removeErr := os.RemoveAll(t.dir); removeErr != nil {
+		err = fmt.Errorf("drop %s tape failed, %v", name, removeErr)
+		return
+	}
+	return
+}
+
+func (db *db) Tapes() (names []string, err error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.closed {
+		err = ClosedErr
+		return
+	}
+	names = db.catalog.names()
+	return
+}
+
+func (db *db) Update(fn func(tx Batch) (err error)) (err error) {
+	t, tapeErr := db.Tape(DefaultTapeName)
+	if tapeErr != nil {
+		err = tapeErr
+		return
+	}
+	err = t.Update(fn)
+	return
+}
+
+func (db *db) Recovery() (r Recovery) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	r = db.recovery
+	return
+}
+
+func (db *db) Close() (err error) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.closed {
+		err = ClosedErr
+		return
+	}
+	db.closed = true
+	// the last checkpoint flushes index files, so the log has nothing to redo when the tapedb is opened again
+	logErr := db.log.Close()
+	var tapeErr error
+	for _, t := range db.tapes {
+		if closeErr := t.Close(); closeErr != nil {
+			tapeErr = closeErr
+		}
+	}
+	db.committer.Close()
+	volumesErr := db.volumes.Close()
+	manifestErr := db.manifest.Close()
+	if logErr != nil {
+		err = fmt.Errorf("close tapedb failed, %v", logErr)
+		return
+	}
+	if tapeErr != nil {
+		err = fmt.Errorf("close tapedb failed, %v", tapeErr)
+		return
+	}
+	if volumesErr != nil {
+		err = fmt.Errorf("close tapedb failed, %v", volumesErr)
+		return
+	}
+	if manifestErr != nil {
+		err = fmt.Errorf("close tapedb failed, %v", manifestErr)
+		return
+	}
+	return
+}
+
+// ErrConflict is returned by Recorder.RecordExpect when the last pos of the key is not the expected one.
+type ErrConflict struct {
+	Key      []byte
+	Expected int64
+	Actual   int64
+}
+
+func (e *ErrConflict) Error() string {
+	return fmt.Sprintf("conflict on %s, expected last pos is %d but it is %d", e.Key, e.Expected, e.Actual)
+}
+
+func validateKey(key []byte) (err error) {
+	if len(key) == 0 {
+		err = fmt.Errorf("key is required")
+		return
+	}
+	if len(key) > maxKeyLen {
+		err = fmt.Errorf("key is too large, max length is %d", maxKeyLen)
+		return
+	}
+	return
+}
@@ -0,0 +1,212 @@
+package tapedb_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/aacfactory/tapedb"
+	"testing"
+	"time"
+)
+
+func defaultTape(t *testing.T, db tapedb.DB) tapedb.Tape {
+	tape, err := db.Tape(tapedb.DefaultTapeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tape
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	key := []byte("order:1")
+	r := defaultTape(t, db).Recorder(key)
+	large := bytes.Repeat([]byte("0123456789"), 200)
+	for i := 0; i < 100; i++ {
+		if _, err := r.Record([]byte(fmt.Sprintf("event:%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.Record(large, []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := r.Player()
+	if err := p.Save(50, []byte("half")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, openErr = tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	p = defaultTape(t, db).Player(key)
+	values, playErr := p.Play(0, 200)
+	if playErr != nil {
+		t.Fatal(playErr)
+	}
+	if len(values) != 102 {
+		t.Fatal("expected 102 values, got", len(values))
+	}
+	for i := 0; i < 100; i++ {
+		if string(values[i]) != fmt.Sprintf("event:%d", i) {
+			t.Fatal("unexpected value", i, string(values[i]))
+		}
+	}
+	if !bytes.Equal(values[100], large) || len(values[101]) != 0 {
+		t.Fatal("unexpected large or empty value")
+	}
+	values, playErr = p.Play(98, 2)
+	if playErr != nil {
+		t.Fatal(playErr)
+	}
+	if len(values) != 2 || string(values[0]) != "event:98" {
+		t.Fatal("unexpected values from 98", len(values))
+	}
+	pos, comment, savedErr := p.LatestSavedPos()
+	if savedErr != nil {
+		t.Fatal(savedErr)
+	}
+	if pos != 50 || string(comment) != "half" {
+		t.Fatal("unexpected saved pos", pos, string(comment))
+	}
+	none, noneErr := defaultTape(t, db).Player([]byte("order:2")).Play(0, 10)
+	if noneErr != nil || len(none) != 0 {
+		t.Fatal("unexpected values of absent key", len(none), noneErr)
+	}
+}
+
+func TestOpen_Option(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := tapedb.Open(dir, tapedb.Option{BlockCapacity: "12X"}); err == nil {
+		t.Fatal("expected invalid block capacity error")
+	}
+	if _, err := tapedb.Open(dir, tapedb.Option{VolumeMaxSize: "1K"}); err == nil {
+		t.Fatal("expected invalid volume max size error")
+	}
+	db, openErr := tapedb.Open(dir, tapedb.Option{
+		BlockCapacity: "1K",
+		PageBlocks:    16,
+		VolumeMaxSize: "1M",
+		PageCacheSize: "1M",
+		MaxCacheNodes: 8,
+		MaxCacheLists: 64,
+		SyncMode:      tapedb.SyncNone,
+	})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	key := []byte("volumes")
+	value := bytes.Repeat([]byte{'x'}, 100*1024)
+	for i := 0; i < 30; i++ {
+		if _, err := defaultTape(t, db).Recorder(key).Record(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tapedb.Open(dir, tapedb.Option{BlockCapacity: "4K"}); err == nil {
+		t.Fatal("expected block capacity can not be changed error")
+	}
+	db, openErr = tapedb.Open(dir, tapedb.Option{VolumeMaxSize: "2M", SyncInterval: 10 * time.Millisecond})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	values, playErr := defaultTape(t, db).Player(key).Play(0, 100)
+	if playErr != nil {
+		t.Fatal(playErr)
+	}
+	if len(values) != 30 {
+		t.Fatal("expected 30 values, got", len(values))
+	}
+	for _, v := range values {
+		if !bytes.Equal(v, value) {
+			t.Fatal("unexpected value")
+		}
+	}
+}
+
+func TestDB_CreateTape(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	if _, err := db.CreateTape("../orders", tapedb.TapeOptions{}); err == nil {
+		t.Fatal("expected invalid tape name error")
+	}
+	orders, ordersErr := db.CreateTape("orders", tapedb.TapeOptions{MaxCacheNodes: 16})
+	if ordersErr != nil {
+		t.Fatal(ordersErr)
+	}
+	if _, err := db.CreateTape("orders", tapedb.TapeOptions{}); err != tapedb.TapeExistsErr {
+		t.Fatal("expected tape exists error, got", err)
+	}
+	audit, auditErr := db.CreateTape("audit", tapedb.TapeOptions{})
+	if auditErr != nil {
+		t.Fatal(auditErr)
+	}
+	key := []byte("1")
+	if _, err := orders.Recorder(key).Record([]byte("order")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := audit.Recorder(key).Record([]byte("audit:1"), []byte("audit:2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropTape("audit"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := audit.Recorder(key).Record([]byte("audit:3")); err == nil {
+		t.Fatal("expected closed tape error")
+	}
+	if err := db.DropTape(tapedb.DefaultTapeName); err == nil {
+		t.Fatal("expected default tape can not be dropped error")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, openErr = tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	names, _ := db.Tapes()
+	if len(names) != 2 || names[0] != tapedb.DefaultTapeName || names[1] != "orders" {
+		t.Fatal("unexpected tapes", names)
+	}
+	if _, err := db.Tape("audit"); err != tapedb.TapeNotFoundErr {
+		t.Fatal("expected tape not found error, got", err)
+	}
+	orders, ordersErr = db.Tape("orders")
+	if ordersErr != nil {
+		t.Fatal(ordersErr)
+	}
+	values, playErr := orders.Player(key).Play(0, 10)
+	if playErr != nil {
+		t.Fatal(playErr)
+	}
+	if len(values) != 1 || string(values[0]) != "order" {
+		t.Fatal("unexpected values of orders", len(values))
+	}
+	values, playErr = defaultTape(t, db).Player(key).Play(0, 10)
+	if playErr != nil || len(values) != 0 {
+		t.Fatal("unexpected values of default tape", len(values), playErr)
+	}
+	audit, auditErr = db.CreateTape("audit", tapedb.TapeOptions{})
+	if auditErr != nil {
+		t.Fatal(auditErr)
+	}
+	values, playErr = audit.Player(key).Play(0, 10)
+	if playErr != nil || len(values) != 0 {
+		t.Fatal("unexpected values of recreated audit tape", len(values), playErr)
+	}
+}
@@ -2,19 +2,29 @@ package blocks
 
 import (
 	"encoding/binary"
+	"github.com/aacfactory/tapedb/internal/checksum"
 	"math"
 )
 
+const (
+	// blockHeadSize is the size of [length][segIdx][segSize][crc32c].
+	blockHeadSize = 12
+)
+
 func calcBlockSize(p []byte, blockCapacity int64) (size int64) {
-	size = int64(math.Ceil(float64(len(p)) / float64(blockCapacity-8)))
+	size = int64(math.Ceil(float64(len(p)) / float64(blockCapacity-blockHeadSize)))
+	if size == 0 {
+		size = 1
+	}
 	return
 }
 
-// [no][segNo][segSize][content_size][...content]
+// [no][segNo][segSize][crc32c][...content]
+// crc32c covers all bytes of the block except itself, content is at the end of the block.
 type Block []byte
 
 func (b Block) write(p []byte, segmentIdx int64, segmentSize int64) (n int) {
-	bLen := len(b) - 8
+	bLen := len(b) - blockHeadSize
 	pLen := len(p)
 	if pLen-bLen < 0 {
 		n = pLen
@@ -30,18 +40,36 @@ func (b Block) write(p []byte, segmentIdx int64, segmentSize int64) (n int) {
 	binary.LittleEndian.PutUint32(b[0:4], uint32(n))
 	binary.LittleEndian.PutUint16(b[4:6], uint16(segmentIdx))
 	binary.LittleEndian.PutUint16(b[6:8], uint16(segmentSize))
-	copy(b[bLen+8-n:], p)
+	copy(b[len(b)-n:], p)
+	b.seal()
+	return
+}
+
+// seal writes the crc32c of the block, it must be called after the block was changed.
+func (b Block) seal() {
+	binary.LittleEndian.PutUint32(b[8:12], checksum.Sum(b[0:8], b[12:]))
+}
+
+// verify returns false when the crc32c of the block is not matched.
+func (b Block) verify() (ok bool) {
+	ok = binary.LittleEndian.Uint32(b[8:12]) == checksum.Sum(b[0:8], b[12:])
+	return
+}
+
+// length returns the size of content in the block, the flag of segment headers is not a part of it.
+func (b Block) length() (n uint32) {
+	n = binary.LittleEndian.Uint32(b[0:4]) &^ segmentHeadersFlag
 	return
 }
 
 func (b Block) read() (p []byte, segmentIdx uint16, segmentSize uint16, has bool) {
-	length := binary.LittleEndian.Uint16(b[0:4])
-	has = length > 0
+	length := b.length()
+	segmentIdx = binary.LittleEndian.Uint16(b[4:6])
+	segmentSize = binary.LittleEndian.Uint16(b[6:8])
+	has = segmentSize > 0
 	if !has {
 		return
 	}
-	segmentIdx = binary.LittleEndian.Uint16(b[4:6])
-	segmentSize = binary.LittleEndian.Uint16(b[6:8])
-	p = b[uint16(len(b))-length:]
+	p = b[uint32(len(b))-length:]
 	return
 }
@@ -0,0 +1,62 @@
+package blocks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// EncodeHeaders encodes headers as [count][...[key_len][key][value_len][value]], lengths are uvarint and keys are sorted.
+func EncodeHeaders(headers map[string][]byte) (p []byte) {
+	keys := make([]string, 0, len(headers))
+	size := binary.MaxVarintLen64
+	for key, value := range headers {
+		keys = append(keys, key)
+		size = size + 2*binary.MaxVarintLen64 + len(key) + len(value)
+	}
+	sort.Strings(keys)
+	p = make([]byte, 0, size)
+	p = binary.AppendUvarint(p, uint64(len(keys)))
+	for _, key := range keys {
+		value := headers[key]
+		p = binary.AppendUvarint(p, uint64(len(key)))
+		p = append(p, key...)
+		p = binary.AppendUvarint(p, uint64(len(value)))
+		p = append(p, value...)
+	}
+	return
+}
+
+func DecodeHeaders(p []byte) (headers map[string][]byte, err error) {
+	count, n := binary.Uvarint(p)
+	if n <= 0 || count > uint64(len(p)) {
+		err = fmt.Errorf("headers are broken")
+		return
+	}
+	p = p[n:]
+	headers = make(map[string][]byte, count)
+	for i := uint64(0); i < count; i++ {
+		keyLen, kn := binary.Uvarint(p)
+		if kn <= 0 || keyLen > uint64(len(p)-kn) {
+			headers = nil
+			err = fmt.Errorf("headers are broken")
+			return
+		}
+		key := string(p[kn : kn+int(keyLen)])
+		p = p[kn+int(keyLen):]
+		valueLen, vn := binary.Uvarint(p)
+		if vn <= 0 || valueLen > uint64(len(p)-vn) {
+			headers = nil
+			err = fmt.Errorf("headers are broken")
+			return
+		}
+		headers[key] = p[vn : vn+int(valueLen)]
+		p = p[vn+int(valueLen):]
+	}
+	if len(p) != 0 {
+		headers = nil
+		err = fmt.Errorf("headers are broken")
+		return
+	}
+	return
+}
@@ -2,11 +2,13 @@ package blocks
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/aacfactory/tapedb/internal/checksum"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"github.com/aacfactory/tapedb/internal/lru"
 	"golang.org/x/sync/singleflight"
 	"io"
-	"math"
-	"os"
 )
 
 type PageBuffer interface {
@@ -53,6 +55,7 @@ func (b *bytesPageBuffer) Close() error {
 	return nil
 }
 
+// Page holds the blocks in (beg, end] of a volume.
 type Page struct {
 	volumeNo      int64
 	beg           int64
@@ -65,18 +68,46 @@ func (p *Page) Key() string {
 	return fmt.Sprintf("[%d][%d:%d]", p.volumeNo, p.beg, p.end)
 }
 
-func (p *Page) Segment(seq int64) (seg Segment, remainSeq int64) {
+// Segment returns the part of the segment which starts at block seq and is held by the page.
+// When the segment continues in the next page, remainSeq is the block number to read from.
+// The block at seq is verified, a checksum.Error is returned when it is corrupted.
+func (p *Page) Segment(seq int64) (seg Segment, remainSeq int64, err error) {
+	if seq <= p.beg || seq > p.end {
+		err = fmt.Errorf("block %d is out of page %s", seq, p.Key())
+		return
+	}
 	b := p.buffer.Bytes()
-	beg := seq - p.beg
+	beg := seq - p.beg - 1
+	if !Block(b[beg*p.blockCapacity : (beg+1)*p.blockCapacity]).verify() {
+		err = &checksum.Error{Structure: "block"}
+		return
+	}
 	segmentIdx := binary.LittleEndian.Uint16(b[beg*p.blockCapacity+4 : beg*p.blockCapacity+6])
 	segmentSize := binary.LittleEndian.Uint16(b[beg*p.blockCapacity+6 : beg*p.blockCapacity+8])
+	if segmentSize == 0 || segmentIdx == 0 || segmentIdx > segmentSize {
+		err = fmt.Errorf("block %d of page %s is not a segment", seq, p.Key())
+		return
+	}
 	end := seq + int64(segmentSize-segmentIdx)
 	if end > p.end {
 		remainSeq = p.end + 1
 		end = p.end
 	}
 	end = end - p.beg
-	seg = b[beg*p.blockCapacity : (end+1)*p.blockCapacity]
+	seg = b[beg*p.blockCapacity : end*p.blockCapacity]
+	return
+}
+
+func NewPageReader(volumeNo int64, volumeSEQ *Sequence, blockCapacity int64, file *ioutils.File, maxBlocks int64, cache *lru.LRU) (pr *PageReader) {
+	pr = &PageReader{
+		volumeNo:      volumeNo,
+		volumeSEQ:     volumeSEQ,
+		blockCapacity: blockCapacity,
+		file:          file,
+		maxBlocks:     maxBlocks,
+		barrier:       new(singleflight.Group),
+		cache:         cache,
+	}
 	return
 }
 
@@ -84,29 +115,122 @@ type PageReader struct {
 	volumeNo      int64
 	volumeSEQ     *Sequence
 	blockCapacity int64
-	file          *os.File
-	size          int64
+	file          *ioutils.File
 	maxBlocks     int64
 	barrier       *singleflight.Group
-	cache         interface{}
+	cache         *lru.LRU
 }
 
+// GetPageRange returns the page which holds block seq, has is false when the block was not confirmed.
 func (pr *PageReader) GetPageRange(seq int64) (beg int64, end int64, has bool) {
-	beg = (int64(math.Ceil(float64(seq)/float64(pr.maxBlocks))) - 1) * pr.maxBlocks
-	end = beg + pr.maxBlocks
-	offset := beg * pr.blockCapacity
-	ln := int64(math.Ceil(float64(pr.volumeSEQ.Value()) / float64(pr.maxBlocks)))
-	latestPageBegOffset := (ln*pr.maxBlocks - pr.maxBlocks) * pr.blockCapacity
-	if offset < latestPageBegOffset {
-		beg = 0
-		end = 0
+	if seq < 1 || seq > pr.volumeSEQ.Confirmed() {
 		return
 	}
+	beg = ((seq - 1) / pr.maxBlocks) * pr.maxBlocks
+	end = beg + pr.maxBlocks
 	has = true
 	return
 }
 
+// Read reads the page of (beg, end]. Pages which are fully confirmed are cached, because they will not be changed.
 func (pr *PageReader) Read(beg int64, end int64) (p *Page, err error) {
+	key := fmt.Sprintf("[%d][%d:%d]", pr.volumeNo, beg, end)
+	cacheable := pr.cache != nil && end <= pr.volumeSEQ.Confirmed()
+	if cacheable {
+		cached, has := pr.cache.Get(key)
+		if has {
+			p = cached.(*Page)
+			return
+		}
+	}
+	v, doErr, _ := pr.barrier.Do(key, func() (v interface{}, doErr error) {
+		capacity := (end - beg) * pr.blockCapacity
+		data, readErr := pr.file.ReadAt(beg*pr.blockCapacity, capacity)
+		if readErr != nil {
+			doErr = readErr
+			return
+		}
+		if int64(len(data)) < capacity {
+			data = append(data, make([]byte, capacity-int64(len(data)))...)
+		}
+		v = &Page{
+			volumeNo:      pr.volumeNo,
+			beg:           beg,
+			end:           end,
+			blockCapacity: pr.blockCapacity,
+			buffer: &bytesPageBuffer{
+				size: capacity,
+				data: data,
+			},
+		}
+		return
+	})
+	pr.barrier.Forget(key)
+	if doErr != nil {
+		err = fmt.Errorf("read page %s failed, %v", key, doErr)
+		return
+	}
+	p = v.(*Page)
+	if cacheable {
+		pr.cache.Add(key, p)
+	}
+	return
+}
+
+// ReadSegmentHead reads the leading blocks of the segment of pos which are held by the first page.
+func (pr *PageReader) ReadSegmentHead(pos Position) (seg Segment, err error) {
+	seq := pos.No()
+	beg, end, has := pr.GetPageRange(seq)
+	if !has {
+		err = fmt.Errorf("block %d of volume %d was not written", seq, pr.volumeNo)
+		return
+	}
+	page, readErr := pr.Read(beg, end)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	seg, _, err = page.Segment(seq)
+	return
+}
 
+// ReadSegment reads the whole segment of pos, the segment may be held by more than one page.
+func (pr *PageReader) ReadSegment(pos Position) (seg Segment, err error) {
+	seq := pos.No()
+	size := int64(pos.Size())
+	for {
+		beg, end, has := pr.GetPageRange(seq)
+		if !has {
+			err = fmt.Errorf("block %d of volume %d was not written", seq, pr.volumeNo)
+			return
+		}
+		page, readErr := pr.Read(beg, end)
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		part, remainSeq, segErr := page.Segment(seq)
+		if segErr != nil {
+			var corrupted *checksum.Error
+			if errors.As(segErr, &corrupted) {
+				corrupted.Offset = (seq - pos.No()) * pr.blockCapacity
+			}
+			err = segErr
+			return
+		}
+		if remainSeq == 0 && seg == nil {
+			seg = part
+			break
+		}
+		seg = append(seg, part...)
+		if remainSeq == 0 {
+			break
+		}
+		seq = remainSeq
+	}
+	if int64(len(seg)) != size*pr.blockCapacity {
+		err = fmt.Errorf("segment %s of volume %d is incomplete", pos, pr.volumeNo)
+		return
+	}
 	return
 }
@@ -0,0 +1,84 @@
+package blocks
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/checksum"
+	"io"
+	"os"
+)
+
+// ScanVolume reads segments of the volume file at path in order without opening the volume, the file is not changed.
+// fn is called with each segment and the error of decoding it, a checksum.Error has the offset in the file.
+// When the head block of a segment is broken, fn is called with the block, and the scan goes on from the next block.
+func ScanVolume(path string, no int64, blockCapacity int64, fn func(pos Position, seg Segment, err error)) (err error) {
+	if blockCapacity <= blockHeadSize {
+		err = fmt.Errorf("scan volume failed, block capacity must be greater than %d", blockHeadSize)
+		return
+	}
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		err = fmt.Errorf("scan volume failed, %v", openErr)
+		return
+	}
+	defer file.Close()
+	reader := bufio.NewReaderSize(file, int(blockCapacity)*64)
+	seq := int64(1)
+	for {
+		block := make(Block, blockCapacity)
+		n, readErr := io.ReadFull(reader, block)
+		if readErr == io.EOF {
+			return
+		}
+		offset := (seq - 1) * blockCapacity
+		if readErr == io.ErrUnexpectedEOF {
+			fn(NewPosition(seq, uint32(no), 1), Segment(block[:n]), fmt.Errorf("block %d is truncated", seq))
+			return
+		}
+		if readErr != nil {
+			err = fmt.Errorf("scan volume failed, %v", readErr)
+			return
+		}
+		if !block.verify() {
+			fn(NewPosition(seq, uint32(no), 1), Segment(block), &checksum.Error{File: path, Offset: offset, Structure: "block"})
+			seq++
+			continue
+		}
+		segmentIdx := binary.LittleEndian.Uint16(block[4:6])
+		segmentSize := int64(binary.LittleEndian.Uint16(block[6:8]))
+		if segmentIdx != 1 || segmentSize == 0 {
+			fn(NewPosition(seq, uint32(no), 1), Segment(block), fmt.Errorf("block %d is not the head of a segment", seq))
+			seq++
+			continue
+		}
+		seg := make(Segment, 0, segmentSize*blockCapacity)
+		seg = append(seg, block...)
+		for i := int64(1); i < segmentSize; i++ {
+			next := make([]byte, blockCapacity)
+			n, readErr = io.ReadFull(reader, next)
+			seg = append(seg, next[:n]...)
+			if readErr != nil {
+				break
+			}
+		}
+		pos := NewPosition(seq, uint32(no), uint32((int64(len(seg))+blockCapacity-1)/blockCapacity))
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			fn(pos, seg, fmt.Errorf("segment at block %d is truncated", seq))
+			return
+		}
+		if readErr != nil {
+			err = fmt.Errorf("scan volume failed, %v", readErr)
+			return
+		}
+		_, contentErr := seg.Content()
+		var corrupted *checksum.Error
+		if errors.As(contentErr, &corrupted) {
+			corrupted.File = path
+			corrupted.Offset = corrupted.Offset + offset
+		}
+		fn(pos, seg, contentErr)
+		seq = seq + segmentSize
+	}
+}
@@ -3,6 +3,7 @@ package blocks
 import (
 	"encoding/binary"
 	"fmt"
+	"github.com/aacfactory/tapedb/internal/checksum"
 )
 
 func NewSegment(p []byte, blockCapacity int64) (s Segment) {
@@ -17,22 +18,108 @@ func NewSegment(p []byte, blockCapacity int64) (s Segment) {
 	return
 }
 
+// NewSegmentWithHeaders returns a segment which content is [headers_len][headers][p],
+// the length of the first block is marked by segmentHeadersFlag, so headers can be read without reading p.
+func NewSegmentWithHeaders(headers []byte, p []byte, blockCapacity int64) (s Segment) {
+	content := make([]byte, 0, binary.MaxVarintLen64+len(headers)+len(p))
+	content = binary.AppendUvarint(content, uint64(len(headers)))
+	content = append(content, headers...)
+	content = append(content, p...)
+	s = NewSegment(content, blockCapacity)
+	binary.LittleEndian.PutUint32(s[0:4], binary.LittleEndian.Uint32(s[0:4])|segmentHeadersFlag)
+	Block(s[0:blockCapacity]).seal()
+	return
+}
+
+// segmentHeadersFlag is the high bit of the length of the first block, a length is never greater than a block.
+const segmentHeadersFlag = uint32(1) << 31
+
 type Segment []byte
 
+// Content returns the content of the segment without headers.
 func (s Segment) Content() (p []byte, err error) {
-	sLen := len(s)
+	p, err = s.content(int64(len(s))/s.blocks(), -1)
+	if err != nil {
+		return
+	}
+	if !s.hasHeaders() {
+		return
+	}
+	headersLen, n := binary.Uvarint(p)
+	if n <= 0 || headersLen > uint64(len(p)-n) {
+		p = nil
+		err = fmt.Errorf("headers are broken")
+		return
+	}
+	p = p[n+int(headersLen):]
+	return
+}
+
+// Headers returns encoded headers, blocks after headers are not read.
+// s can be the leading blocks of the segment, complete is false when they do not hold all headers.
+func (s Segment) Headers(blockCapacity int64) (headers []byte, complete bool, err error) {
+	if !s.hasHeaders() {
+		complete = true
+		return
+	}
+	prefix, prefixErr := s.content(blockCapacity, binary.MaxVarintLen64)
+	if prefixErr != nil {
+		err = prefixErr
+		return
+	}
+	headersLen, n := binary.Uvarint(prefix)
+	if n <= 0 {
+		if int64(len(s)) < s.blocks()*blockCapacity {
+			return
+		}
+		err = fmt.Errorf("headers are broken")
+		return
+	}
+	size := n + int(headersLen)
+	p, contentErr := s.content(blockCapacity, size)
+	if contentErr != nil {
+		err = contentErr
+		return
+	}
+	if len(p) < size {
+		if int64(len(s)) < s.blocks()*blockCapacity {
+			return
+		}
+		err = fmt.Errorf("headers are broken")
+		return
+	}
+	headers = p[n:size]
+	complete = true
+	return
+}
+
+func (s Segment) hasHeaders() (ok bool) {
+	ok = binary.LittleEndian.Uint32(s[0:4])&segmentHeadersFlag != 0
+	return
+}
+
+// content returns at least limit bytes of the content from the leading blocks of s, limit < 0 means all.
+// A checksum.Error is returned when a block is corrupted, its offset is relative to s.
+func (s Segment) content(blockCapacity int64, limit int) (p []byte, err error) {
+	parts := int64(len(s)) / blockCapacity
 	p = make([]byte, 0, len(s))
-	blockSize := s.blocks()
-	blockCapacity := int64(sLen) / blockSize
-	blockIdx := int64(binary.LittleEndian.Uint16(s[4:6]))
-	for i := blockIdx; i <= blockSize; i++ {
-		length := binary.LittleEndian.Uint32(s[blockCapacity*(i-1) : blockCapacity*(i-1)+4])
-		idx := int64(binary.LittleEndian.Uint16(s[blockCapacity*(i-1)+4 : blockCapacity*(i-1)+6]))
-		if idx != i {
+	for i := int64(1); i <= parts; i++ {
+		block := Block(s[blockCapacity*(i-1) : blockCapacity*i])
+		if !block.verify() {
+			p = nil
+			err = &checksum.Error{Offset: blockCapacity * (i - 1), Structure: "block"}
+			return
+		}
+		length := block.length()
+		idx := int64(binary.LittleEndian.Uint16(block[4:6]))
+		if idx != i || int64(length) > blockCapacity-blockHeadSize {
 			err = fmt.Errorf("incomplete")
 			return
 		}
-		p = append(p, s[uint32(blockCapacity*(i-1)):uint32(blockCapacity*i)][uint32(blockCapacity)-length:]...)
+		p = append(p, block[uint32(blockCapacity)-length:]...)
+		if limit >= 0 && len(p) >= limit {
+			return
+		}
 	}
 	return
 }
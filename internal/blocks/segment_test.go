@@ -2,8 +2,10 @@ package blocks_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/aacfactory/tapedb/internal/blocks"
+	"github.com/aacfactory/tapedb/internal/checksum"
 	"testing"
 	"time"
 )
@@ -14,3 +16,64 @@ func TestSegment_Read(t *testing.T) {
 	r, err := seg.Content()
 	fmt.Println(len(p) == len(r), bytes.Equal(p, r), string(r), err)
 }
+
+func TestSegment_Headers(t *testing.T) {
+	headers := map[string][]byte{
+		"type":    []byte("created"),
+		"version": []byte("2"),
+		"empty":   {},
+	}
+	for _, size := range []int{0, 10, 100, 1000} {
+		value := bytes.Repeat([]byte{'v'}, size)
+		seg := blocks.NewSegmentWithHeaders(blocks.EncodeHeaders(headers), value, 64)
+		content, contentErr := seg.Content()
+		if contentErr != nil {
+			t.Fatal(contentErr)
+		}
+		if !bytes.Equal(content, value) {
+			t.Fatal("unexpected content", size, len(content))
+		}
+		p, complete, headersErr := seg.Headers(64)
+		if headersErr != nil || !complete {
+			t.Fatal("unexpected headers", headersErr, complete)
+		}
+		decoded, decodeErr := blocks.DecodeHeaders(p)
+		if decodeErr != nil {
+			t.Fatal(decodeErr)
+		}
+		if len(decoded) != 3 || string(decoded["type"]) != "created" || string(decoded["version"]) != "2" {
+			t.Fatal("unexpected decoded headers", decoded)
+		}
+		if _, complete, _ = seg[:64].Headers(64); !complete {
+			t.Fatal("expected headers in the first block")
+		}
+	}
+	large := map[string][]byte{"large": bytes.Repeat([]byte{'h'}, 200)}
+	seg := blocks.NewSegmentWithHeaders(blocks.EncodeHeaders(large), []byte("value"), 64)
+	if _, complete, err := seg[:128].Headers(64); err != nil || complete {
+		t.Fatal("expected incomplete headers", complete, err)
+	}
+	if p, complete, _ := seg.Headers(64); !complete || len(p) != len(blocks.EncodeHeaders(large)) {
+		t.Fatal("expected complete headers")
+	}
+	if p, complete, _ := blocks.NewSegment([]byte("value"), 64).Headers(64); !complete || p != nil {
+		t.Fatal("expected no headers")
+	}
+}
+
+func TestSegment_Checksum(t *testing.T) {
+	p := bytes.Repeat([]byte{'v'}, 100)
+	seg := blocks.NewSegment(p, 64)
+	seg[64+60] ^= 0xff
+	_, err := seg.Content()
+	var corrupted *checksum.Error
+	if !errors.As(err, &corrupted) || corrupted.Offset != 64 || corrupted.Structure != "block" {
+		t.Fatal("expected corrupted second block", err)
+	}
+	// the head of a block is covered by its checksum too
+	seg = blocks.NewSegment(p, 64)
+	seg[3] ^= 0x40
+	if _, err = seg.Content(); !errors.As(err, &corrupted) || corrupted.Offset != 0 {
+		t.Fatal("expected corrupted head of first block", err)
+	}
+}
@@ -1,9 +1,9 @@
 package blocks
 
 import (
-	"runtime"
+	"context"
+	"sync"
 	"sync/atomic"
-	"time"
 )
 
 func NewSequence(limit int64, value int64) (v *Sequence) {
@@ -12,15 +12,25 @@ func NewSequence(limit int64, value int64) (v *Sequence) {
 		tbc:     value + 1,
 		limit:   limit,
 		padding: [5]int64{},
+		mutex:   new(sync.Mutex),
+		pending: make(map[int64]int64),
+		changed: make(chan struct{}),
 	}
 	return
 }
 
+// Sequence allocates continuous ranges by Next, and confirms them in order by Confirm.
+// Ranges can be confirmed in any order, but the confirmed mark only moves over continuous confirmed ranges,
+// so every block before the mark was written, except blocks of failed writes, which are confirmed too so later ranges are not blocked,
+// but no position refers to them.
 type Sequence struct {
 	value   int64
 	tbc     int64
 	limit   int64
 	padding [5]int64
+	mutex   *sync.Mutex
+	pending map[int64]int64
+	changed chan struct{}
 }
 
 func (seq *Sequence) Value() (v int64) {
@@ -28,30 +38,82 @@ func (seq *Sequence) Value() (v int64) {
 	return
 }
 
+func (seq *Sequence) Confirmed() (v int64) {
+	v = atomic.LoadInt64(&seq.tbc) - 1
+	return
+}
+
+func (seq *Sequence) Limit() (v int64) {
+	v = seq.limit
+	return
+}
+
 func (seq *Sequence) HasRemains() (ok bool) {
 	ok = seq.Value() < seq.limit
 	return
 }
 
+// Next allocates n continuous numbers, i is the first one, ok is false when there are no enough remains.
 func (seq *Sequence) Next(n int64) (i int64, ok bool) {
-	if seq.HasRemains() {
-		i = atomic.AddInt64(&seq.value, n) - n + 1
+	for {
+		value := seq.Value()
+		if value+n > seq.limit {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&seq.value, value, value+n) {
+			i = value + 1
+			ok = true
+			return
+		}
 	}
-	return
 }
 
-func (seq *Sequence) Confirm(n int64, span int64) (ok bool, err error) {
-	loops := 10
+// Confirm confirms the range which begins at n, the confirmed mark moves when all ranges before it were confirmed.
+func (seq *Sequence) Confirm(n int64, span int64) {
+	seq.mutex.Lock()
+	tbc := atomic.LoadInt64(&seq.tbc)
+	if n < tbc {
+		seq.mutex.Unlock()
+		return
+	}
+	seq.pending[n] = span
+	moved := false
 	for {
-		if atomic.CompareAndSwapInt64(&seq.tbc, n, n+span) {
+		s, has := seq.pending[tbc]
+		if !has {
 			break
 		}
-		loops--
-		if loops < 1 {
-			loops = 10
-			runtime.Gosched()
+		delete(seq.pending, tbc)
+		tbc = tbc + s
+		moved = true
+	}
+	if !moved {
+		seq.mutex.Unlock()
+		return
+	}
+	atomic.StoreInt64(&seq.tbc, tbc)
+	changed := seq.changed
+	seq.changed = make(chan struct{})
+	seq.mutex.Unlock()
+	close(changed)
+}
+
+// Wait waits until the confirmed mark reaches n, or ctx is done.
+func (seq *Sequence) Wait(ctx context.Context, n int64) (err error) {
+	for {
+		seq.mutex.Lock()
+		if seq.Confirmed() >= n {
+			seq.mutex.Unlock()
+			return
+		}
+		changed := seq.changed
+		seq.mutex.Unlock()
+		select {
+		case <-changed:
+			break
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
 		}
-		time.Sleep(50 * time.Microsecond)
 	}
-	return
 }
@@ -0,0 +1,39 @@
+package blocks_test
+
+import (
+	"context"
+	"github.com/aacfactory/tapedb/internal/blocks"
+	"testing"
+	"time"
+)
+
+func TestSequence_Confirm(t *testing.T) {
+	seq := blocks.NewSequence(10, 0)
+	a, _ := seq.Next(2)
+	b, _ := seq.Next(3)
+	c, _ := seq.Next(5)
+	if _, ok := seq.Next(1); ok {
+		t.Fatal("expected no remains")
+	}
+	seq.Confirm(c, 5)
+	seq.Confirm(b, 3)
+	if seq.Confirmed() != 0 {
+		t.Fatal("expected confirmed is 0, got", seq.Confirmed())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	if err := seq.Wait(ctx, b+2); err == nil {
+		t.Fatal("expected wait timeout")
+	}
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- seq.Wait(context.Background(), 10)
+	}()
+	seq.Confirm(a, 2)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if seq.Confirmed() != 10 {
+		t.Fatal("expected confirmed is 10, got", seq.Confirmed())
+	}
+}
@@ -0,0 +1,279 @@
+package blocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/checksum"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"github.com/aacfactory/tapedb/internal/lru"
+	"sync"
+	"time"
+)
+
+type VolumeOptions struct {
+	Path          string
+	No            int64
+	BlockCapacity int64
+	MaxBlocks     int64
+	PageBlocks    int64
+	Cache         *lru.LRU
+	// SyncInterval is the interval of background fsync, default is 1s, and negative means no background fsync.
+	SyncInterval time.Duration
+}
+
+func NewVolume(opts VolumeOptions) (v *Volume, err error) {
+	if opts.No <= 0 {
+		err = fmt.Errorf("new volume failed, no must be greater than 0")
+		return
+	}
+	if opts.BlockCapacity <= blockHeadSize {
+		err = fmt.Errorf("new volume failed, block capacity must be greater than %d", blockHeadSize)
+		return
+	}
+	if opts.MaxBlocks <= 0 || opts.PageBlocks <= 0 {
+		err = fmt.Errorf("new volume failed, max blocks and page blocks must be greater than 0")
+		return
+	}
+	file, openErr := ioutils.OpenFile(opts.Path)
+	if openErr != nil {
+		err = fmt.Errorf("new volume failed, %v", openErr)
+		return
+	}
+	size, sizeErr := file.Size()
+	if sizeErr != nil {
+		_ = file.Close()
+		err = fmt.Errorf("new volume failed, %v", sizeErr)
+		return
+	}
+	written := size / opts.BlockCapacity
+	if size%opts.BlockCapacity != 0 {
+		written++
+	}
+	seq := NewSequence(opts.MaxBlocks, written)
+	syncInterval := opts.SyncInterval
+	if syncInterval == 0 {
+		syncInterval = 1 * time.Second
+	}
+	v = &Volume{
+		no:            opts.No,
+		path:          opts.Path,
+		blockCapacity: opts.BlockCapacity,
+		file:          file,
+		seq:           seq,
+		mutex:         new(sync.RWMutex),
+		reader:        NewPageReader(opts.No, seq, opts.BlockCapacity, file, opts.PageBlocks, opts.Cache),
+		counter:       new(sync.WaitGroup),
+		syncInterval:  syncInterval,
+		closeCh:       make(chan struct{}, 1),
+	}
+	v.counter.Add(1)
+	v.sync()
+	return
+}
+
+// Volume is a file of blocks, block n is at (n-1)*blockCapacity.
+type Volume struct {
+	no            int64
+	path          string
+	blockCapacity int64
+	file          *ioutils.File
+	seq           *Sequence
+	mutex         *sync.RWMutex
+	closed        bool
+	reader        *PageReader
+	counter       *sync.WaitGroup
+	syncInterval  time.Duration
+	closeCh       chan struct{}
+}
+
+func (v *Volume) No() (no int64) {
+	no = v.no
+	return
+}
+
+func (v *Volume) BlockCapacity() (n int64) {
+	n = v.blockCapacity
+	return
+}
+
+func (v *Volume) Blocks() (n int64) {
+	n = v.seq.Confirmed()
+	return
+}
+
+// Write writes segments into continuous blocks, ok is false when the volume has no room for them.
+// Writers write their blocks in parallel, and Write returns after all blocks before the written ones were confirmed,
+// so readers never see a gap before the written blocks.
+func (v *Volume) Write(ctx context.Context, segments ...Segment) (poss []Position, ok bool, err error) {
+	if len(segments) == 0 {
+		ok = true
+		return
+	}
+	n := int64(0)
+	for _, segment := range segments {
+		if int64(len(segment))%v.blockCapacity != 0 {
+			err = fmt.Errorf("volume %d write failed, size of segment is not matched with block capacity", v.no)
+			return
+		}
+		n = n + int64(len(segment))/v.blockCapacity
+	}
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	if v.closed {
+		err = fmt.Errorf("volume %d write failed, volume was closed", v.no)
+		return
+	}
+	beg, has := v.seq.Next(n)
+	if !has {
+		return
+	}
+	p := make([]byte, 0, n*v.blockCapacity)
+	poss = make([]Position, 0, len(segments))
+	no := beg
+	for _, segment := range segments {
+		blocks := int64(len(segment)) / v.blockCapacity
+		p = append(p, segment...)
+		poss = append(poss, NewPosition(no, uint32(v.no), uint32(blocks)))
+		no = no + blocks
+	}
+	writeErr := v.file.WriteAt((beg-1)*v.blockCapacity, p)
+	if writeErr != nil {
+		// confirm even if it was failed, otherwise the blocks after it can not be confirmed,
+		// and no position refers to the failed blocks, so they are never read.
+		v.seq.Confirm(beg, n)
+		err = fmt.Errorf("volume %d write failed, %v", v.no, writeErr)
+		poss = nil
+		return
+	}
+	v.seq.Confirm(beg, n)
+	waitErr := v.seq.Wait(ctx, beg+n-1)
+	if waitErr != nil {
+		err = fmt.Errorf("volume %d write failed, wait for confirming failed, %v", v.no, waitErr)
+		poss = nil
+		return
+	}
+	ok = true
+	return
+}
+
+func (v *Volume) Read(pos Position) (p []byte, err error) {
+	if int64(pos.Idx()) != v.no {
+		err = fmt.Errorf("volume %d read failed, %s is not in this volume", v.no, pos)
+		return
+	}
+	seg, readErr := v.reader.ReadSegment(pos)
+	if readErr != nil {
+		err = fmt.Errorf("volume %d read failed, %w", v.no, v.corrupted(pos, readErr))
+		return
+	}
+	p, err = seg.Content()
+	if err != nil {
+		err = v.corrupted(pos, err)
+	}
+	return
+}
+
+// ReadSegment returns the raw blocks of the segment of pos from the file, they are neither cached nor verified.
+func (v *Volume) ReadSegment(pos Position) (seg Segment, err error) {
+	if int64(pos.Idx()) != v.no {
+		err = fmt.Errorf("volume %d read segment failed, %s is not in this volume", v.no, pos)
+		return
+	}
+	p, readErr := v.file.ReadAt((pos.No()-1)*v.blockCapacity, int64(pos.Size())*v.blockCapacity)
+	if readErr != nil {
+		err = fmt.Errorf("volume %d read segment failed, %v", v.no, readErr)
+		return
+	}
+	seg = p
+	return
+}
+
+// corrupted fills the file of a checksum.Error of the segment of pos, and makes its offset relative to the volume.
+func (v *Volume) corrupted(pos Position, err error) error {
+	var e *checksum.Error
+	if errors.As(err, &e) {
+		e.File = v.path
+		e.Offset = e.Offset + (pos.No()-1)*v.blockCapacity
+	}
+	return err
+}
+
+// ReadHeaders returns encoded headers of the segment of pos, the value is not decoded,
+// and only the first page of the segment is read when it holds all headers.
+func (v *Volume) ReadHeaders(pos Position) (headers []byte, err error) {
+	if int64(pos.Idx()) != v.no {
+		err = fmt.Errorf("volume %d read headers failed, %s is not in this volume", v.no, pos)
+		return
+	}
+	head, readErr := v.reader.ReadSegmentHead(pos)
+	if readErr != nil {
+		err = fmt.Errorf("volume %d read headers failed, %w", v.no, v.corrupted(pos, readErr))
+		return
+	}
+	headers, complete, headersErr := head.Headers(v.blockCapacity)
+	if headersErr != nil {
+		err = fmt.Errorf("volume %d read headers failed, %w", v.no, v.corrupted(pos, headersErr))
+		return
+	}
+	if complete {
+		return
+	}
+	seg, segErr := v.reader.ReadSegment(pos)
+	if segErr != nil {
+		err = fmt.Errorf("volume %d read headers failed, %w", v.no, v.corrupted(pos, segErr))
+		return
+	}
+	headers, _, headersErr = seg.Headers(v.blockCapacity)
+	if headersErr != nil {
+		err = fmt.Errorf("volume %d read headers failed, %w", v.no, v.corrupted(pos, headersErr))
+		return
+	}
+	return
+}
+
+func (v *Volume) Sync() (err error) {
+	err = v.file.Sync()
+	return
+}
+
+func (v *Volume) sync() {
+	go func(file *ioutils.File, syncInterval time.Duration, closeCh chan struct{}, cd *sync.WaitGroup) {
+		for {
+			stop := false
+			var tick <-chan time.Time
+			if syncInterval > 0 {
+				tick = time.After(syncInterval)
+			}
+			select {
+			case <-closeCh:
+				stop = true
+				break
+			case <-tick:
+				_ = file.Sync()
+			}
+			if stop {
+				break
+			}
+		}
+		cd.Done()
+	}(v.file, v.syncInterval, v.closeCh, v.counter)
+}
+
+func (v *Volume) Close() (err error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.closed {
+		return
+	}
+	v.closed = true
+	close(v.closeCh)
+	v.counter.Wait()
+	err = v.Sync()
+	if err != nil {
+		_ = v.file.Close()
+		return
+	}
+	err = v.file.Close()
+	return
+}
@@ -0,0 +1,67 @@
+package blocks_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/aacfactory/tapedb/internal/blocks"
+	"github.com/aacfactory/tapedb/internal/lru"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestVolume_WriteFailed limits the file size of the process, so the write of the second segment fails with EFBIG.
+func TestVolume_WriteFailed(t *testing.T) {
+	cache, cacheErr := lru.NewLRU(8, nil)
+	if cacheErr != nil {
+		t.Fatal(cacheErr)
+	}
+	v, err := blocks.NewVolume(blocks.VolumeOptions{
+		Path:          filepath.Join(t.TempDir(), "1.vol"),
+		No:            1,
+		BlockCapacity: 64,
+		MaxBlocks:     1024,
+		PageBlocks:    4,
+		Cache:         cache,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	a, ok, writeErr := v.Write(context.Background(), blocks.NewSegment([]byte("a"), 64))
+	if writeErr != nil || !ok {
+		t.Fatal("write failed", ok, writeErr)
+	}
+	var limit syscall.Rlimit
+	if err = syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Setrlimit(syscall.RLIMIT_FSIZE, &syscall.Rlimit{Cur: 128, Max: limit.Max}); err != nil {
+		t.Skip("file size limit can not be set", err)
+	}
+	// blocks 2 to 4
+	_, _, writeErr = v.Write(context.Background(), blocks.NewSegment(bytes.Repeat([]byte("b"), 150), 64))
+	if err = syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	if writeErr == nil {
+		t.Fatal("expected write failed")
+	}
+	// blocks 5 to 8 are not blocked by the failed write
+	c, ok, writeErr := v.Write(context.Background(), blocks.NewSegment(bytes.Repeat([]byte("c"), 200), 64))
+	if writeErr != nil || !ok {
+		t.Fatal("write failed", ok, writeErr)
+	}
+	if c[0].No() != 5 || v.Blocks() != 8 {
+		t.Fatal("unexpected blocks", c[0].No(), v.Blocks())
+	}
+	if p, readErr := v.Read(a[0]); readErr != nil || string(p) != "a" {
+		t.Fatal("unexpected value of a", readErr)
+	}
+	if p, readErr := v.Read(c[0]); readErr != nil || !bytes.Equal(p, bytes.Repeat([]byte("c"), 200)) {
+		t.Fatal("unexpected value of c", readErr)
+	}
+	if _, readErr := v.Read(blocks.NewPosition(2, 1, 3)); readErr == nil {
+		t.Fatal("expected failed blocks can not be read")
+	}
+}
@@ -0,0 +1,56 @@
+package blocks_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/blocks"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestVolume_Write(t *testing.T) {
+	v, err := blocks.NewVolume(blocks.VolumeOptions{
+		Path:          filepath.Join(t.TempDir(), "1.vol"),
+		No:            1,
+		BlockCapacity: 64,
+		MaxBlocks:     1024,
+		PageBlocks:    8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	wg := new(sync.WaitGroup)
+	poss := make([]blocks.Position, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := bytes.Repeat([]byte(fmt.Sprintf("%d,", i)), i%10+1)
+			written, ok, writeErr := v.Write(context.Background(), blocks.NewSegment(p, 64))
+			if writeErr != nil || !ok {
+				t.Error("write failed", ok, writeErr)
+				return
+			}
+			if v.Blocks() < written[0].No()+int64(written[0].Size())-1 {
+				t.Error("written blocks were not confirmed")
+			}
+			poss[i] = written[0]
+		}(i)
+	}
+	wg.Wait()
+	for i, pos := range poss {
+		p, readErr := v.Read(pos)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if !bytes.Equal(p, bytes.Repeat([]byte(fmt.Sprintf("%d,", i)), i%10+1)) {
+			t.Fatal("unexpected value", i, string(p))
+		}
+	}
+	if err = v.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
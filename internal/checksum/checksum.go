@@ -0,0 +1,27 @@
+package checksum
+
+import (
+	"fmt"
+	"hash/crc32"
+)
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+// Sum returns the crc32c of parts as if they were one slice, so a structure can skip the bytes which hold its checksum.
+func Sum(parts ...[]byte) (v uint32) {
+	for _, part := range parts {
+		v = crc32.Update(v, table, part)
+	}
+	return
+}
+
+// Error is returned when the checksum of a structure is not matched, Offset is the offset of the structure in File.
+type Error struct {
+	File      string
+	Offset    int64
+	Structure string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at %d of %s is corrupted", e.Structure, e.Offset, e.File)
+}
@@ -0,0 +1,70 @@
+// Package crashtest runs a test in a child process of the test binary and kills it, so files are reopened after a real crash.
+package crashtest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	dirEnv    = "TAPEDB_CRASH_DIR"
+	readyLine = "crashtest: ready"
+)
+
+// Child returns the dir of the crashed files when the test runs in the child process.
+func Child() (dir string, ok bool) {
+	dir = os.Getenv(dirEnv)
+	ok = dir != ""
+	return
+}
+
+// Ready tells the parent the child can be killed, it never returns.
+func Ready() {
+	fmt.Println(readyLine)
+	_ = os.Stdout.Sync()
+	for {
+		time.Sleep(time.Hour)
+	}
+}
+
+// Kill runs the test name in a child process with dir, and kills it by SIGKILL once it is ready.
+// The child must call Ready, the test fails when the child exits before it.
+func Kill(t testing.TB, name string, dir string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^"+name+"$", "-test.count=1")
+	cmd.Env = append(os.Environ(), dirEnv+"="+dir)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	stdout, pipeErr := cmd.StdoutPipe()
+	if pipeErr != nil {
+		t.Fatal(pipeErr)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	output := new(strings.Builder)
+	ready := false
+	lines := bufio.NewScanner(stdout)
+	for lines.Scan() {
+		if lines.Text() == readyLine {
+			ready = true
+			break
+		}
+		output.WriteString(lines.Text())
+		output.WriteByte('\n')
+	}
+	if !ready {
+		_ = cmd.Wait()
+		t.Fatalf("child of %s exited before it was ready\n%s%s", name, output, stderr)
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	_ = cmd.Wait()
+}
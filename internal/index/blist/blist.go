@@ -3,29 +3,33 @@ package blist
 import (
 	"encoding/binary"
 	"fmt"
-	"github.com/aacfactory/tapedb/internal/ioutils"
+	"github.com/aacfactory/tapedb/internal/checksum"
+	"github.com/aacfactory/tapedb/internal/journal"
 	"github.com/aacfactory/tapedb/internal/lru"
+	"sort"
 	"sync"
-	"time"
 )
 
+// head: [closed][free]
+// free is the no of the first freed list, freed lists are chained by next.
 const (
 	headSize      = 4096
 	listSize      = listHead + itemSize*(maxItems)
 	maxCacheLists = 4096 * 64 // 64M
 )
 
-var (
-	NotSafelyClosedErr = fmt.Errorf("blist was not safely closed")
-)
-
 type Options struct {
 	Path          string
 	MaxCacheLists int64
+	// Full is called when written lists in memory are too many, see journal.Options.
+	Full func()
 }
 
 func New(opts Options) (b *BList, err error) {
-	file, openErr := ioutils.OpenFile(opts.Path)
+	file, openErr := journal.New(journal.Options{
+		Path: opts.Path,
+		Full: opts.Full,
+	})
 	if openErr != nil {
 		err = fmt.Errorf("new blist failed, %v", openErr)
 		return
@@ -40,38 +44,39 @@ func New(opts Options) (b *BList, err error) {
 		return
 	}
 	b = &BList{
-		mutex:        new(sync.RWMutex),
-		num:          0,
-		file:         file,
-		cache:        cache,
-		counter:      new(sync.WaitGroup),
-		syncInterval: 1 * time.Second,
-		closeCh:      make(chan struct{}, 1),
+		mutex:   new(sync.RWMutex),
+		num:     0,
+		free:    make([]int64, 0, 1),
+		file:    file,
+		cache:   cache,
+		counter: new(sync.WaitGroup),
 	}
 	err = b.load()
 	if err != nil {
 		_ = b.file.Close()
-		err = fmt.Errorf("load blist from file failed, %v", err)
+		err = fmt.Errorf("load blist from file failed, %w", err)
 		return
 	}
-	b.sync()
 	return
 }
 
 type BList struct {
-	mutex        *sync.RWMutex
-	file         *ioutils.File
-	cache        *lru.LRU
-	counter      *sync.WaitGroup
-	syncInterval time.Duration
-	closeCh      chan struct{}
-	num          int64
+	mutex   *sync.RWMutex
+	file    *journal.File
+	cache   *lru.LRU
+	counter *sync.WaitGroup
+	num     int64
+	free    []int64
+	// relocations are moved lists of each vacuum, iterators follow them to find their lists.
+	relocations []map[int64]int64
 }
 
 func (b *BList) AllocList() (list List, err error) {
 	b.counter.Add(1)
 	b.mutex.Lock()
+	b.file.Begin()
 	list, err = b.allocList()
+	b.end(&err)
 	b.mutex.Unlock()
 	b.counter.Done()
 	return
@@ -82,9 +87,16 @@ func (b *BList) Add(no int64, items [][]byte) (err error) {
 	defer b.mutex.Unlock()
 	b.counter.Add(1)
 	defer b.counter.Done()
-	tail, getTailErr := b.getTail(no)
-	if getTailErr != nil {
-		err = getTailErr
+	b.file.Begin()
+	defer b.end(&err)
+	head, readErr := b.read(no)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	tail, lists, locateErr := b.locate(head)
+	if locateErr != nil {
+		err = locateErr
 		return
 	}
 	dirty, addErr := b.add(tail.Copy(), items)
@@ -95,6 +107,16 @@ func (b *BList) Add(no int64, items [][]byte) (err error) {
 	if len(dirty) == 0 {
 		return
 	}
+	// dirty[0] is the new tail, and the last one is the old tail
+	newTail := dirty[0]
+	newTail.setLists(lists + int64(len(dirty)) - 1)
+	if last := dirty[len(dirty)-1]; last.No() == no {
+		last.setTail(newTail.No())
+	} else if prevTail, has := head.tail(); !has || prevTail != newTail.No() {
+		head = head.Copy()
+		head.setTail(newTail.No())
+		dirty = append(dirty, head)
+	}
 	for _, l := range dirty {
 		writeErr := b.write(l)
 		if writeErr != nil {
@@ -118,7 +140,6 @@ func (b *BList) Get(no int64, offset int64) (items [][]byte, err error) {
 	for i := int64(0); i < n; i++ {
 		next := list.next()
 		if next == 0 {
-			err = fmt.Errorf("out of range")
 			return
 		}
 		list, getErr = b.read(next)
@@ -143,10 +164,114 @@ func (b *BList) Get(no int64, offset int64) (items [][]byte, err error) {
 	return
 }
 
+// Iterator returns an iterator of items of list no from offset, items which are added after creating are also iterated.
+func (b *BList) Iterator(no int64, offset int64) (it *Iterator, err error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	list, getErr := b.read(no)
+	if getErr != nil {
+		err = getErr
+		return
+	}
+	idx := offset
+	for idx >= maxItems {
+		next := list.next()
+		if next == 0 {
+			break
+		}
+		list, getErr = b.read(next)
+		if getErr != nil {
+			err = getErr
+			return
+		}
+		idx = idx - maxItems
+	}
+	it = &Iterator{
+		b:    b,
+		list: list,
+		idx:  idx,
+		gen:  len(b.relocations),
+	}
+	return
+}
+
+// Search returns the smallest offset of items of list no which f is true for, f must be false then true along items.
+// Lists are skipped by their last items, and items in the found list are binary searched.
+// offset is the length of the list chain when f is false for all items.
+func (b *BList) Search(no int64, f func(item []byte) (ok bool)) (offset int64, err error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	list, getErr := b.read(no)
+	if getErr != nil {
+		err = getErr
+		return
+	}
+	for {
+		size := list.Size()
+		if size > 0 && f(list.item(size-1)) {
+			offset += int64(sort.Search(int(size), func(i int) bool {
+				return f(list.item(int64(i)))
+			}))
+			return
+		}
+		offset += size
+		next := list.next()
+		if next == 0 {
+			return
+		}
+		list, getErr = b.read(next)
+		if getErr != nil {
+			err = getErr
+			return
+		}
+	}
+}
+
+func (b *BList) Len(no int64) (n int64, err error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	_, n, err = b.getTailAndLen(no)
+	return
+}
+
+func (b *BList) Last(no int64) (item []byte, has bool, err error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	tail, getErr := b.getTail(no)
+	if getErr != nil {
+		err = getErr
+		return
+	}
+	size := tail.Size()
+	if size == 0 {
+		return
+	}
+	item = tail.Items(size - 1)[0]
+	has = true
+	return
+}
+
+// Flush writes lists in memory into the file and syncs it.
+func (b *BList) Flush() (err error) {
+	err = b.file.Flush()
+	return
+}
+
+// end commits writes since b.file.Begin, err is replaced when committing failed.
+func (b *BList) end(err *error) {
+	if commitErr := b.file.Commit(); commitErr != nil && *err == nil {
+		*err = commitErr
+	}
+}
+
+// File returns the file of the blist, its writes are kept in memory until they are flushed.
+func (b *BList) File() (file *journal.File) {
+	file = b.file
+	return
+}
+
+// Close closes the file, lists which were not flushed are dropped.
 func (b *BList) Close() (err error) {
-	b.counter.Wait()
-	b.counter.Add(1)
-	close(b.closeCh)
 	b.counter.Wait()
 	p := make([]byte, 8)
 	binary.BigEndian.PutUint64(p, uint64(1))
@@ -155,89 +280,360 @@ func (b *BList) Close() (err error) {
 		err = wErr
 		return
 	}
-	_ = b.file.Sync()
 	_ = b.file.Close()
 	return
 }
 
 func (b *BList) load() (err error) {
-	stat, statErr := b.file.File().Stat()
-	if statErr != nil {
-		err = fmt.Errorf("blist load failed, %v", statErr)
-		return
-	}
-	if stat.IsDir() {
-		err = fmt.Errorf("data file of blist must be file")
+	fileSize, sizeErr := b.file.Size()
+	if sizeErr != nil {
+		err = fmt.Errorf("blist load failed, %v", sizeErr)
 		return
 	}
-	fileSize := stat.Size()
 	if fileSize == 0 {
 		return
 	}
-	// stats
-	p, rErr := b.file.ReadAt(0, 8)
-	if rErr != nil {
-		err = rErr
-		return
+	// num
+	if fileSize > headSize {
+		b.num = (fileSize - headSize) / listSize
 	}
-	if binary.BigEndian.Uint64(p) != 1 {
-		err = NotSafelyClosedErr
+	// free
+	err = b.loadFree()
+	if err != nil {
 		return
 	}
-	// num
-	b.num = (fileSize - headSize) / listSize
 	// mark open
-	binary.BigEndian.PutUint64(p, 0)
+	p := make([]byte, 8)
 	wErr := b.file.WriteAt(0, p)
 	if wErr != nil {
 		err = wErr
 		return
 	}
-	syncErr := b.file.Sync()
-	if syncErr != nil {
-		err = syncErr
+	return
+}
+
+// Free makes list no and lists chained after it reusable, no must not be used after it.
+func (b *BList) Free(no int64) (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.counter.Add(1)
+	defer b.counter.Done()
+	b.file.Begin()
+	defer b.end(&err)
+	nos := make([]int64, 0, 1)
+	for no != 0 {
+		list, readErr := b.read(no)
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		nos = append(nos, no)
+		no = list.next()
+	}
+	for _, no := range nos {
+		err = b.pushFree(no)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Live returns the number of lists which are not freed, only lists after it are moved by Vacuum.
+func (b *BList) Live() (n int64) {
+	b.mutex.RLock()
+	n = b.num - int64(len(b.free))
+	b.mutex.RUnlock()
+	return
+}
+
+// Vacuum moves lists at the end of the file into freed slots, then truncates the file.
+// Iterators which were created before still work, they follow moved lists.
+// moved is called when a first list of a chain is moved, the owner of the chain must use the new no.
+func (b *BList) Vacuum(moved func(from int64, to int64) (err error)) (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.counter.Add(1)
+	defer b.counter.Done()
+	err = b.vacuum(moved)
+	if err != nil {
+		return
+	}
+	err = b.file.Truncate(headSize + b.num*listSize)
+	return
+}
+
+// vacuum moves lists in an operation, the file is truncated after the operation was committed.
+func (b *BList) vacuum(moved func(from int64, to int64) (err error)) (err error) {
+	b.file.Begin()
+	defer b.end(&err)
+	free := make(map[int64]bool, len(b.free))
+	for _, no := range b.free {
+		free[no] = true
+	}
+	relocations := make(map[int64]int64)
+	slots := append(make([]int64, 0, len(b.free)), b.free...)
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i] < slots[j]
+	})
+	for b.num > 0 {
+		if free[b.num] {
+			delete(free, b.num)
+			b.cache.Remove(b.num)
+			b.num--
+			continue
+		}
+		if len(slots) == 0 {
+			break
+		}
+		to := slots[0]
+		slots = slots[1:]
+		if !free[to] {
+			// slot was dropped from the end
+			continue
+		}
+		delete(free, to)
+		err = b.move(b.num, to, moved)
+		if err != nil {
+			return
+		}
+		relocations[b.num] = to
+		b.num--
+	}
+	if len(relocations) > 0 {
+		b.relocations = append(b.relocations, relocations)
+	}
+	// rebuild the chain of freed lists
+	b.free = b.free[:0]
+	err = b.writeFree(0)
+	if err != nil {
 		return
 	}
+	remains := make([]int64, 0, len(free))
+	for no := range free {
+		remains = append(remains, no)
+	}
+	sort.Slice(remains, func(i, j int) bool {
+		return remains[i] > remains[j]
+	})
+	for _, no := range remains {
+		err = b.pushFree(no)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
-func (b *BList) sync() {
-	go func(file *ioutils.File, syncInterval time.Duration, closeCh chan struct{}, cd *sync.WaitGroup) {
-		for {
-			stop := false
-			select {
-			case <-closeCh:
-				stop = true
-				break
-			case <-time.After(syncInterval):
-				_ = file.Sync()
-			}
-			if stop {
-				break
+// move writes list from into slot to, and repoints its prev and next lists.
+func (b *BList) move(from int64, to int64, moved func(from int64, to int64) (err error)) (err error) {
+	list, readErr := b.read(from)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	list = list.Copy()
+	list.setNo(to)
+	if tail, has := list.tail(); has && tail == from {
+		list.setTail(to)
+	}
+	err = b.write(list)
+	if err != nil {
+		return
+	}
+	if prev := list.prev(); prev != 0 {
+		p, prevErr := b.read(prev)
+		if prevErr != nil {
+			err = prevErr
+			return
+		}
+		p = p.Copy()
+		p.setNext(to)
+		err = b.write(p)
+		if err != nil {
+			return
+		}
+	} else {
+		err = moved(from, to)
+		if err != nil {
+			return
+		}
+	}
+	if next := list.next(); next != 0 {
+		n, nextErr := b.read(next)
+		if nextErr != nil {
+			err = nextErr
+			return
+		}
+		n = n.Copy()
+		n.setPrev(to)
+		err = b.write(n)
+		if err != nil {
+			return
+		}
+	} else if prev := list.prev(); prev != 0 {
+		// the tail is moved, the head of the chain keeps it
+		head, headErr := b.read(prev)
+		for headErr == nil && head.prev() != 0 {
+			head, headErr = b.read(head.prev())
+		}
+		if headErr != nil {
+			err = headErr
+			return
+		}
+		if _, has := head.tail(); has {
+			head = head.Copy()
+			head.setTail(to)
+			err = b.write(head)
+			if err != nil {
+				return
 			}
 		}
-		cd.Done()
-	}(b.file, b.syncInterval, b.closeCh, b.counter)
+	}
+	b.cache.Remove(from)
+	return
+}
+
+// relocate returns the current no of list no which was seen at generation gen of vacuums.
+func (b *BList) relocate(no int64, gen int) (v int64, current int) {
+	v = no
+	for current = gen; current < len(b.relocations); current++ {
+		if to, moved := b.relocations[current][v]; moved {
+			v = to
+		}
+	}
+	return
 }
 
 func (b *BList) allocList() (list List, err error) {
-	b.num++
-	no := b.num
+	no := int64(0)
+	if n := len(b.free); n > 0 {
+		no = b.free[n-1]
+		b.free = b.free[:n-1]
+		head := int64(0)
+		if n > 1 {
+			head = b.free[n-2]
+		}
+		err = b.writeFree(head)
+		if err != nil {
+			return
+		}
+	} else {
+		b.num++
+		no = b.num
+	}
 	list = NewList(no)
 	err = b.write(list)
 	return
 }
 
-func (b *BList) getTail(idx int64) (list List, err error) {
-	list, err = b.read(idx)
+// pushFree chains list no before the first freed list.
+func (b *BList) pushFree(no int64) (err error) {
+	head := int64(0)
+	if n := len(b.free); n > 0 {
+		head = b.free[n-1]
+	}
+	list := NewList(no)
+	list.setNext(head)
+	err = b.write(list)
+	if err != nil {
+		return
+	}
+	err = b.writeFree(no)
 	if err != nil {
 		return
 	}
-	next := list.next()
-	if next == 0 {
+	b.free = append(b.free, no)
+	return
+}
+
+func (b *BList) writeFree(head int64) (err error) {
+	p := make([]byte, 8)
+	binary.BigEndian.PutUint64(p, uint64(head))
+	err = b.file.WriteAt(8, p)
+	return
+}
+
+// loadFree reads the chain of freed lists, the first one is at the end of b.free.
+func (b *BList) loadFree() (err error) {
+	p, readErr := b.file.ReadAt(8, 8)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	nos := make([]int64, 0, 1)
+	if len(p) == 8 {
+		no := int64(binary.BigEndian.Uint64(p))
+		for no != 0 {
+			if no < 0 || no > b.num || len(nos) > int(b.num) {
+				err = fmt.Errorf("freed lists of blist are broken")
+				return
+			}
+			list, listErr := b.read(no)
+			if listErr != nil {
+				err = listErr
+				return
+			}
+			nos = append(nos, no)
+			no = list.next()
+		}
+	}
+	for i := len(nos) - 1; i >= 0; i-- {
+		b.free = append(b.free, nos[i])
+	}
+	return
+}
+
+func (b *BList) getTail(idx int64) (list List, err error) {
+	list, _, err = b.getTailAndLen(idx)
+	return
+}
+
+// getTailAndLen returns the tail list and the number of items, lists before the tail are always full.
+func (b *BList) getTailAndLen(idx int64) (list List, n int64, err error) {
+	head, readErr := b.read(idx)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	lists := int64(0)
+	list, lists, err = b.locate(head)
+	if err != nil {
 		return
 	}
-	list, err = b.getTail(next)
+	n = (lists-1)*maxItems + list.Size()
+	return
+}
+
+// locate returns the tail list of the chain from head and the number of lists of the chain,
+// they are kept by the head and the tail, and the chain is only walked when it was written by older versions.
+func (b *BList) locate(head List) (tail List, lists int64, err error) {
+	if no, has := head.tail(); has {
+		tail = head
+		if no != head.No() {
+			tail, err = b.read(no)
+			if err != nil {
+				return
+			}
+		}
+		if n, ok := tail.lists(); ok {
+			lists = n
+			return
+		}
+	}
+	tail = head
+	lists = 1
+	for {
+		next := tail.next()
+		if next == 0 {
+			break
+		}
+		tail, err = b.read(next)
+		if err != nil {
+			return
+		}
+		lists++
+	}
 	return
 }
 
@@ -264,6 +660,7 @@ func (b *BList) add(l List, items [][]byte) (dirty []List, err error) {
 		if len(nextAddDirty) > 0 {
 			dirty = append(dirty, nextAddDirty...)
 		}
+		adds++
 		break
 	}
 	if adds > 0 {
@@ -287,6 +684,11 @@ func (b *BList) read(no int64) (list List, err error) {
 	list = NewList(0)
 	copy(list, region.Bytes())
 	_ = region.Close()
+	if !list.verify() {
+		list = nil
+		err = &checksum.Error{File: b.file.Path(), Offset: offset, Structure: "blist list"}
+		return
+	}
 	b.cache.Add(no, list)
 	return
 }
@@ -294,7 +696,7 @@ func (b *BList) read(no int64) (list List, err error) {
 func (b *BList) write(list List) (err error) {
 	idx := list.No()
 	offset := headSize + (idx-1)*listSize
-	writeErr := b.file.WriteAt(offset, list)
+	writeErr := b.file.WriteAt(offset, list.sealed())
 	if writeErr != nil {
 		err = writeErr
 		return
@@ -2,8 +2,12 @@ package blist_test
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"github.com/aacfactory/tapedb/internal/checksum"
 	"github.com/aacfactory/tapedb/internal/index/blist"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -12,7 +16,7 @@ import (
 
 func TestNew(t *testing.T) {
 	b, bErr := blist.New(blist.Options{
-		Path:          `P:\tmp\bl1.txt`,
+		Path:          filepath.Join(t.TempDir(), "bl"),
 		MaxCacheLists: 0,
 	})
 	if bErr != nil {
@@ -71,7 +75,7 @@ func TestNew(t *testing.T) {
 
 func TestBList_Add(t *testing.T) {
 	b, bErr := blist.New(blist.Options{
-		Path:          `P:\tmp\bl1.txt`,
+		Path:          filepath.Join(t.TempDir(), "bl"),
 		MaxCacheLists: 0,
 	})
 	if bErr != nil {
@@ -83,7 +87,7 @@ func TestBList_Add(t *testing.T) {
 		_, _ = b.AllocList()
 	}
 	wg := new(sync.WaitGroup)
-	loops := 1000000
+	loops := 100000
 	sotErrs := int64(0)
 	now := time.Now()
 	for i := 0; i < loops; i++ {
@@ -100,10 +104,21 @@ func TestBList_Add(t *testing.T) {
 	wg.Wait()
 	sd := time.Now().Sub(now)
 	fmt.Println("set", loops, sotErrs, sd, sd/time.Duration(loops))
+	if sotErrs > 0 {
+		t.Fatal("expected no add error, got", sotErrs)
+	}
+	for _, no := range nos {
+		size, lenErr := b.Len(no)
+		if lenErr != nil || size != int64(loops/len(nos)) {
+			t.Fatal("expected", loops/len(nos), "items of", no, "got", size, lenErr)
+		}
+	}
 
+	// each get reads the whole chain, so gets are fewer than adds
+	gets := loops / 100
 	gotErrs := int64(0)
 	now = time.Now()
-	for i := 0; i < loops; i++ {
+	for i := 0; i < gets; i++ {
 		wg.Add(1)
 		no := nos[i%len(nos)]
 		go func(b *blist.BList, n int64, wg *sync.WaitGroup, no int64) {
@@ -116,5 +131,273 @@ func TestBList_Add(t *testing.T) {
 	}
 	wg.Wait()
 	gd := time.Now().Sub(now)
-	fmt.Println("got", loops, gotErrs, gd, gd/time.Duration(loops))
+	fmt.Println("got", gets, gotErrs, gd, gd/time.Duration(gets))
+	if gotErrs > 0 {
+		t.Fatal("expected no get error, got", gotErrs)
+	}
+}
+
+func TestBList_Search(t *testing.T) {
+	b, bErr := blist.New(blist.Options{
+		Path: filepath.Join(t.TempDir(), "bl"),
+	})
+	if bErr != nil {
+		t.Fatal(bErr)
+	}
+	defer b.Close()
+	l, lErr := b.AllocList()
+	if lErr != nil {
+		t.Fatal(lErr)
+	}
+	items := make([][]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		items = append(items, pos(int64(i*2)))
+	}
+	if err := b.Add(l.No(), items); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []int64{0, 1, 2, 27, 28, 29, 198, 199, 500} {
+		offset, searchErr := b.Search(l.No(), func(item []byte) bool {
+			return int64(binary.BigEndian.Uint64(item[0:8])) >= target
+		})
+		if searchErr != nil {
+			t.Fatal(searchErr)
+		}
+		expected := (target + 1) / 2
+		if expected > 100 {
+			expected = 100
+		}
+		if offset != expected {
+			t.Fatal("unexpected offset of", target, offset, expected)
+		}
+	}
+}
+
+func TestBList_Vacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bl")
+	b, bErr := blist.New(blist.Options{
+		Path: path,
+	})
+	if bErr != nil {
+		t.Fatal(bErr)
+	}
+	// a, b and c are chains of 3 lists, and they are interleaved in the file
+	nos := make([]int64, 3)
+	for i := range nos {
+		l, lErr := b.AllocList()
+		if lErr != nil {
+			t.Fatal(lErr)
+		}
+		nos[i] = l.No()
+	}
+	for n := int64(0); n < 40; n++ {
+		for i, no := range nos {
+			if err := b.Add(no, [][]byte{pos(int64(i)*1000 + n)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := b.Free(nos[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, bErr = blist.New(blist.Options{
+		Path: path,
+	})
+	if bErr != nil {
+		t.Fatal(bErr)
+	}
+	defer b.Close()
+	// freed slots are reused
+	reused, allocErr := b.AllocList()
+	if allocErr != nil {
+		t.Fatal(allocErr)
+	}
+	if reused.No() > 9 {
+		t.Fatal("expected freed slot reused, got", reused.No())
+	}
+	if err := b.Free(reused.No()); err != nil {
+		t.Fatal(err)
+	}
+	// the last list of c is at the end of the file
+	it, itErr := b.Iterator(nos[2], 30)
+	if itErr != nil {
+		t.Fatal(itErr)
+	}
+	stat, _ := os.Stat(path)
+	size := stat.Size()
+	moved := make(map[int64]int64)
+	vacuumErr := b.Vacuum(func(from int64, to int64) (err error) {
+		moved[from] = to
+		return
+	})
+	if vacuumErr != nil {
+		t.Fatal(vacuumErr)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ = os.Stat(path)
+	if stat.Size() >= size {
+		t.Fatal("expected file shrunk from", size, "got", stat.Size())
+	}
+	for i := 1; i < 3; i++ {
+		no := nos[i]
+		if to, has := moved[no]; has {
+			no = to
+		}
+		items, getErr := b.Get(no, 0)
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+		if len(items) != 40 {
+			t.Fatal("expected 40 items, got", len(items))
+		}
+		for n, item := range items {
+			if int64(binary.BigEndian.Uint64(item[0:8])) != int64(i)*1000+int64(n) {
+				t.Fatal("unexpected item", i, n)
+			}
+		}
+	}
+	// the iterator created before the vacuum follows moved lists
+	n := int64(30)
+	for {
+		item, ok, nextErr := it.Next()
+		if nextErr != nil {
+			t.Fatal(nextErr)
+		}
+		if !ok {
+			break
+		}
+		if int64(binary.BigEndian.Uint64(item[0:8])) != 2000+n {
+			t.Fatal("unexpected item of iterator", n)
+		}
+		n++
+	}
+	if n != 40 {
+		t.Fatal("expected 10 items of iterator, got", n-30)
+	}
+	// moved tails are still found by their heads
+	for i := 1; i < 3; i++ {
+		no := nos[i]
+		if to, has := moved[no]; has {
+			no = to
+		}
+		if err := b.Add(no, [][]byte{pos(int64(i)*1000 + 40)}); err != nil {
+			t.Fatal(err)
+		}
+		size, lenErr := b.Len(no)
+		if lenErr != nil || size != 41 {
+			t.Fatal("expected 41 items, got", size, lenErr)
+		}
+		last, has, lastErr := b.Last(no)
+		if lastErr != nil || !has || int64(binary.BigEndian.Uint64(last[0:8])) != int64(i)*1000+40 {
+			t.Fatal("unexpected last item", i, lastErr)
+		}
+	}
+}
+
+func TestBList_Len(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bl")
+	b, bErr := blist.New(blist.Options{
+		Path: path,
+	})
+	if bErr != nil {
+		t.Fatal(bErr)
+	}
+	l, lErr := b.AllocList()
+	if lErr != nil {
+		t.Fatal(lErr)
+	}
+	n := int64(0)
+	for batch := 1; n < 1000; batch = batch%20 + 1 {
+		items := make([][]byte, 0, batch)
+		for i := 0; i < batch; i++ {
+			items = append(items, pos(n))
+			n++
+		}
+		if err := b.Add(l.No(), items); err != nil {
+			t.Fatal(err)
+		}
+		size, lenErr := b.Len(l.No())
+		if lenErr != nil || size != n {
+			t.Fatal("expected", n, "items, got", size, lenErr)
+		}
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, bErr = blist.New(blist.Options{
+		Path: path,
+	})
+	if bErr != nil {
+		t.Fatal(bErr)
+	}
+	defer b.Close()
+	size, lenErr := b.Len(l.No())
+	if lenErr != nil || size != n {
+		t.Fatal("expected", n, "items after reopen, got", size, lenErr)
+	}
+	last, has, lastErr := b.Last(l.No())
+	if lastErr != nil || !has || int64(binary.BigEndian.Uint64(last[0:8])) != n-1 {
+		t.Fatal("unexpected last item", lastErr)
+	}
+	items, getErr := b.Get(l.No(), 0)
+	if getErr != nil || int64(len(items)) != n {
+		t.Fatal("unexpected items", len(items), getErr)
+	}
+	for i, item := range items {
+		if int64(binary.BigEndian.Uint64(item[0:8])) != int64(i) {
+			t.Fatal("unexpected item", i)
+		}
+	}
+}
+
+func TestBList_Corrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bl")
+	b, bErr := blist.New(blist.Options{
+		Path: path,
+	})
+	if bErr != nil {
+		t.Fatal(bErr)
+	}
+	l, lErr := b.AllocList()
+	if lErr != nil {
+		t.Fatal(lErr)
+	}
+	if err := b.Add(l.No(), [][]byte{pos(1), pos(2), pos(3)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := os.ReadFile(path)
+	// the second item of the first list, lists are after the 4096 bytes head, and items are after the 32 bytes head of a list
+	p[4096+32+16+7] ^= 0xff
+	if err := os.WriteFile(path, p, 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, bErr = blist.New(blist.Options{
+		Path: path,
+	})
+	if bErr != nil {
+		t.Fatal(bErr)
+	}
+	defer b.Close()
+	_, err := b.Get(l.No(), 0)
+	var corrupted *checksum.Error
+	if !errors.As(err, &corrupted) || corrupted.File != path || corrupted.Offset != 4096 || corrupted.Structure != "blist list" {
+		t.Fatal("expected corrupted list", err)
+	}
 }
@@ -0,0 +1,185 @@
+package blist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Checker reads chains of lists in a file without opening it, the file is not changed.
+type Checker struct {
+	file   *os.File
+	num    int64
+	freed  map[int64]bool
+	chains map[int64]int64
+}
+
+// NewChecker opens the file at path as read only, and reads the chain of freed lists,
+// broken is called with the offset and the problem of each inconsistency of the chain.
+func NewChecker(path string, broken func(offset int64, problem string)) (c *Checker, err error) {
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		err = fmt.Errorf("check blist failed, %v", openErr)
+		return
+	}
+	stat, statErr := file.Stat()
+	if statErr != nil {
+		_ = file.Close()
+		err = fmt.Errorf("check blist failed, %v", statErr)
+		return
+	}
+	c = &Checker{
+		file:   file,
+		num:    0,
+		freed:  make(map[int64]bool),
+		chains: make(map[int64]int64),
+	}
+	if stat.Size() > headSize {
+		c.num = (stat.Size() - headSize) / listSize
+		if (stat.Size()-headSize)%listSize != 0 {
+			broken(headSize+c.num*listSize, "the last list is truncated")
+		}
+	}
+	p, readErr := c.readAt(8, 8)
+	if readErr != nil {
+		_ = c.Close()
+		c = nil
+		err = readErr
+		return
+	}
+	no := int64(0)
+	if len(p) == 8 {
+		no = int64(binary.BigEndian.Uint64(p))
+	}
+	for no != 0 {
+		offset := headSize + (no-1)*listSize
+		if no < 0 || no > c.num {
+			broken(8, fmt.Sprintf("freed list %d is out of range", no))
+			break
+		}
+		if c.freed[no] {
+			broken(offset, fmt.Sprintf("freed list %d is chained more than once", no))
+			break
+		}
+		c.freed[no] = true
+		list, ok, listErr := c.read(no, broken)
+		if listErr != nil {
+			_ = c.Close()
+			c = nil
+			err = listErr
+			return
+		}
+		if !ok {
+			break
+		}
+		no = list.next()
+	}
+	return
+}
+
+// Chain follows the chain of lists from no, and checks checksums, nos, prev and next links, sizes, the tail and the number of lists of them,
+// lists before the tail must be full, and a list must not be freed or be in other chains.
+// visit is called with each item and the offset of its list, broken is called with each inconsistency,
+// and the chain is not followed after a broken list.
+func (c *Checker) Chain(no int64, visit func(offset int64, item []byte), broken func(offset int64, problem string)) (err error) {
+	prev := int64(0)
+	head := no
+	var headTail int64
+	var hasTail bool
+	lists := int64(0)
+	for no != 0 {
+		offset := headSize + (no-1)*listSize
+		if no < 0 || no > c.num {
+			broken(offset, fmt.Sprintf("list %d is out of range", no))
+			return
+		}
+		if c.freed[no] {
+			broken(offset, fmt.Sprintf("list %d is used and freed", no))
+			return
+		}
+		if first, has := c.chains[no]; has {
+			broken(offset, fmt.Sprintf("list %d is in the chain of %d", no, first))
+			return
+		}
+		c.chains[no] = no
+		if prev != 0 {
+			c.chains[no] = c.chains[prev]
+		}
+		list, ok, readErr := c.read(no, broken)
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		if !ok {
+			return
+		}
+		if list.prev() != prev {
+			broken(offset, fmt.Sprintf("prev %d of list %d is not %d", list.prev(), no, prev))
+			return
+		}
+		size := list.Size()
+		if size > maxItems || (list.next() != 0 && size != maxItems) {
+			broken(offset, fmt.Sprintf("size %d of list %d is invalid", size, no))
+			return
+		}
+		for i := int64(0); i < size; i++ {
+			visit(offset, list.item(i))
+		}
+		lists++
+		if prev == 0 {
+			headTail, hasTail = list.tail()
+		}
+		if list.next() == 0 {
+			if hasTail && headTail != no {
+				broken(headSize+(head-1)*listSize, fmt.Sprintf("tail %d of list %d is not %d", headTail, head, no))
+			}
+			if n, has := list.lists(); has && n != lists {
+				broken(offset, fmt.Sprintf("lists %d of list %d is not %d", n, no, lists))
+			}
+		}
+		prev = no
+		no = list.next()
+	}
+	return
+}
+
+// read returns the list no, ok is false when the list is broken.
+func (c *Checker) read(no int64, broken func(offset int64, problem string)) (list List, ok bool, err error) {
+	offset := headSize + (no-1)*listSize
+	p, readErr := c.readAt(offset, listSize)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	if len(p) < listSize {
+		broken(offset, fmt.Sprintf("list %d is truncated", no))
+		return
+	}
+	list = p
+	if !list.verify() {
+		broken(offset, fmt.Sprintf("checksum of list %d is not matched", no))
+		return
+	}
+	if list.No() != no {
+		broken(offset, fmt.Sprintf("no of list %d is %d", no, list.No()))
+		return
+	}
+	ok = true
+	return
+}
+
+func (c *Checker) readAt(offset int64, capacity int64) (p []byte, err error) {
+	p = make([]byte, capacity)
+	n, readErr := c.file.ReadAt(p, offset)
+	p = p[:n]
+	if readErr != nil && readErr != io.EOF {
+		err = fmt.Errorf("check blist failed, %v", readErr)
+	}
+	return
+}
+
+func (c *Checker) Close() (err error) {
+	err = c.file.Close()
+	return
+}
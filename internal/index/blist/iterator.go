@@ -0,0 +1,51 @@
+package blist
+
+// Iterator iterates items of a list chain, it only holds one list.
+type Iterator struct {
+	b    *BList
+	list List
+	idx  int64
+	gen  int
+}
+
+// Next returns the next item, ok is false when there is no more item for now.
+// Calling Next again after items were added returns them.
+func (it *Iterator) Next() (item []byte, ok bool, err error) {
+	for {
+		if it.idx < it.list.Size() {
+			item = it.list.item(it.idx)
+			it.idx++
+			ok = true
+			return
+		}
+		// the held list may be stale, read it again to get added items and the next list.
+		it.b.mutex.RLock()
+		no, gen := it.b.relocate(it.list.No(), it.gen)
+		it.gen = gen
+		list, readErr := it.b.read(no)
+		if readErr != nil {
+			it.b.mutex.RUnlock()
+			err = readErr
+			return
+		}
+		if it.idx < list.Size() {
+			it.b.mutex.RUnlock()
+			it.list = list
+			continue
+		}
+		next := list.next()
+		if next == 0 || it.idx < maxItems {
+			it.b.mutex.RUnlock()
+			it.list = list
+			return
+		}
+		nextList, nextErr := it.b.read(next)
+		it.b.mutex.RUnlock()
+		if nextErr != nil {
+			err = nextErr
+			return
+		}
+		it.list = nextList
+		it.idx = it.idx - maxItems
+	}
+}
@@ -1,11 +1,19 @@
 package blist
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"github.com/aacfactory/tapedb/internal/checksum"
+)
 
+// list: [no][crc32c|size][prev][next][items]
+// prev of the first list of a chain is never a link, it keeps the no of the tail list of the chain with linkFlag,
+// and next of the tail list keeps the number of lists of the chain with linkFlag, so the tail and the length are read in O(1).
+// They are 0 in chains which were written by older versions, and the chain is walked until it is added again.
 const (
 	listHead = 32
 	itemSize = 16
 	maxItems = 14
+	linkFlag = uint64(1) << 63
 )
 
 func NewList(no int64) List {
@@ -27,17 +35,34 @@ func (l List) setNo(n int64) {
 }
 
 func (l List) Size() (n int64) {
-	n = int64(binary.BigEndian.Uint64(l[8:16]))
+	n = int64(binary.BigEndian.Uint32(l[12:16]))
 	return
 }
 
 func (l List) setSize(n int64) {
-	binary.BigEndian.PutUint64(l[8:16], uint64(n))
+	binary.BigEndian.PutUint32(l[12:16], uint32(n))
+	return
+}
+
+// sealed returns a copy of the list with its crc32c, the crc32c is in the high half of the size.
+func (l List) sealed() (v List) {
+	v = l.Copy()
+	binary.BigEndian.PutUint32(v[8:12], checksum.Sum(v[0:8], v[12:]))
+	return
+}
+
+func (l List) verify() (ok bool) {
+	expected := binary.BigEndian.Uint32(l[8:12])
+	ok = expected == checksum.Sum(l[0:8], l[12:])
 	return
 }
 
 func (l List) prev() (n int64) {
-	n = int64(binary.BigEndian.Uint64(l[16:24]))
+	v := binary.BigEndian.Uint64(l[16:24])
+	if v&linkFlag != 0 {
+		return
+	}
+	n = int64(v)
 	return
 }
 
@@ -47,7 +72,11 @@ func (l List) setPrev(prev int64) {
 }
 
 func (l List) next() (n int64) {
-	n = int64(binary.BigEndian.Uint64(l[24:32]))
+	v := binary.BigEndian.Uint64(l[24:32])
+	if v&linkFlag != 0 {
+		return
+	}
+	n = int64(v)
 	return
 }
 
@@ -56,6 +85,38 @@ func (l List) setNext(next int64) {
 	return
 }
 
+// tail returns the no of the tail list which is kept by the first list of a chain.
+func (l List) tail() (no int64, has bool) {
+	v := binary.BigEndian.Uint64(l[16:24])
+	if v&linkFlag == 0 {
+		return
+	}
+	no = int64(v &^ linkFlag)
+	has = true
+	return
+}
+
+func (l List) setTail(no int64) {
+	binary.BigEndian.PutUint64(l[16:24], linkFlag|uint64(no))
+	return
+}
+
+// lists returns the number of lists of the chain which is kept by the tail list.
+func (l List) lists() (n int64, has bool) {
+	v := binary.BigEndian.Uint64(l[24:32])
+	if v&linkFlag == 0 {
+		return
+	}
+	n = int64(v &^ linkFlag)
+	has = true
+	return
+}
+
+func (l List) setLists(n int64) {
+	binary.BigEndian.PutUint64(l[24:32], linkFlag|uint64(n))
+	return
+}
+
 func (l List) Items(offset int64) (items [][]byte) {
 	n := l.Size()
 	if n == 0 {
@@ -68,6 +129,11 @@ func (l List) Items(offset int64) (items [][]byte) {
 	return
 }
 
+func (l List) item(i int64) (item []byte) {
+	item = l[i*itemSize+listHead : (i+1)*itemSize+listHead]
+	return
+}
+
 func (l List) Add(p []byte) (ok bool) {
 	n := l.Size()
 	if n >= maxItems {
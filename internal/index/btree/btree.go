@@ -4,33 +4,49 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"github.com/aacfactory/tapedb/internal/ioutils"
+	"github.com/aacfactory/tapedb/internal/checksum"
+	"github.com/aacfactory/tapedb/internal/journal"
 	"github.com/aacfactory/tapedb/internal/lru"
+	"hash/crc32"
+	"sort"
 	"sync"
 	"sync/atomic"
-	"time"
 )
 
+// head: two copies of [seq][root][closed][free][size][pending_len][...pending][crc32] at headCopyOffset,
+// a commit writes the copy of the older seq, so a torn write of the head never breaks the newer one.
+// free is the idx of the first freed node slot, the first 8 bytes of a freed slot is the idx of the next freed one.
+// pending are slots which were freed by the last commit, they are linked into freed slots by the next commit,
+// because the tree of the previous head still uses them until the head of the last commit is written.
+// A tree which file is not empty must have a valid copy, otherwise it is corrupted.
 const (
-	degree        = 256          // 256 36k/node
-	maxItems      = degree*2 - 1 // max items per node. max children is +1
-	maxKeyLen     = 48
-	maxCacheNodes = 32 * 64 // 64M
-	headSize      = 4096
+	degree         = 256          // 256 36k/node
+	maxItems       = degree*2 - 1 // max items per node. max children is +1
+	minItems       = degree - 1   // min items per node except the root
+	maxKeyLen      = 48
+	maxCacheNodes  = 32 * 64 // 64M
+	headSize       = 4096
+	headCopyOffset = 1024
+	headCopySize   = 1024
 )
 
-var (
-	NotSafelyClosedErr = fmt.Errorf("btree was not safely closed")
-)
+// maxPendingSlots is the number of pending slots which fit in a copy of the head,
+// a commit frees at most three nodes of each level, so it is never reached by a tree which fits in a file.
+const maxPendingSlots = (headCopySize - 44 - 4) / 8
 
 type Options struct {
 	Path          string
 	MaxCacheNodes int64
 	Less          func(a []byte, b []byte) (ok bool)
+	// Full is called when written nodes in memory are too many, see journal.Options.
+	Full func()
 }
 
 func New(opts Options) (tr *BTree, err error) {
-	file, openErr := ioutils.OpenFile(opts.Path)
+	file, openErr := journal.New(journal.Options{
+		Path: opts.Path,
+		Full: opts.Full,
+	})
 	if openErr != nil {
 		err = fmt.Errorf("new btree failed, %v", openErr)
 		return
@@ -45,57 +61,39 @@ func New(opts Options) (tr *BTree, err error) {
 		return
 	}
 	tr = &BTree{
-		mutex:        new(sync.RWMutex),
-		cow:          new(cow),
-		root:         nil,
-		size:         0,
-		file:         file,
-		lessFn:       opts.Less,
-		cache:        cache,
-		counter:      new(sync.WaitGroup),
-		syncInterval: 1 * time.Second,
-		closeCh:      make(chan struct{}, 1),
+		mutex:   new(sync.RWMutex),
+		cow:     new(cow),
+		root:    nil,
+		size:    0,
+		seq:     0,
+		free:    make([]int64, 0, 1),
+		pending: nil,
+		file:    file,
+		lessFn:  opts.Less,
+		cache:   cache,
+		counter: new(sync.WaitGroup),
 	}
 	err = tr.load()
 	if err != nil {
 		_ = tr.file.Close()
-		err = fmt.Errorf("load btree from file failed, %v", err)
+		err = fmt.Errorf("load btree from file failed, %w", err)
 		return
 	}
-	tr.sync()
 	return
 }
 
 type BTree struct {
-	mutex        *sync.RWMutex
-	cow          *cow
-	root         *node
-	size         int64
-	file         *ioutils.File
-	cache        *lru.LRU
-	lessFn       func(a []byte, b []byte) (ok bool)
-	counter      *sync.WaitGroup
-	syncInterval time.Duration
-	closeCh      chan struct{}
-}
-
-func (tr *BTree) sync() {
-	go func(file *ioutils.File, syncInterval time.Duration, closeCh chan struct{}, cd *sync.WaitGroup) {
-		for {
-			stop := false
-			select {
-			case <-closeCh:
-				stop = true
-				break
-			case <-time.After(syncInterval):
-				_ = file.Sync()
-			}
-			if stop {
-				break
-			}
-		}
-		cd.Done()
-	}(tr.file, tr.syncInterval, tr.closeCh, tr.counter)
+	mutex   *sync.RWMutex
+	cow     *cow
+	root    *node
+	size    int64
+	seq     uint64
+	free    []int64
+	pending []int64
+	file    *journal.File
+	cache   *lru.LRU
+	lessFn  func(a []byte, b []byte) (ok bool)
+	counter *sync.WaitGroup
 }
 
 func (tr *BTree) less(a, b []byte) bool {
@@ -116,6 +114,69 @@ func (tr *BTree) newNode(leaf bool, idx int64) *node {
 	return n
 }
 
+// allocIdx returns a freed node slot first, or a new slot at the end of the file, the slot is not used by the last commit.
+func (tr *BTree) allocIdx(dirty *dirtyNodes) (idx int64) {
+	if n := len(tr.free); n > 0 {
+		idx = tr.free[n-1]
+		tr.free = tr.free[:n-1]
+	} else {
+		idx = atomic.AddInt64(&tr.size, 1)
+	}
+	dirty.allocated[idx] = true
+	return
+}
+
+// freeIdx drops the node which is no longer in the btree, its slot is pending until the next commit.
+func (tr *BTree) freeIdx(idx int64, dirty *dirtyNodes) (err error) {
+	delete(dirty.nodes, idx)
+	tr.cache.Remove(idx)
+	dirty.freed = append(dirty.freed, idx)
+	return
+}
+
+// link makes pending slots reusable, they are not used by the tree since the head of the last commit was written.
+func (tr *BTree) link() (err error) {
+	for _, idx := range tr.pending {
+		p := make([]byte, 8)
+		if n := len(tr.free); n > 0 {
+			binary.BigEndian.PutUint64(p, uint64(tr.free[n-1]))
+		}
+		err = tr.file.WriteAt((idx-1)*nodeSize+headSize, p)
+		if err != nil {
+			return
+		}
+		tr.free = append(tr.free, idx)
+	}
+	tr.pending = nil
+	return
+}
+
+// loadFree reads the chain of freed slots from idx, the first one is at the end of tr.free.
+func (tr *BTree) loadFree(idx int64) (err error) {
+	idxs := make([]int64, 0, 1)
+	for idx != 0 {
+		if idx < 0 || idx > tr.size || int64(len(idxs)) > tr.size {
+			err = fmt.Errorf("freed slots of btree are broken")
+			return
+		}
+		idxs = append(idxs, idx)
+		p, readErr := tr.file.ReadAt((idx-1)*nodeSize+headSize, 8)
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		if len(p) < 8 {
+			err = fmt.Errorf("freed slots of btree are broken")
+			return
+		}
+		idx = int64(binary.BigEndian.Uint64(p))
+	}
+	for i := len(idxs) - 1; i >= 0; i-- {
+		tr.free = append(tr.free, idxs[i])
+	}
+	return
+}
+
 func (tr *BTree) find(n *node, key []byte, hint *pathHint, depth int, write bool) (idx int, e Entry, found bool, err error) {
 	items, getErr := n.entries(tr.file, tr.cache, write)
 	if getErr != nil {
@@ -194,10 +255,10 @@ func (tr *BTree) Set(key []byte, value []byte) (err error) {
 	tr.counter.Add(1)
 	tr.mutex.Lock()
 	defer tr.mutex.Unlock()
+	tr.file.Begin()
+	defer tr.end(&err)
 
-	dirty := &dirtyNodes{
-		nodes: make(map[int64]*node),
-	}
+	dirty := newDirtyNodes()
 	err = tr.setHint(NewEntry(key, value), &pathHint{}, dirty)
 	if err != nil {
 		tr.counter.Done()
@@ -215,7 +276,7 @@ func (tr *BTree) Set(key []byte, value []byte) (err error) {
 
 func (tr *BTree) setHint(item Entry, hint *pathHint, dirty *dirtyNodes) (err error) {
 	if tr.root == nil {
-		tr.root = tr.newNode(true, atomic.AddInt64(&tr.size, 1))
+		tr.root = tr.newNode(true, tr.allocIdx(dirty))
 		tr.root.items = NewEntries(maxItems)
 		tr.root.items.setEntry(0, item)
 		dirty.nodes[tr.root.idx] = tr.root
@@ -233,7 +294,7 @@ func (tr *BTree) setHint(item Entry, hint *pathHint, dirty *dirtyNodes) (err err
 			err = splitErr
 			return
 		}
-		tr.root = tr.newNode(false, atomic.AddInt64(&tr.size, 1))
+		tr.root = tr.newNode(false, tr.allocIdx(dirty))
 		*tr.root.children = make([]*node, 0, maxItems+1)
 		*tr.root.children = append([]*node{}, left, right)
 		tr.root.items = NewEntries(maxItems)
@@ -262,7 +323,7 @@ func (tr *BTree) nodeSplit(n *node, dirty *dirtyNodes) (right *node, median Entr
 	}
 	dirty.nodes[left.idx] = left
 	// right node
-	right = tr.newNode(n.leaf(), atomic.AddInt64(&tr.size, 1))
+	right = tr.newNode(n.leaf(), tr.allocIdx(dirty))
 	right.items = r
 	if !n.leaf() {
 		*right.children = make([]*node, len((*n.children)[i+1:]), maxItems+1)
@@ -271,16 +332,74 @@ func (tr *BTree) nodeSplit(n *node, dirty *dirtyNodes) (right *node, median Entr
 	dirty.nodes[right.idx] = right
 
 	*n = *left
+	// n is the node in the tree, so it is relocated by commit instead of left
+	dirty.nodes[n.idx] = n
 	return right, median, nil
 }
 
-func (tr *BTree) updateRoot() (err error) {
-	if tr.root == nil {
-		return
+// writeHead writes the head into the copy of the older seq, so the newer copy is kept when the write is torn.
+func (tr *BTree) writeHead(closed bool) (err error) {
+	tr.seq++
+	p := make([]byte, headCopySize)
+	binary.BigEndian.PutUint64(p[0:8], tr.seq)
+	if tr.root != nil {
+		binary.BigEndian.PutUint64(p[8:16], uint64(tr.root.idx))
+	}
+	if closed {
+		binary.BigEndian.PutUint64(p[16:24], 1)
+	}
+	if n := len(tr.free); n > 0 {
+		binary.BigEndian.PutUint64(p[24:32], uint64(tr.free[n-1]))
+	}
+	binary.BigEndian.PutUint64(p[32:40], uint64(atomic.LoadInt64(&tr.size)))
+	binary.BigEndian.PutUint32(p[40:44], uint32(len(tr.pending)))
+	for i, idx := range tr.pending {
+		binary.BigEndian.PutUint64(p[44+i*8:52+i*8], uint64(idx))
+	}
+	binary.BigEndian.PutUint32(p[headCopySize-4:], crc32.ChecksumIEEE(p[:headCopySize-4]))
+	err = tr.file.WriteAt(headCopyOffset+int64(tr.seq%2)*headCopySize, p)
+	return
+}
+
+type head struct {
+	seq     uint64
+	root    int64
+	free    int64
+	size    int64
+	pending []int64
+}
+
+// readHead returns the valid copy of the newer seq, has is false when there is no valid copy.
+func readHead(readAt func(offset int64, capacity int64) (p []byte, err error)) (h head, has bool, err error) {
+	for i := int64(0); i < 2; i++ {
+		p, readErr := readAt(headCopyOffset+i*headCopySize, headCopySize)
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		if len(p) < headCopySize || crc32.ChecksumIEEE(p[:headCopySize-4]) != binary.BigEndian.Uint32(p[headCopySize-4:]) {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(p[0:8])
+		if has && seq < h.seq {
+			continue
+		}
+		pendingLen := int(binary.BigEndian.Uint32(p[40:44]))
+		if pendingLen > maxPendingSlots {
+			continue
+		}
+		h = head{
+			seq:     seq,
+			root:    int64(binary.BigEndian.Uint64(p[8:16])),
+			free:    int64(binary.BigEndian.Uint64(p[24:32])),
+			size:    int64(binary.BigEndian.Uint64(p[32:40])),
+			pending: make([]int64, 0, pendingLen),
+		}
+		for k := 0; k < pendingLen; k++ {
+			h.pending = append(h.pending, int64(binary.BigEndian.Uint64(p[44+k*8:52+k*8])))
+		}
+		has = true
 	}
-	p := make([]byte, 8)
-	binary.BigEndian.PutUint64(p, uint64(tr.root.idx))
-	err = tr.file.WriteAt(0, p)
 	return
 }
 
@@ -306,6 +425,7 @@ func (tr *BTree) copy(n *node) *node {
 	n2.cow = tr.cow
 	n2.idx = n.idx
 	n2.key = n.key
+	n2.stub = atomic.LoadInt32(&n.stub)
 	if n.items != nil {
 		n2.items = NewEntries(maxItems)
 		copy(n2.items, n.items)
@@ -354,6 +474,8 @@ func (tr *BTree) nodeSet(cn **node, item Entry, hint *pathHint, depth int, dirty
 	if err != nil {
 		return
 	}
+	// the child is written into a new slot, so n is written too
+	dirty.nodes[n.idx] = n
 	if split {
 		if items.size() == maxItems {
 			return true, nil
@@ -401,8 +523,52 @@ func (tr *BTree) Get(key []byte) ([]byte, bool, error) {
 	}
 }
 
+// commit writes dirty nodes into slots which are not used by the last commit, then flips the root by writing the head,
+// so the tree of the last head is never overwritten. Every ancestor of a dirty node is dirty, because it refers to the new slot.
+// Slots of the old copies are pending until the next commit, and writes are kept in memory until the file is flushed.
 func (tr *BTree) commit(dirty *dirtyNodes) (err error) {
+	if err = tr.link(); err != nil {
+		return
+	}
+	nodes := make([]*node, 0, len(dirty.nodes))
 	for _, n := range dirty.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].idx < nodes[j].idx
+	})
+	freed := len(dirty.freed)
+	for _, n := range nodes {
+		if !dirty.allocated[n.idx] {
+			freed++
+		}
+	}
+	if freed > maxPendingSlots {
+		err = fmt.Errorf("btree commit failed, too many freed slots in one commit")
+		return
+	}
+	// relocate all before writing, parents are written with new slots of their children
+	for _, n := range nodes {
+		if dirty.allocated[n.idx] {
+			continue
+		}
+		tr.cache.Remove(n.idx)
+		dirty.freed = append(dirty.freed, n.idx)
+		n.idx = tr.allocIdx(dirty)
+		n.key = make([]byte, 8)
+		binary.BigEndian.PutUint64(n.key, uint64(n.idx))
+	}
+	if err = tr.write(nodes); err != nil {
+		return
+	}
+	tr.pending = dirty.freed
+	err = tr.writeHead(false)
+	return
+}
+
+// write writes nodes at their slots.
+func (tr *BTree) write(nodes []*node) (err error) {
+	for _, n := range nodes {
 		err = n.update(tr.file, tr.cache)
 		if err != nil {
 			return
@@ -411,111 +577,83 @@ func (tr *BTree) commit(dirty *dirtyNodes) (err error) {
 	return
 }
 
-func (tr *BTree) load() (err error) {
-	stat, statErr := tr.file.File().Stat()
-	if statErr != nil {
-		err = fmt.Errorf("btree load failed, %v", statErr)
-		return
+// end commits writes since tr.file.Begin, err is replaced when committing failed.
+func (tr *BTree) end(err *error) {
+	if commitErr := tr.file.Commit(); commitErr != nil && *err == nil {
+		*err = commitErr
 	}
-	if stat.IsDir() {
-		err = fmt.Errorf("data file of btree must be file")
+}
+
+// File returns the file of the btree, its writes are kept in memory until they are flushed.
+func (tr *BTree) File() (file *journal.File) {
+	file = tr.file
+	return
+}
+
+func (tr *BTree) load() (err error) {
+	fileSize, sizeErr := tr.file.Size()
+	if sizeErr != nil {
+		err = fmt.Errorf("btree load failed, %v", sizeErr)
 		return
 	}
-	fileSize := stat.Size()
 	if fileSize == 0 {
 		return
 	}
-	// stats
-
-	p, rErr := tr.file.ReadAt(8, 8)
-	if rErr != nil {
-		err = rErr
+	h, has, headErr := readHead(tr.file.ReadAt)
+	if headErr != nil {
+		err = headErr
 		return
 	}
-	if binary.BigEndian.Uint64(p) != 1 {
-		err = NotSafelyClosedErr
+	if !has {
+		err = &checksum.Error{File: tr.file.Path(), Offset: headCopyOffset, Structure: "btree head"}
 		return
 	}
-
-	rootIdxP, readRootIdxErr := tr.file.ReadAt(0, 8)
-	if readRootIdxErr != nil {
-		err = readRootIdxErr
+	// slots
+	tr.seq = h.seq
+	tr.size = h.size
+	tr.pending = h.pending
+	err = tr.loadFree(h.free)
+	if err != nil {
 		return
 	}
-	rootIdx := int64(binary.BigEndian.Uint64(rootIdxP))
-	if rootIdx <= 0 {
+	if h.root <= 0 {
 		return
 	}
-	root, rootErr := tr.readNode(rootIdx)
+	root, rootErr := tr.readNode(h.root)
 	if rootErr != nil {
 		err = rootErr
 		return
 	}
 	tr.root = root
 	// mark open
-	binary.BigEndian.PutUint64(p, 0)
-	wErr := tr.file.WriteAt(8, p)
+	wErr := tr.writeHead(false)
 	if wErr != nil {
 		err = wErr
 		return
 	}
-	syncErr := tr.file.Sync()
-	if syncErr != nil {
-		err = syncErr
-		return
-	}
 	return
 }
 
+// readNode resolves the node at idx, its children are stubs which are resolved on demand.
 func (tr *BTree) readNode(idx int64) (n *node, err error) {
-	off := (idx-1)*nodeSize + headSize
-	np, readErr := tr.file.ReadAt(off, nodeSize)
-	if readErr != nil {
-		err = readErr
-		return
-	}
-	children := make([]int64, 0, 1)
-	head := np[0:nodeHeadLen]
-	for i := 0; i < (maxItems + 1); i++ {
-		c := binary.BigEndian.Uint64(head[i*8 : (i+1)*8])
-		if c == 0 {
-			break
-		}
-		children = append(children, int64(c))
-	}
-	items := NewEntries(maxItems)
-	copy(items, np[nodeHeadLen:])
-	n = tr.newNode(len(children) == 0, idx)
-	tr.cache.Add(n.idx, items)
-	for _, child := range children {
-		c, cErr := tr.readNode(child)
-		if cErr != nil {
-			err = cErr
-			return
-		}
-		*n.children = append(*n.children, c)
-	}
-	tr.size++
+	n = newStubNode(tr.cow, idx)
+	err = n.resolve(tr.file, tr.cache)
+	return
+}
+
+// Flush writes nodes in memory into the file and syncs it.
+func (tr *BTree) Flush() (err error) {
+	err = tr.file.Flush()
 	return
 }
 
+// Close closes the file, nodes which were not flushed are dropped.
 func (tr *BTree) Close() (err error) {
 	tr.counter.Wait()
-	tr.counter.Add(1)
-	close(tr.closeCh)
-	tr.counter.Wait()
-	p := make([]byte, 8)
-	binary.BigEndian.PutUint64(p, uint64(1))
-	wErr := tr.file.WriteAt(8, p)
-	if wErr != nil {
-		err = wErr
-		return
-	}
-	err = tr.updateRoot()
+	err = tr.writeHead(true)
 	if err != nil {
 		return
 	}
-	_ = tr.file.Sync()
 	_ = tr.file.Close()
 	return
 }
@@ -0,0 +1,207 @@
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Check walks the tree in the file at path from the root without opening it, the file is not changed.
+// Checksums, sizes and key order of nodes, child pointers and freed slots are checked, keys are compared by bytes.Compare,
+// broken is called with the offset and the problem of each inconsistency, and visit is called with entries in key order.
+// Subtrees of broken nodes are not walked, err is only returned when the file can not be read.
+func Check(path string, visit func(key []byte, value []byte), broken func(offset int64, problem string)) (err error) {
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		err = fmt.Errorf("check btree failed, %v", openErr)
+		return
+	}
+	defer file.Close()
+	stat, statErr := file.Stat()
+	if statErr != nil {
+		err = fmt.Errorf("check btree failed, %v", statErr)
+		return
+	}
+	if stat.Size() == 0 {
+		return
+	}
+	c := &checker{
+		readAt: func(offset int64, capacity int64) (p []byte, err error) {
+			p = make([]byte, capacity)
+			n, readErr := file.ReadAt(p, offset)
+			p = p[:n]
+			if readErr != nil && readErr != io.EOF {
+				err = readErr
+			}
+			return
+		},
+		visit:   visit,
+		broken:  broken,
+		freed:   make(map[int64]bool),
+		visited: make(map[int64]bool),
+		depth:   -1,
+	}
+	h, has, headErr := readHead(c.readAt)
+	if headErr != nil {
+		err = fmt.Errorf("check btree failed, %v", headErr)
+		return
+	}
+	if !has {
+		broken(headCopyOffset, "no copy of head is valid")
+		return
+	}
+	c.size = h.size
+	if max := (stat.Size() - headSize) / nodeSize; c.size > max {
+		broken(0, fmt.Sprintf("size %d of head is greater than %d slots of the file", c.size, max))
+		c.size = max
+	}
+	if err = c.free(h.free, h.pending); err != nil {
+		return
+	}
+	if h.root == 0 {
+		return
+	}
+	err = c.node(h.root, nil, nil, 0)
+	return
+}
+
+type checker struct {
+	readAt  func(offset int64, capacity int64) (p []byte, err error)
+	visit   func(key []byte, value []byte)
+	broken  func(offset int64, problem string)
+	size    int64
+	freed   map[int64]bool
+	visited map[int64]bool
+	// depth is the depth of leaves, all leaves must be at the same depth.
+	depth int
+}
+
+// free reads the chain of freed slots and pending slots, they must not be used by the tree.
+func (c *checker) free(idx int64, pending []int64) (err error) {
+	for idx != 0 {
+		offset := (idx-1)*nodeSize + headSize
+		if idx < 0 || idx > c.size {
+			c.broken(headCopyOffset, fmt.Sprintf("freed slot %d is out of range", idx))
+			break
+		}
+		if c.freed[idx] {
+			c.broken(offset, fmt.Sprintf("freed slot %d is chained more than once", idx))
+			break
+		}
+		c.freed[idx] = true
+		p, readErr := c.readAt(offset, 8)
+		if readErr != nil {
+			err = fmt.Errorf("check btree failed, %v", readErr)
+			return
+		}
+		if len(p) < 8 {
+			c.broken(offset, fmt.Sprintf("freed slot %d is truncated", idx))
+			break
+		}
+		idx = int64(binary.BigEndian.Uint64(p))
+	}
+	for _, idx = range pending {
+		if idx <= 0 || idx > c.size {
+			c.broken(headCopyOffset, fmt.Sprintf("pending slot %d is out of range", idx))
+			continue
+		}
+		c.freed[idx] = true
+	}
+	return
+}
+
+// node checks the node at idx which keys must be in (lower, upper), nil means unbounded.
+func (c *checker) node(idx int64, lower []byte, upper []byte, depth int) (err error) {
+	offset := (idx-1)*nodeSize + headSize
+	if idx <= 0 || idx > c.size {
+		c.broken(offset, fmt.Sprintf("node %d is out of range", idx))
+		return
+	}
+	if c.freed[idx] {
+		c.broken(offset, fmt.Sprintf("node %d is used by the tree and freed", idx))
+		return
+	}
+	if c.visited[idx] {
+		c.broken(offset, fmt.Sprintf("node %d is referenced more than once", idx))
+		return
+	}
+	c.visited[idx] = true
+	p, readErr := c.readAt(offset, nodeSize)
+	if readErr != nil {
+		err = fmt.Errorf("check btree failed, %v", readErr)
+		return
+	}
+	if len(p) < nodeSize {
+		c.broken(offset, fmt.Sprintf("node %d is truncated", idx))
+		return
+	}
+	if !verifyNode(p) {
+		c.broken(offset, fmt.Sprintf("checksum of node %d is not matched", idx))
+		return
+	}
+	items := Entries(p[nodeHeadLen:])
+	n := items.size()
+	if n > maxItems || (n == 0 && depth > 0) {
+		c.broken(offset, fmt.Sprintf("size %d of node %d is invalid", n, idx))
+		return
+	}
+	keys := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		e := Entry(items[i*entrySize+entriesHeadLen : (i+1)*entrySize+entriesHeadLen])
+		if kLen := binary.BigEndian.Uint64(e[0:8]); kLen > maxKeyLen {
+			c.broken(offset, fmt.Sprintf("length %d of key %d of node %d is invalid", kLen, i, idx))
+			return
+		}
+		key := e.Key()
+		prev := lower
+		if i > 0 {
+			prev = keys[i-1]
+		}
+		if (prev != nil && bytes.Compare(prev, key) >= 0) || (upper != nil && bytes.Compare(key, upper) >= 0) {
+			c.broken(offset, fmt.Sprintf("key %d of node %d is out of order", i, idx))
+			return
+		}
+		keys = append(keys, key)
+	}
+	children := make([]int64, 0, n+1)
+	for i := 0; i < maxItems+1; i++ {
+		child := int64(binary.BigEndian.Uint64(p[i*8 : (i+1)*8]))
+		if child == 0 {
+			break
+		}
+		children = append(children, child)
+	}
+	if len(children) == 0 {
+		if c.depth < 0 {
+			c.depth = depth
+		} else if c.depth != depth {
+			c.broken(offset, fmt.Sprintf("leaf %d is at depth %d, but other leaves are at %d", idx, depth, c.depth))
+		}
+		for i, key := range keys {
+			c.visit(key, Entry(items[i*entrySize+entriesHeadLen:(i+1)*entrySize+entriesHeadLen]).Value())
+		}
+		return
+	}
+	if len(children) != n+1 {
+		c.broken(offset, fmt.Sprintf("node %d has %d children for %d keys", idx, len(children), n))
+		return
+	}
+	for i, child := range children {
+		childLower, childUpper := lower, upper
+		if i > 0 {
+			childLower = keys[i-1]
+		}
+		if i < n {
+			childUpper = keys[i]
+		}
+		if err = c.node(child, childLower, childUpper, depth+1); err != nil {
+			return
+		}
+		if i < n {
+			c.visit(keys[i], Entry(items[i*entrySize+entriesHeadLen:(i+1)*entrySize+entriesHeadLen]).Value())
+		}
+	}
+	return
+}
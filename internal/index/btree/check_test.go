@@ -0,0 +1,52 @@
+package btree_test
+
+import (
+	"bytes"
+	"github.com/aacfactory/tapedb/internal/index/btree"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bt")
+	tr, err := btree.New(btree.Options{
+		Path: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 2000
+	for i := n - 1; i >= 0; i-- {
+		if err = tr.Set(intBytes(int64(i)), intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i += 3 {
+		if _, err = tr.Delete(intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var prev []byte
+	visited := 0
+	err = btree.Check(path, func(key []byte, value []byte) {
+		if prev != nil && bytes.Compare(prev, key) >= 0 || !bytes.Equal(key, value) {
+			t.Fatal("unexpected entry", key, value)
+		}
+		prev = key
+		visited++
+	}, func(offset int64, problem string) {
+		t.Fatal("unexpected problem", offset, problem)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if visited != n-(n+2)/3 {
+		t.Fatal("unexpected visited", visited)
+	}
+}
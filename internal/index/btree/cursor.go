@@ -0,0 +1,296 @@
+package btree
+
+import "sort"
+
+// Cursor walks entries of the btree in order of keys.
+// It does not hold nodes between moves, every move seeks from the root under the read lock,
+// so the btree can be changed while walking, and the cursor always moves to the next key of the current one.
+type Cursor struct {
+	tr    *BTree
+	key   []byte
+	value []byte
+	valid bool
+	moved bool
+}
+
+func (tr *BTree) Cursor() (c *Cursor) {
+	c = &Cursor{
+		tr:    tr,
+		key:   nil,
+		value: nil,
+		valid: false,
+		moved: false,
+	}
+	return
+}
+
+// First moves to the first entry, ok is false when the btree is empty.
+func (c *Cursor) First() (ok bool, err error) {
+	ok, err = c.seek(nil, true)
+	return
+}
+
+// Seek moves to the first entry which key is not less than key.
+func (c *Cursor) Seek(key []byte) (ok bool, err error) {
+	ok, err = c.seek(key, true)
+	return
+}
+
+// Last moves to the last entry, ok is false when the btree is empty.
+func (c *Cursor) Last() (ok bool, err error) {
+	ok, err = c.seekLast(nil, true)
+	return
+}
+
+// SeekLast moves to the last entry which key is not greater than key.
+func (c *Cursor) SeekLast(key []byte) (ok bool, err error) {
+	ok, err = c.seekLast(key, true)
+	return
+}
+
+// Next moves to the entry after the current one, it moves to the first entry when the cursor was not moved.
+func (c *Cursor) Next() (ok bool, err error) {
+	if !c.moved {
+		ok, err = c.First()
+		return
+	}
+	if !c.valid {
+		return
+	}
+	ok, err = c.seek(c.key, false)
+	return
+}
+
+// Prev moves to the entry before the current one, it moves to the last entry when the cursor was not moved.
+func (c *Cursor) Prev() (ok bool, err error) {
+	if !c.moved {
+		ok, err = c.Last()
+		return
+	}
+	if !c.valid {
+		return
+	}
+	ok, err = c.seekLast(c.key, false)
+	return
+}
+
+func (c *Cursor) Valid() (ok bool) {
+	ok = c.valid
+	return
+}
+
+func (c *Cursor) Key() (key []byte) {
+	key = c.key
+	return
+}
+
+func (c *Cursor) Value() (value []byte) {
+	value = c.value
+	return
+}
+
+func (c *Cursor) seek(key []byte, inclusive bool) (ok bool, err error) {
+	var e Entry
+	if key == nil {
+		e, ok, err = c.tr.first()
+	} else {
+		e, ok, err = c.tr.successor(key, inclusive)
+	}
+	if err != nil {
+		c.valid = false
+		return
+	}
+	c.set(e, ok)
+	return
+}
+
+func (c *Cursor) seekLast(key []byte, inclusive bool) (ok bool, err error) {
+	var e Entry
+	if key == nil {
+		e, ok, err = c.tr.last()
+	} else {
+		e, ok, err = c.tr.predecessor(key, inclusive)
+	}
+	if err != nil {
+		c.valid = false
+		return
+	}
+	c.set(e, ok)
+	return
+}
+
+func (c *Cursor) set(e Entry, ok bool) {
+	c.moved = true
+	c.valid = ok
+	if !ok {
+		c.key = nil
+		c.value = nil
+		return
+	}
+	c.key = append(make([]byte, 0, len(e.Key())), e.Key()...)
+	c.value = append(make([]byte, 0, len(e.Value())), e.Value()...)
+}
+
+func (tr *BTree) first() (e Entry, ok bool, err error) {
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	n := tr.root
+	for n != nil {
+		items, getErr := n.entries(tr.file, tr.cache, false)
+		if getErr != nil {
+			err = getErr
+			return
+		}
+		if items.size() == 0 {
+			return
+		}
+		if n.leaf() {
+			e = copyEntry(items.mustGetEntry(0))
+			ok = true
+			return
+		}
+		n = (*n.children)[0]
+	}
+	return
+}
+
+// successor returns the first entry which key is greater than key, or equal to key when inclusive.
+func (tr *BTree) successor(key []byte, inclusive bool) (e Entry, ok bool, err error) {
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	n := tr.root
+	for n != nil {
+		items, getErr := n.entries(tr.file, tr.cache, false)
+		if getErr != nil {
+			err = getErr
+			return
+		}
+		size := items.size()
+		idx := sort.Search(size, func(i int) bool {
+			k := items.mustGetEntry(i).Key()
+			if inclusive {
+				return !tr.less(k, key)
+			}
+			return tr.less(key, k)
+		})
+		if idx < size {
+			e = copyEntry(items.mustGetEntry(idx))
+			ok = true
+		}
+		if n.leaf() {
+			return
+		}
+		n = (*n.children)[idx]
+	}
+	return
+}
+
+func (tr *BTree) last() (e Entry, ok bool, err error) {
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	n := tr.root
+	for n != nil {
+		items, getErr := n.entries(tr.file, tr.cache, false)
+		if getErr != nil {
+			err = getErr
+			return
+		}
+		size := items.size()
+		if size == 0 {
+			return
+		}
+		if n.leaf() {
+			e = copyEntry(items.mustGetEntry(size - 1))
+			ok = true
+			return
+		}
+		n = (*n.children)[len(*n.children)-1]
+	}
+	return
+}
+
+// predecessor returns the last entry which key is less than key, or equal to key when inclusive.
+func (tr *BTree) predecessor(key []byte, inclusive bool) (e Entry, ok bool, err error) {
+	tr.mutex.RLock()
+	defer tr.mutex.RUnlock()
+	n := tr.root
+	for n != nil {
+		items, getErr := n.entries(tr.file, tr.cache, false)
+		if getErr != nil {
+			err = getErr
+			return
+		}
+		size := items.size()
+		// idx is the number of entries before key, so the child at idx holds keys between them and key.
+		idx := sort.Search(size, func(i int) bool {
+			k := items.mustGetEntry(i).Key()
+			if inclusive {
+				return tr.less(key, k)
+			}
+			return !tr.less(k, key)
+		})
+		if idx > 0 {
+			e = copyEntry(items.mustGetEntry(idx - 1))
+			ok = true
+		}
+		if n.leaf() {
+			return
+		}
+		n = (*n.children)[idx]
+	}
+	return
+}
+
+// Ascend calls fn with entries from the first one which key is not less than from in order, until fn returns false.
+// from is nil means from the first entry.
+func (tr *BTree) Ascend(from []byte, fn func(key []byte, value []byte) (next bool)) (err error) {
+	c := tr.Cursor()
+	ok := false
+	if from == nil {
+		ok, err = c.First()
+	} else {
+		ok, err = c.Seek(from)
+	}
+	for ok && err == nil {
+		if !fn(c.Key(), c.Value()) {
+			return
+		}
+		ok, err = c.Next()
+	}
+	return
+}
+
+// Descend calls fn with entries from the last one which key is not greater than from in reverse order, until fn returns false.
+// from is nil means from the last entry.
+func (tr *BTree) Descend(from []byte, fn func(key []byte, value []byte) (next bool)) (err error) {
+	c := tr.Cursor()
+	ok := false
+	if from == nil {
+		ok, err = c.Last()
+	} else {
+		ok, err = c.SeekLast(from)
+	}
+	for ok && err == nil {
+		if !fn(c.Key(), c.Value()) {
+			return
+		}
+		ok, err = c.Prev()
+	}
+	return
+}
+
+// AscendRange calls fn with entries in [lo, hi) in order, until fn returns false.
+func (tr *BTree) AscendRange(lo []byte, hi []byte, fn func(key []byte, value []byte) (next bool)) (err error) {
+	err = tr.Ascend(lo, func(key []byte, value []byte) (next bool) {
+		if !tr.less(key, hi) {
+			return false
+		}
+		return fn(key, value)
+	})
+	return
+}
+
+func copyEntry(e Entry) (v Entry) {
+	v = append(make([]byte, 0, len(e)), e...)
+	return
+}
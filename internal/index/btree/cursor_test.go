@@ -0,0 +1,144 @@
+package btree_test
+
+import (
+	"github.com/aacfactory/tapedb/internal/index/btree"
+	"path/filepath"
+	"testing"
+)
+
+func TestCursor_Next(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bt")
+	tr, err := btree.New(btree.Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := tr.Cursor()
+	if ok, _ := c.Next(); ok {
+		t.Fatal("expected empty btree")
+	}
+	// odd numbers, enough to split nodes
+	for i := 0; i < 5000; i++ {
+		if err = tr.Set(intBytes(int64(i*2+1)), intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err = btree.New(btree.Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	c = tr.Cursor()
+	n := 0
+	for {
+		ok, nextErr := c.Next()
+		if nextErr != nil {
+			t.Fatal(nextErr)
+		}
+		if !ok {
+			break
+		}
+		if bytesInt(c.Key()) != n*2+1 || bytesInt(c.Value()) != n {
+			t.Fatal("unexpected entry", n, bytesInt(c.Key()), bytesInt(c.Value()))
+		}
+		n++
+	}
+	if n != 5000 {
+		t.Fatal("expected 5000 entries, got", n)
+	}
+	if ok, _ := c.Seek(intBytes(1000)); !ok || bytesInt(c.Key()) != 1001 {
+		t.Fatal("unexpected seek", bytesInt(c.Key()))
+	}
+	if ok, _ := c.Seek(intBytes(1001)); !ok || bytesInt(c.Key()) != 1001 {
+		t.Fatal("unexpected inclusive seek", bytesInt(c.Key()))
+	}
+	// set while walking
+	if err = tr.Set(intBytes(1002), intBytes(-1)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Next(); !ok || bytesInt(c.Key()) != 1002 {
+		t.Fatal("expected the key set while walking", bytesInt(c.Key()))
+	}
+	if ok, _ := c.Seek(intBytes(10000)); ok {
+		t.Fatal("expected no key after the last")
+	}
+}
+
+func TestBTree_Descend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bt")
+	tr, err := btree.New(btree.Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	// odd numbers, enough to split nodes
+	for i := 0; i < 5000; i++ {
+		if err = tr.Set(intBytes(int64(i*2+1)), intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 4999
+	err = tr.Descend(nil, func(key []byte, value []byte) (next bool) {
+		if bytesInt(key) != n*2+1 || bytesInt(value) != n {
+			t.Fatal("unexpected entry", n, bytesInt(key), bytesInt(value))
+		}
+		n--
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != -1 {
+		t.Fatal("expected all entries, stopped at", n)
+	}
+	keys := make([]int, 0, 3)
+	err = tr.Descend(intBytes(1000), func(key []byte, value []byte) (next bool) {
+		keys = append(keys, bytesInt(key))
+		return len(keys) < 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] != 999 || keys[1] != 997 || keys[2] != 995 {
+		t.Fatal("unexpected descend", keys)
+	}
+	keys = keys[:0]
+	err = tr.AscendRange(intBytes(1001), intBytes(1007), func(key []byte, value []byte) (next bool) {
+		keys = append(keys, bytesInt(key))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] != 1001 || keys[2] != 1005 {
+		t.Fatal("unexpected range", keys)
+	}
+	c := tr.Cursor()
+	if ok, _ := c.SeekLast(intBytes(1001)); !ok || bytesInt(c.Key()) != 1001 {
+		t.Fatal("unexpected inclusive seek last", bytesInt(c.Key()))
+	}
+	if ok, _ := c.Prev(); !ok || bytesInt(c.Key()) != 999 {
+		t.Fatal("unexpected prev", bytesInt(c.Key()))
+	}
+	if ok, _ := c.SeekLast(intBytes(0)); ok {
+		t.Fatal("expected no key before the first")
+	}
+	c = tr.Cursor()
+	if ok, _ := c.Prev(); !ok || bytesInt(c.Key()) != 9999 {
+		t.Fatal("expected the last key", bytesInt(c.Key()))
+	}
+}
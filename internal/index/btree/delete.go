@@ -0,0 +1,180 @@
+package btree
+
+import "fmt"
+
+// Delete removes the key, ok is false when the key does not exist.
+// Nodes which have less than minItems entries borrow from or merge with their siblings,
+// slots of merged nodes are freed and reused by later sets.
+func (tr *BTree) Delete(key []byte) (ok bool, err error) {
+	if len(key) > maxKeyLen {
+		err = fmt.Errorf("key is too large")
+		return
+	}
+	tr.counter.Add(1)
+	defer tr.counter.Done()
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	tr.file.Begin()
+	defer tr.end(&err)
+	if tr.root == nil {
+		return
+	}
+	dirty := newDirtyNodes()
+	_, ok, err = tr.nodeDelete(&tr.root, false, key, &pathHint{}, 0, dirty)
+	if err != nil || !ok {
+		return
+	}
+	items, getErr := tr.root.entries(tr.file, tr.cache, true)
+	if getErr != nil {
+		err = getErr
+		return
+	}
+	if items.size() == 0 {
+		old := tr.root
+		if old.leaf() {
+			tr.root = nil
+		} else {
+			tr.root = (*old.children)[0]
+		}
+		err = tr.freeIdx(old.idx, dirty)
+		if err != nil {
+			return
+		}
+	}
+	err = tr.commit(dirty)
+	if err != nil {
+		return
+	}
+	tr.release(tr.root)
+	return
+}
+
+// nodeDelete removes the key from the subtree of cn, or removes the max entry of the subtree when max is true.
+func (tr *BTree) nodeDelete(cn **node, max bool, key []byte, hint *pathHint, depth int, dirty *dirtyNodes) (prev Entry, deleted bool, err error) {
+	n := tr.cowLoad(cn)
+	items, getErr := n.entries(tr.file, tr.cache, true)
+	if getErr != nil {
+		err = getErr
+		return
+	}
+	i := 0
+	found := false
+	if max {
+		i, found = items.size()-1, true
+	} else {
+		i, _, found, err = tr.find(n, key, hint, depth, true)
+		if err != nil {
+			return
+		}
+	}
+	if n.leaf() {
+		if !found {
+			return
+		}
+		prev = copyEntry(items.mustGetEntry(i))
+		items.removeEntry(i)
+		dirty.nodes[n.idx] = n
+		deleted = true
+		return
+	}
+	if found {
+		if max {
+			i++
+			prev, deleted, err = tr.nodeDelete(&(*n.children)[i], true, nil, hint, depth+1, dirty)
+		} else {
+			prev = copyEntry(items.mustGetEntry(i))
+			// replace the entry by the max entry of its left subtree
+			maxEntry, _, maxErr := tr.nodeDelete(&(*n.children)[i], true, nil, hint, depth+1, dirty)
+			if maxErr != nil {
+				err = maxErr
+				return
+			}
+			items.replaceEntry(i, maxEntry)
+			deleted = true
+		}
+	} else {
+		prev, deleted, err = tr.nodeDelete(&(*n.children)[i], max, key, hint, depth+1, dirty)
+	}
+	if err != nil || !deleted {
+		return
+	}
+	dirty.nodes[n.idx] = n
+	child, childErr := (*n.children)[i].entries(tr.file, tr.cache, true)
+	if childErr != nil {
+		err = childErr
+		return
+	}
+	if child.size() < minItems {
+		err = tr.nodeRebalance(n, i, dirty)
+	}
+	return
+}
+
+// nodeRebalance makes the i-th child of n have enough entries, by merging it with a sibling or borrowing one entry from the sibling.
+func (tr *BTree) nodeRebalance(n *node, i int, dirty *dirtyNodes) (err error) {
+	items, getErr := n.entries(tr.file, tr.cache, true)
+	if getErr != nil {
+		err = getErr
+		return
+	}
+	if i == items.size() {
+		i--
+	}
+	left := tr.cowLoad(&(*n.children)[i])
+	right := tr.cowLoad(&(*n.children)[i+1])
+	leftItems, leftErr := left.entries(tr.file, tr.cache, true)
+	if leftErr != nil {
+		err = leftErr
+		return
+	}
+	rightItems, rightErr := right.entries(tr.file, tr.cache, true)
+	if rightErr != nil {
+		err = rightErr
+		return
+	}
+	if leftItems.size()+rightItems.size() < maxItems {
+		// merge right and the separator into left
+		leftItems.setEntry(leftItems.size(), copyEntry(items.mustGetEntry(i)))
+		leftItems.appendEntries(rightItems)
+		if !left.leaf() {
+			*left.children = append(*left.children, *right.children...)
+		}
+		items.removeEntry(i)
+		copy((*n.children)[i+1:], (*n.children)[i+2:])
+		(*n.children)[len(*n.children)-1] = nil
+		*n.children = (*n.children)[:len(*n.children)-1]
+		dirty.nodes[left.idx] = left
+		err = tr.freeIdx(right.idx, dirty)
+		if err != nil {
+			return
+		}
+	} else if leftItems.size() > rightItems.size() {
+		// move the separator to the front of right, and the last of left up
+		last := leftItems.size() - 1
+		rightItems.setEntry(0, copyEntry(items.mustGetEntry(i)))
+		items.replaceEntry(i, copyEntry(leftItems.mustGetEntry(last)))
+		leftItems.removeEntry(last)
+		if !left.leaf() {
+			moved := (*left.children)[len(*left.children)-1]
+			*left.children = (*left.children)[:len(*left.children)-1]
+			*right.children = append([]*node{moved}, *right.children...)
+		}
+		dirty.nodes[left.idx] = left
+		dirty.nodes[right.idx] = right
+	} else {
+		// move the separator to the end of left, and the first of right up
+		leftItems.setEntry(leftItems.size(), copyEntry(items.mustGetEntry(i)))
+		items.replaceEntry(i, copyEntry(rightItems.mustGetEntry(0)))
+		rightItems.removeEntry(0)
+		if !left.leaf() {
+			moved := (*right.children)[0]
+			copy(*right.children, (*right.children)[1:])
+			*right.children = (*right.children)[:len(*right.children)-1]
+			*left.children = append(*left.children, moved)
+		}
+		dirty.nodes[left.idx] = left
+		dirty.nodes[right.idx] = right
+	}
+	dirty.nodes[n.idx] = n
+	return
+}
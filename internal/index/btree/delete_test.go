@@ -0,0 +1,217 @@
+package btree_test
+
+import (
+	"github.com/aacfactory/tapedb/internal/index/btree"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBTree_Delete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bt")
+	tr, err := btree.New(btree.Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20000
+	for i := 0; i < n; i++ {
+		if err = tr.Set(intBytes(int64(i)), intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted := make(map[int]bool)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n)[:n*3/4] {
+		ok, deleteErr := tr.Delete(intBytes(int64(i)))
+		if deleteErr != nil {
+			t.Fatal(deleteErr)
+		}
+		if !ok {
+			t.Fatal("expected deleted", i)
+		}
+		deleted[i] = true
+	}
+	if ok, _ := tr.Delete(intBytes(n)); ok {
+		t.Fatal("expected not found")
+	}
+	check := func(tr *btree.BTree) {
+		prev := -1
+		count := 0
+		walkErr := tr.Ascend(nil, func(key []byte, value []byte) (next bool) {
+			k := bytesInt(key)
+			if k <= prev || deleted[k] || bytesInt(value) != k {
+				t.Fatal("unexpected entry", prev, k, bytesInt(value))
+			}
+			prev = k
+			count++
+			return true
+		})
+		if walkErr != nil {
+			t.Fatal(walkErr)
+		}
+		if count != n-len(deleted) {
+			t.Fatal("expected", n-len(deleted), "entries, got", count)
+		}
+		for i := 0; i < n; i++ {
+			_, has, getErr := tr.Get(intBytes(int64(i)))
+			if getErr != nil {
+				t.Fatal(getErr)
+			}
+			if has == deleted[i] {
+				t.Fatal("unexpected get", i, has)
+			}
+		}
+	}
+	check(tr)
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := os.Stat(path)
+	size := stat.Size()
+	tr, err = btree.New(btree.Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(tr)
+	// freed slots are reused
+	for i := range deleted {
+		if err = tr.Set(intBytes(int64(i)), intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+		delete(deleted, i)
+	}
+	check(tr)
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ = os.Stat(path)
+	if stat.Size() > size {
+		t.Fatal("expected freed slots reused, file grew from", size, "to", stat.Size())
+	}
+	// delete all
+	tr, err = btree.New(btree.Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if ok, _ := tr.Delete(intBytes(int64(i))); !ok {
+			t.Fatal("expected deleted", i)
+		}
+		deleted[i] = true
+	}
+	check(tr)
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err = btree.New(btree.Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	check(tr)
+}
+
+func TestBTree_Vacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bt")
+	tr, err := btree.New(btree.Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20000
+	for i := 0; i < n; i++ {
+		if err = tr.Set(intBytes(int64(i)), intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// delete the front keys, so slots of the first nodes are freed
+	for i := 0; i < n/2; i++ {
+		if _, err = tr.Delete(intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err = btree.New(btree.Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := os.Stat(path)
+	size := stat.Size()
+	if err = tr.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ = os.Stat(path)
+	if stat.Size() >= size {
+		t.Fatal("expected file shrunk from", size, "got", stat.Size())
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err = btree.New(btree.Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	count := 0
+	err = tr.Ascend(nil, func(key []byte, value []byte) (next bool) {
+		if bytesInt(key) != n/2+count || bytesInt(value) != n/2+count {
+			t.Fatal("unexpected entry", count, bytesInt(key))
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != n/2 {
+		t.Fatal("expected", n/2, "entries, got", count)
+	}
+	// set after vacuum appends new slots
+	for i := 0; i < n/2; i++ {
+		if err = tr.Set(intBytes(int64(i)), intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if v, has, _ := tr.Get(intBytes(int64(i))); !has || bytesInt(v) != i {
+			t.Fatal("unexpected get", i)
+		}
+	}
+}
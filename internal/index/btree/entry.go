@@ -79,6 +79,22 @@ func (entries Entries) replaceEntry(idx int, e Entry) {
 	return
 }
 
+func (entries Entries) removeEntry(idx int) {
+	n := entries.size()
+	copy(entries[idx*entrySize+entriesHeadLen:], entries[(idx+1)*entrySize+entriesHeadLen:n*entrySize+entriesHeadLen])
+	copy(entries[(n-1)*entrySize+entriesHeadLen:n*entrySize+entriesHeadLen], make([]byte, entrySize))
+	entries.setSize(n - 1)
+	return
+}
+
+func (entries Entries) appendEntries(other Entries) {
+	n := entries.size()
+	m := other.size()
+	copy(entries[n*entrySize+entriesHeadLen:], other[entriesHeadLen:m*entrySize+entriesHeadLen])
+	entries.setSize(n + m)
+	return
+}
+
 func (entries Entries) Split() (left Entries, median Entry, right Entries) {
 	mid := entries.size() / 2
 	leftSize := entries.size() - mid - 1
@@ -3,18 +3,35 @@ package btree
 import (
 	"encoding/binary"
 	"fmt"
-	"github.com/aacfactory/tapedb/internal/ioutils"
+	"github.com/aacfactory/tapedb/internal/checksum"
+	"github.com/aacfactory/tapedb/internal/journal"
 	"github.com/aacfactory/tapedb/internal/lru"
+	"sync"
+	"sync/atomic"
 )
 
 const (
 	nodeHeadLen = 8 * (maxItems + 1)
 	nodeBodyLen = entrySize*(maxItems) + entriesHeadLen
 	nodeSize    = nodeHeadLen + nodeBodyLen // 36k
+	// nodeChecksumOffset is the crc32c of the node in the unused head of its entries.
+	nodeChecksumOffset = nodeHeadLen + 8
 )
 
+func nodeChecksum(p []byte) (v uint32) {
+	v = checksum.Sum(p[:nodeChecksumOffset], p[nodeChecksumOffset+4:nodeSize])
+	return
+}
+
+func verifyNode(p []byte) (ok bool) {
+	expected := binary.BigEndian.Uint32(p[nodeChecksumOffset : nodeChecksumOffset+4])
+	ok = expected == nodeChecksum(p)
+	return
+}
+
+// cow is shared by nodes of a tree, resolving serializes resolving stubs by readers which only hold the read lock of the tree.
 type cow struct {
-	_ int
+	resolving sync.Mutex
 }
 
 type pathHint struct {
@@ -22,15 +39,36 @@ type pathHint struct {
 	path [8]uint8
 }
 
+// node is a stub when it is not resolved, only idx and key are known, its children are read on first use.
+// stub is 1 until the node is resolved, it is accessed atomically, so children are visible after it is 0.
 type node struct {
 	cow      *cow
 	key      []byte
 	idx      int64
+	stub     int32
 	items    Entries
 	children *[]*node
 }
 
-func (n *node) entries(reader *ioutils.File, cache *lru.LRU, hold bool) (v Entries, err error) {
+func newStubNode(c *cow, idx int64) (n *node) {
+	n = &node{cow: c, idx: idx, stub: 1}
+	n.key = make([]byte, 8)
+	binary.BigEndian.PutUint64(n.key, uint64(idx))
+	return
+}
+
+// entries returns items of the node, the node is resolved first when it is a stub.
+func (n *node) entries(reader *journal.File, cache *lru.LRU, hold bool) (v Entries, err error) {
+	if n.isStub() {
+		n.cow.resolving.Lock()
+		if n.isStub() {
+			err = n.resolve(reader, cache)
+		}
+		n.cow.resolving.Unlock()
+		if err != nil {
+			return
+		}
+	}
 	if hold {
 		if n.items != nil && len(n.items) > 0 {
 			v = n.items
@@ -46,7 +84,7 @@ func (n *node) entries(reader *ioutils.File, cache *lru.LRU, hold bool) (v Entri
 	return
 }
 
-func (n *node) load(reader *ioutils.File, cache *lru.LRU) (v Entries, err error) {
+func (n *node) load(reader *journal.File, cache *lru.LRU) (v Entries, err error) {
 	vv, has := cache.Get(n.idx)
 	if has {
 		v, has = vv.(Entries)
@@ -56,21 +94,67 @@ func (n *node) load(reader *ioutils.File, cache *lru.LRU) (v Entries, err error)
 		}
 		return
 	}
-	fmt.Println("no cache", n.idx, binary.BigEndian.Uint64(n.key))
 	off := (n.idx-1)*nodeSize + headSize
-	m, readErr := reader.ReadRegion(off, nodeSize)
+	p, readErr := reader.ReadAt(off, nodeSize)
 	if readErr != nil {
 		err = readErr
 		return
 	}
+	if len(p) == nodeSize && !verifyNode(p) {
+		err = &checksum.Error{File: reader.Path(), Offset: off, Structure: "btree node"}
+		return
+	}
 	v = NewEntries(maxItems)
-	copy(v, m.Bytes()[nodeHeadLen:])
-	_ = m.Close()
+	if len(p) > nodeHeadLen {
+		copy(v, p[nodeHeadLen:])
+	}
 	cache.Add(n.idx, v)
 	return
 }
 
-func (n *node) update(file *ioutils.File, cache *lru.LRU) (err error) {
+// isStub returns true when the node is not resolved.
+func (n *node) isStub() bool {
+	return atomic.LoadInt32(&n.stub) == 1
+}
+
+// resolve reads children of the node as stubs, and caches items when they are not cached.
+// Nodes are read by copies, because regions of the file may be shared by concurrent readers.
+func (n *node) resolve(reader *journal.File, cache *lru.LRU) (err error) {
+	off := (n.idx-1)*nodeSize + headSize
+	p, readErr := reader.ReadAt(off, nodeSize)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	if len(p) < nodeSize {
+		err = fmt.Errorf("btree resolve node %d failed, node is broken", n.idx)
+		return
+	}
+	if !verifyNode(p) {
+		err = &checksum.Error{File: reader.Path(), Offset: off, Structure: "btree node"}
+		return
+	}
+	var children []*node
+	for i := 0; i < (maxItems + 1); i++ {
+		c := binary.BigEndian.Uint64(p[i*8 : (i+1)*8])
+		if c == 0 {
+			break
+		}
+		children = append(children, newStubNode(n.cow, int64(c)))
+	}
+	if !cache.Contains(n.idx) {
+		items := NewEntries(maxItems)
+		copy(items, p[nodeHeadLen:])
+		cache.Add(n.idx, items)
+	}
+	if len(children) > 0 {
+		n.children = &children
+	}
+	atomic.StoreInt32(&n.stub, 0)
+	return
+}
+
+func (n *node) update(file *journal.File, cache *lru.LRU) (err error) {
 	if n.items == nil || len(n.items) == 0 {
 		err = fmt.Errorf("btree can not update node which has nil entries failed")
 		return
@@ -85,6 +169,7 @@ func (n *node) update(file *ioutils.File, cache *lru.LRU) (err error) {
 	items := NewEntries(maxItems)
 	copy(items, n.items)
 	copy(p[nodeHeadLen:], items)
+	binary.BigEndian.PutUint32(p[nodeChecksumOffset:nodeChecksumOffset+4], nodeChecksum(p))
 	off := (n.idx-1)*nodeSize + headSize
 	err = file.WriteAt(off, p)
 	if err != nil {
@@ -116,6 +201,19 @@ func (n *node) String() (v string) {
 	return
 }
 
+// dirtyNodes are nodes which are changed by an operation, allocated are slots which were not used by the last commit,
+// and freed are slots which are not used after the operation.
 type dirtyNodes struct {
-	nodes map[int64]*node
+	nodes     map[int64]*node
+	allocated map[int64]bool
+	freed     []int64
+}
+
+func newDirtyNodes() (dirty *dirtyNodes) {
+	dirty = &dirtyNodes{
+		nodes:     make(map[int64]*node),
+		allocated: make(map[int64]bool),
+		freed:     nil,
+	}
+	return
 }
@@ -0,0 +1,127 @@
+package btree
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestBTree_LazyLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bt")
+	tr, err := New(Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(i int) []byte {
+		p := make([]byte, 8)
+		binary.BigEndian.PutUint64(p, uint64(i))
+		return p
+	}
+	for i := 0; i < 200000; i++ {
+		if err = tr.Set(key(i), key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err = New(Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	if tr.root.isStub() || tr.root.leaf() {
+		t.Fatal("expected resolved root which has children")
+	}
+	for _, child := range *tr.root.children {
+		if !child.isStub() {
+			t.Fatal("expected children are not read at open")
+		}
+	}
+	v, has, getErr := tr.Get(key(123456))
+	if getErr != nil || !has || binary.BigEndian.Uint64(v) != 123456 {
+		t.Fatal("unexpected get", has, getErr)
+	}
+	resolved := 0
+	for _, child := range *tr.root.children {
+		if !child.isStub() {
+			resolved++
+		}
+	}
+	if resolved != 1 {
+		t.Fatal("expected only the child on the path resolved, got", resolved)
+	}
+	if tr.cache.Len() > 4 {
+		t.Fatal("expected cached nodes are bounded by the lru, got", tr.cache.Len())
+	}
+}
+
+func TestBTree_ConcurrentGet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bt")
+	tr, err := New(Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(i int) []byte {
+		p := make([]byte, 8)
+		binary.BigEndian.PutUint64(p, uint64(i))
+		return p
+	}
+	for i := 0; i < 20000; i++ {
+		if err = tr.Set(key(i), key(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr, err = New(Options{
+		Path:          path,
+		MaxCacheNodes: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	wg := new(sync.WaitGroup)
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 20000; i += 3 {
+				v, has, getErr := tr.Get(key(i))
+				if getErr != nil {
+					errs <- getErr
+					return
+				}
+				if !has || binary.BigEndian.Uint64(v) != uint64(i) {
+					errs <- fmt.Errorf("unexpected value of %d", i)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for getErr := range errs {
+		t.Fatal(getErr)
+	}
+}
@@ -0,0 +1,161 @@
+package btree_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/checksum"
+	"github.com/aacfactory/tapedb/internal/index/btree"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBTree_TornHead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bt")
+	tr, err := btree.New(btree.Options{
+		Path: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 2000
+	for i := 0; i < n; i++ {
+		if err = tr.Set(intBytes(int64(i)), intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Set(intBytes(n), intBytes(n)); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// crash when the head of the last commit was written partly
+	file, openErr := os.OpenFile(path, os.O_RDWR, 0600)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	copies := make([][]byte, 2)
+	for i := range copies {
+		copies[i] = make([]byte, 8)
+		if _, err = file.ReadAt(copies[i], int64(1024+i*1024)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newer := 0
+	if binary.BigEndian.Uint64(copies[1]) > binary.BigEndian.Uint64(copies[0]) {
+		newer = 1
+	}
+	if _, err = file.WriteAt([]byte{0xff, 0xff}, int64(1024+newer*1024+20)); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	tr, err = btree.New(btree.Options{
+		Path: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	for i := 0; i < n; i++ {
+		v, has, getErr := tr.Get(intBytes(int64(i)))
+		if getErr != nil {
+			t.Fatal(getErr)
+		}
+		if !has || bytesInt(v) != i {
+			t.Fatal("expected the tree of the previous head", i)
+		}
+	}
+	if _, has, _ := tr.Get(intBytes(n)); has {
+		t.Fatal("expected the last commit is dropped with its head")
+	}
+}
+
+func TestBTree_CorruptedNode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bt")
+	tr, err := btree.New(btree.Options{
+		Path: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = tr.Set([]byte(fmt.Sprintf("key:%d", i)), intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// nodes of older commits may be kept in freed slots, so all copies are corrupted
+	p, _ := os.ReadFile(path)
+	if !bytes.Contains(p, []byte("key:5")) {
+		t.Fatal("expected key in file")
+	}
+	p = bytes.ReplaceAll(p, []byte("key:5"), []byte("Key:5"))
+	if err = os.WriteFile(path, p, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the root is resolved when the tree is loaded
+	_, err = btree.New(btree.Options{
+		Path: path,
+	})
+	var corrupted *checksum.Error
+	if !errors.As(err, &corrupted) || corrupted.File != path || corrupted.Structure != "btree node" {
+		t.Fatal("expected corrupted node", err)
+	}
+}
+
+func TestBTree_BrokenHeads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bt")
+	tr, err := btree.New(btree.Options{
+		Path: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = tr.Set(intBytes(int64(i)), intBytes(int64(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, openErr := os.OpenFile(path, os.O_RDWR, 0600)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = file.WriteAt([]byte{0xff, 0xff}, int64(1024+i*1024+20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = file.Close()
+	// the index is reported instead of being opened as an empty tree
+	_, err = btree.New(btree.Options{
+		Path: path,
+	})
+	var corrupted *checksum.Error
+	if !errors.As(err, &corrupted) || corrupted.File != path || corrupted.Structure != "btree head" {
+		t.Fatal("expected corrupted head", err)
+	}
+	var problems []string
+	if err = btree.Check(path, func(key []byte, value []byte) {}, func(offset int64, problem string) {
+		problems = append(problems, problem)
+	}); err != nil || len(problems) != 1 {
+		t.Fatal("expected broken head is reported by check", problems, err)
+	}
+}
@@ -0,0 +1,101 @@
+package btree
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+// Vacuum moves nodes at the end of the file into freed slots, then truncates the file.
+// Unlike commits of sets and deletes, parents of moved nodes are written in place, so the operation relies on its writes being flushed all or nothing.
+func (tr *BTree) Vacuum() (err error) {
+	tr.counter.Add(1)
+	defer tr.counter.Done()
+	tr.mutex.Lock()
+	defer tr.mutex.Unlock()
+	live := tr.size - int64(len(tr.free)) - int64(len(tr.pending))
+	err = tr.vacuum(live)
+	if err != nil {
+		return
+	}
+	err = tr.file.Truncate(headSize + live*nodeSize)
+	return
+}
+
+// vacuum moves nodes which are after live in an operation, the file is truncated after the operation was committed.
+func (tr *BTree) vacuum(live int64) (err error) {
+	tr.file.Begin()
+	defer tr.end(&err)
+	if err = tr.link(); err != nil {
+		return
+	}
+	slots := make([]int64, 0, len(tr.free))
+	for _, idx := range tr.free {
+		if idx <= live {
+			slots = append(slots, idx)
+		}
+	}
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i] < slots[j]
+	})
+	dirty := newDirtyNodes()
+	err = tr.vacuumNode(tr.root, nil, live, &slots, dirty)
+	if err != nil {
+		return
+	}
+	tr.free = tr.free[:0]
+	tr.size = live
+	nodes := make([]*node, 0, len(dirty.nodes))
+	for _, n := range dirty.nodes {
+		nodes = append(nodes, n)
+	}
+	err = tr.write(nodes)
+	if err != nil {
+		return
+	}
+	err = tr.writeHead(false)
+	if err != nil {
+		return
+	}
+	tr.release(tr.root)
+	return
+}
+
+// vacuumNode moves n and its descendants which are after live into slots, and marks their parents dirty.
+func (tr *BTree) vacuumNode(n *node, parent *node, live int64, slots *[]int64, dirty *dirtyNodes) (err error) {
+	if n == nil {
+		return
+	}
+	// resolve the node to walk its children
+	if _, err = n.entries(tr.file, tr.cache, false); err != nil {
+		return
+	}
+	if n.idx > live {
+		// hold entries before changing idx, they are cached by idx
+		if _, err = n.entries(tr.file, tr.cache, true); err != nil {
+			return
+		}
+		tr.cache.Remove(n.idx)
+		delete(dirty.nodes, n.idx)
+		n.idx = (*slots)[0]
+		*slots = (*slots)[1:]
+		n.key = make([]byte, 8)
+		binary.BigEndian.PutUint64(n.key, uint64(n.idx))
+		dirty.nodes[n.idx] = n
+		if parent != nil {
+			if _, err = parent.entries(tr.file, tr.cache, true); err != nil {
+				return
+			}
+			dirty.nodes[parent.idx] = parent
+		}
+	}
+	if n.leaf() {
+		return
+	}
+	for _, child := range *n.children {
+		err = tr.vacuumNode(child, n, live, slots, dirty)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
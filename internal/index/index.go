@@ -1,9 +1,9 @@
 package index
 
 import (
-	"fmt"
 	"github.com/aacfactory/tapedb/internal/index/blist"
 	"github.com/aacfactory/tapedb/internal/index/btree"
+	"github.com/aacfactory/tapedb/internal/journal"
 	"sync"
 )
 
@@ -20,6 +20,7 @@ func New(options Options) (idx *Indexer, err error) {
 	}
 	bl, blErr := blist.New(options.BList)
 	if blErr != nil {
+		_ = bt.Close()
 		err = blErr
 		return
 	}
@@ -39,7 +40,8 @@ type Indexer struct {
 	counter *sync.WaitGroup
 }
 
-func (idx *Indexer) Set(key []byte, poss [][]byte) (err error) {
+// Set appends poss to the list of key, offset is the offset of the first one in the list.
+func (idx *Indexer) Set(key []byte, poss [][]byte) (offset int64, err error) {
 	idx.mutex.Lock()
 	defer idx.mutex.Unlock()
 	idx.counter.Add(1)
@@ -61,6 +63,10 @@ func (idx *Indexer) Set(key []byte, poss [][]byte) (err error) {
 		listNo = list.No()
 	} else {
 		listNo = decodeListNo(encodedListNo)
+		offset, err = idx.bl.Len(listNo)
+		if err != nil {
+			return
+		}
 	}
 	// bt
 	addErr := idx.bl.Add(listNo, poss)
@@ -79,6 +85,113 @@ func (idx *Indexer) Set(key []byte, poss [][]byte) (err error) {
 	return
 }
 
+// Retain keeps the last n poss of key, they are copied into a new list which replaces the list of key, and the old list is freed.
+func (idx *Indexer) Retain(key []byte, n int64) (err error) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.counter.Add(1)
+	defer idx.counter.Done()
+	// bt
+	encodedListNo, hasList, getListNoErr := idx.bt.Get(key)
+	if getListNoErr != nil {
+		err = getListNoErr
+		return
+	}
+	if !hasList {
+		return
+	}
+	listNo := decodeListNo(encodedListNo)
+	// bl
+	size, lenErr := idx.bl.Len(listNo)
+	if lenErr != nil {
+		err = lenErr
+		return
+	}
+	if size <= n {
+		return
+	}
+	poss, getErr := idx.bl.Get(listNo, size-n)
+	if getErr != nil {
+		err = getErr
+		return
+	}
+	list, newListErr := idx.bl.AllocList()
+	if newListErr != nil {
+		err = newListErr
+		return
+	}
+	if len(poss) > 0 {
+		addErr := idx.bl.Add(list.No(), poss)
+		if addErr != nil {
+			err = addErr
+			return
+		}
+	}
+	// bt
+	err = idx.bt.Set(key, encodeListNo(list.No()))
+	if err != nil {
+		return
+	}
+	// bl
+	err = idx.bl.Free(listNo)
+	return
+}
+
+// Vacuum shrinks the btree file and the blist file by reusing freed slots,
+// it holds the indexer exclusively for the whole pass, so other calls wait until it is done.
+// Only keys of lists which are moved are kept in memory.
+func (idx *Indexer) Vacuum() (err error) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+	idx.counter.Add(1)
+	defer idx.counter.Done()
+	// bt
+	err = idx.bt.Vacuum()
+	if err != nil {
+		return
+	}
+	live := idx.bl.Live()
+	keys := make(map[int64][]byte)
+	err = idx.bt.Ascend(nil, func(key []byte, value []byte) (next bool) {
+		if no := decodeListNo(value); no > live {
+			keys[no] = key
+		}
+		return true
+	})
+	if err != nil {
+		return
+	}
+	// bl
+	err = idx.bl.Vacuum(func(from int64, to int64) (err error) {
+		key, has := keys[from]
+		if !has {
+			// list was orphaned before it could be freed
+			return
+		}
+		err = idx.bt.Set(key, encodeListNo(to))
+		return
+	})
+	return
+}
+
+// Vacuum shrinks files of the indexer which is not opened.
+func Vacuum(options Options) (err error) {
+	idx, openErr := New(options)
+	if openErr != nil {
+		err = openErr
+		return
+	}
+	err = idx.Vacuum()
+	if err == nil {
+		err = idx.Flush()
+	}
+	closeErr := idx.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
+
 func (idx *Indexer) Get(key []byte, offset int64) (poss [][]byte, err error) {
 	idx.mutex.RLock()
 	defer idx.mutex.RUnlock()
@@ -88,8 +201,7 @@ func (idx *Indexer) Get(key []byte, offset int64) (poss [][]byte, err error) {
 		err = getListNoErr
 		return
 	}
-	if hasList {
-		err = fmt.Errorf("not exist")
+	if !hasList {
 		return
 	}
 	listNo := decodeListNo(encodedListNo)
@@ -98,9 +210,139 @@ func (idx *Indexer) Get(key []byte, offset int64) (poss [][]byte, err error) {
 	return
 }
 
+// Iterator returns an iterator of poss of key from offset, has is false when key does not exist.
+func (idx *Indexer) Iterator(key []byte, offset int64) (it *blist.Iterator, has bool, err error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	// bt
+	encodedListNo, hasList, getListNoErr := idx.bt.Get(key)
+	if getListNoErr != nil {
+		err = getListNoErr
+		return
+	}
+	if !hasList {
+		return
+	}
+	// bl
+	it, err = idx.bl.Iterator(decodeListNo(encodedListNo), offset)
+	has = err == nil
+	return
+}
+
+// Search returns the smallest offset of poss of key which f is true for, see blist.BList Search.
+func (idx *Indexer) Search(key []byte, f func(pos []byte) (ok bool)) (offset int64, err error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	// bt
+	encodedListNo, hasList, getListNoErr := idx.bt.Get(key)
+	if getListNoErr != nil {
+		err = getListNoErr
+		return
+	}
+	if !hasList {
+		return
+	}
+	// bl
+	offset, err = idx.bl.Search(decodeListNo(encodedListNo), f)
+	return
+}
+
+func (idx *Indexer) Len(key []byte) (n int64, err error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	// bt
+	encodedListNo, hasList, getListNoErr := idx.bt.Get(key)
+	if getListNoErr != nil {
+		err = getListNoErr
+		return
+	}
+	if !hasList {
+		return
+	}
+	// bl
+	n, err = idx.bl.Len(decodeListNo(encodedListNo))
+	return
+}
+
+func (idx *Indexer) Last(key []byte) (pos []byte, has bool, err error) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	// bt
+	encodedListNo, hasList, getListNoErr := idx.bt.Get(key)
+	if getListNoErr != nil {
+		err = getListNoErr
+		return
+	}
+	if !hasList {
+		return
+	}
+	listNo := decodeListNo(encodedListNo)
+	// bl
+	pos, has, err = idx.bl.Last(listNo)
+	return
+}
+
+// Keys returns a cursor of keys in order.
+func (idx *Indexer) Keys() (c *btree.Cursor) {
+	c = idx.bt.Cursor()
+	return
+}
+
+// Files returns files of the btree and the blist, their writes are kept in memory until they are flushed.
+func (idx *Indexer) Files() (files []*journal.File) {
+	files = []*journal.File{idx.bt.File(), idx.bl.File()}
+	return
+}
+
+// Flush writes changes in memory into files of the btree and the blist, indexes of tapes are flushed by checkpoints of the write-ahead log instead.
+func (idx *Indexer) Flush() (err error) {
+	err = idx.bl.Flush()
+	if err != nil {
+		return
+	}
+	err = idx.bt.Flush()
+	return
+}
+
 func (idx *Indexer) Close() (err error) {
 	idx.counter.Wait()
 	_ = idx.bt.Close()
 	_ = idx.bl.Close()
 	return
 }
+
+// Check verifies files of the indexer which is not opened, the files are not changed, see btree.Check and blist.Checker.
+// visit is called with each pos of each key and the offset of its list in the blist file,
+// broken is called with the path, the offset and the problem of each inconsistency.
+func Check(options Options, visit func(key []byte, offset int64, pos []byte), broken func(path string, offset int64, problem string)) (err error) {
+	btreeBroken := func(offset int64, problem string) {
+		broken(options.BTree.Path, offset, problem)
+	}
+	blistBroken := func(offset int64, problem string) {
+		broken(options.BList.Path, offset, problem)
+	}
+	keys := make([][]byte, 0, 1)
+	nos := make([]int64, 0, 1)
+	err = btree.Check(options.BTree.Path, func(key []byte, value []byte) {
+		keys = append(keys, append([]byte(nil), key...))
+		nos = append(nos, decodeListNo(value))
+	}, btreeBroken)
+	if err != nil {
+		return
+	}
+	checker, checkerErr := blist.NewChecker(options.BList.Path, blistBroken)
+	if checkerErr != nil {
+		err = checkerErr
+		return
+	}
+	defer checker.Close()
+	for i, key := range keys {
+		err = checker.Chain(nos[i], func(offset int64, pos []byte) {
+			visit(key, offset, pos)
+		}, blistBroken)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
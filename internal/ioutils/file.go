@@ -90,7 +90,7 @@ func OpenFile(filePath string) (file *File, err error) {
 	if !ExistFile(filePath) {
 		dir, _ := filepath.Split(filePath)
 		if !ExistFile(dir) {
-			err = os.MkdirAll(dir, 0600)
+			err = os.MkdirAll(dir, 0700)
 			if err != nil {
 				return
 			}
@@ -132,17 +132,26 @@ func (f *File) Size() (n int64, err error) {
 	return
 }
 
+// WriteAt can be called concurrently, writers of the same region must be serialized by callers.
 func (f *File) WriteAt(offset int64, p []byte) (err error) {
-	f.mutex.Lock()
+	f.mutex.RLock()
 	err = WriteRegion(f.file, offset, p)
+	f.mutex.RUnlock()
+	return
+}
+
+// Truncate changes the size of the file, it must not be called with other reads or writes.
+func (f *File) Truncate(size int64) (err error) {
+	f.mutex.Lock()
+	err = f.file.Truncate(size)
 	f.mutex.Unlock()
 	return
 }
 
 func (f *File) Sync() (err error) {
-	f.mutex.Lock()
+	f.mutex.RLock()
 	err = f.file.Sync()
-	f.mutex.Unlock()
+	f.mutex.RUnlock()
 	return
 }
 
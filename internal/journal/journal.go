@@ -0,0 +1,396 @@
+package journal
+
+import (
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	pageSize               = 4096
+	defaultMaxPendingBytes = 64 * ioutils.MEGABYTE
+)
+
+type Options struct {
+	Path string
+	// MaxPendingBytes is the size of written pages which triggers Full, default is 64M.
+	MaxPendingBytes int64
+	// Full is called when written pages exceed MaxPendingBytes, it must not block.
+	Full func()
+}
+
+// New opens the file, its writes are kept in memory until Flush.
+func New(opts Options) (f *File, err error) {
+	data, openErr := ioutils.OpenFile(opts.Path)
+	if openErr != nil {
+		err = fmt.Errorf("new journal file failed, %v", openErr)
+		return
+	}
+	size, sizeErr := data.Size()
+	if sizeErr != nil {
+		_ = data.Close()
+		err = fmt.Errorf("new journal file failed, %v", sizeErr)
+		return
+	}
+	maxPendingBytes := opts.MaxPendingBytes
+	if maxPendingBytes <= 0 {
+		maxPendingBytes = defaultMaxPendingBytes
+	}
+	f = &File{
+		mutex:           new(sync.RWMutex),
+		op:              new(sync.RWMutex),
+		path:            opts.Path,
+		data:            data,
+		pages:           make(map[int64][]byte),
+		size:            size,
+		dataSize:        size,
+		maxPendingBytes: maxPendingBytes,
+		full:            opts.Full,
+	}
+	return
+}
+
+// File is a data file which written pages are kept in memory until Flush, so the data file only has complete operations.
+// Operations are made durable by a write-ahead log, which logs them before they are applied,
+// and logs pages by Pages before they are flushed, so they are redone after a crash.
+type File struct {
+	mutex           *sync.RWMutex
+	op              *sync.RWMutex
+	path            string
+	data            *ioutils.File
+	pages           map[int64][]byte
+	size            int64
+	dataSize        int64
+	shrunk          bool
+	maxPendingBytes int64
+	full            func()
+}
+
+// Path returns the path of the data file.
+func (f *File) Path() (path string) {
+	path = f.path
+	return
+}
+
+// Begin starts an operation, writes until Commit are flushed all or nothing, and Flush waits for Commit.
+func (f *File) Begin() {
+	f.op.RLock()
+}
+
+// Commit ends the operation, Full is called when written pages are too many.
+func (f *File) Commit() (err error) {
+	f.mutex.RLock()
+	full := int64(len(f.pages))*pageSize > f.maxPendingBytes
+	f.mutex.RUnlock()
+	f.op.RUnlock()
+	if full && f.full != nil {
+		f.full()
+	}
+	return
+}
+
+func (f *File) WriteAt(offset int64, p []byte) (err error) {
+	if len(p) == 0 {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	end := offset + int64(len(p))
+	for off := offset; off < end; {
+		pageNo := off / pageSize
+		page, has := f.pages[pageNo]
+		if !has {
+			page = make([]byte, pageSize)
+			// the base page is read only when it is written partly and it is in the data file
+			whole := off == pageNo*pageSize && end >= off+pageSize
+			if !whole && pageNo*pageSize < f.dataSize {
+				base, readErr := f.data.ReadAt(pageNo*pageSize, pageSize)
+				if readErr != nil {
+					err = readErr
+					return
+				}
+				copy(page, base)
+			}
+			f.pages[pageNo] = page
+		}
+		n := copy(page[off-pageNo*pageSize:], p[off-offset:])
+		off = off + int64(n)
+	}
+	if end > f.size {
+		f.size = end
+	}
+	return
+}
+
+func (f *File) ReadAt(offset int64, capacity int64) (p []byte, err error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if !f.overlaid(offset, capacity) {
+		p, err = f.data.ReadAt(offset, capacity)
+		return
+	}
+	if offset+capacity > f.size {
+		capacity = f.size - offset
+	}
+	p, err = f.compose(offset, capacity)
+	return
+}
+
+func (f *File) ReadRegion(offset int64, capacity int64) (region ioutils.FileRegion, err error) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	if !f.overlaid(offset, capacity) {
+		region, err = f.data.ReadRegion(offset, capacity)
+		return
+	}
+	if offset+capacity > f.size {
+		err = fmt.Errorf("file has no this region")
+		return
+	}
+	p, composeErr := f.compose(offset, capacity)
+	if composeErr != nil {
+		err = composeErr
+		return
+	}
+	region = &memRegion{
+		data: p,
+	}
+	return
+}
+
+// Size returns the size of the file including pages which were not flushed.
+func (f *File) Size() (n int64, err error) {
+	f.mutex.RLock()
+	n = f.size
+	f.mutex.RUnlock()
+	return
+}
+
+// Truncate drops pages after size, it must not be called in an operation, and the data file is truncated by Flush.
+func (f *File) Truncate(size int64) (err error) {
+	f.op.Lock()
+	defer f.op.Unlock()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err = f.shrink(size)
+	return
+}
+
+// Page is a written page which was not flushed, P is trimmed at the size of the file.
+type Page struct {
+	Offset int64
+	P      []byte
+}
+
+// Pages returns the size and the written pages of the file, pages is nil when the file was not changed,
+// and they must not be used after the next write.
+func (f *File) Pages() (size int64, pages []Page) {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	size = f.size
+	if len(f.pages) == 0 && f.size == f.dataSize && !f.shrunk {
+		return
+	}
+	pages = make([]Page, 0, len(f.pages))
+	for _, pageNo := range f.pageNos() {
+		pages = append(pages, Page{
+			Offset: pageNo * pageSize,
+			P:      f.trim(pageNo),
+		})
+	}
+	return
+}
+
+// Flush writes pages into the data file and syncs it, it is not atomic,
+// so pages are logged by Pages before flushing, and they are written again by Restore after a crash.
+func (f *File) Flush() (err error) {
+	f.op.Lock()
+	defer f.op.Unlock()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err = f.write()
+	return
+}
+
+// Restore writes pages which were returned by Pages into the file at path, and truncates it to size.
+func Restore(path string, size int64, pages []Page) (err error) {
+	data, openErr := ioutils.OpenFile(path)
+	if openErr != nil {
+		err = fmt.Errorf("restore %s failed, %v", path, openErr)
+		return
+	}
+	for _, page := range pages {
+		if err = data.WriteAt(page.Offset, page.P); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = data.Truncate(size)
+	}
+	if err == nil {
+		err = data.Sync()
+	}
+	_ = data.Close()
+	if err != nil {
+		err = fmt.Errorf("restore %s failed, %v", path, err)
+		return
+	}
+	return
+}
+
+// write writes pages into the data file and syncs it, f.op and f.mutex must be held.
+func (f *File) write() (err error) {
+	if len(f.pages) == 0 && f.size == f.dataSize && !f.shrunk {
+		return
+	}
+	for _, pageNo := range f.pageNos() {
+		if err = f.data.WriteAt(pageNo*pageSize, f.trim(pageNo)); err != nil {
+			err = fmt.Errorf("flush failed, %v", err)
+			return
+		}
+	}
+	if f.size < f.dataSize || f.shrunk {
+		if err = f.data.Truncate(f.size); err != nil {
+			err = fmt.Errorf("flush failed, %v", err)
+			return
+		}
+	}
+	if err = f.data.Sync(); err != nil {
+		err = fmt.Errorf("flush failed, %v", err)
+		return
+	}
+	f.dataSize = f.size
+	f.shrunk = false
+	f.pages = make(map[int64][]byte)
+	return
+}
+
+// shrink drops pages after size, the tail of the page which holds size is cleared, f.mutex must be held.
+func (f *File) shrink(size int64) (err error) {
+	for pageNo := range f.pages {
+		if pageNo*pageSize >= size {
+			delete(f.pages, pageNo)
+		}
+	}
+	if off := size % pageSize; off != 0 {
+		pageNo := size / pageSize
+		page, has := f.pages[pageNo]
+		if !has {
+			page = make([]byte, pageSize)
+			if pageNo*pageSize < f.dataSize {
+				base, readErr := f.data.ReadAt(pageNo*pageSize, pageSize)
+				if readErr != nil {
+					err = readErr
+					return
+				}
+				copy(page, base)
+			}
+			f.pages[pageNo] = page
+		}
+		ioutils.ClearRange(page, int(off), pageSize)
+	}
+	f.size = size
+	// bytes of the data file after size are stale, so they are not read as base pages, and the file is truncated by Flush
+	if f.dataSize > size {
+		f.dataSize = size
+		f.shrunk = true
+	}
+	return
+}
+
+// pageNos returns numbers of written pages in order, f.mutex must be held.
+func (f *File) pageNos() (pageNos []int64) {
+	pageNos = make([]int64, 0, len(f.pages))
+	for pageNo := range f.pages {
+		pageNos = append(pageNos, pageNo)
+	}
+	sort.Slice(pageNos, func(i, j int) bool {
+		return pageNos[i] < pageNos[j]
+	})
+	return
+}
+
+// trim returns the page which is trimmed at the size of the file, f.mutex must be held.
+func (f *File) trim(pageNo int64) (page []byte) {
+	page = f.pages[pageNo]
+	if n := f.size - pageNo*pageSize; n < pageSize {
+		page = page[:n]
+	}
+	return
+}
+
+// Close closes the file, pages which were not flushed are dropped, they are redone from the write-ahead log.
+func (f *File) Close() (err error) {
+	err = f.data.Close()
+	return
+}
+
+// overlaid returns true when a page in the range was written but not flushed, f.mutex must be held.
+func (f *File) overlaid(offset int64, capacity int64) (ok bool) {
+	if len(f.pages) == 0 || capacity <= 0 {
+		return
+	}
+	for pageNo := offset / pageSize; pageNo <= (offset+capacity-1)/pageSize; pageNo++ {
+		if _, ok = f.pages[pageNo]; ok {
+			return
+		}
+	}
+	return
+}
+
+// compose reads the range from the data file and pages, f.mutex must be held.
+func (f *File) compose(offset int64, capacity int64) (p []byte, err error) {
+	if capacity <= 0 {
+		return
+	}
+	base, readErr := f.data.ReadAt(offset, capacity)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	p = make([]byte, capacity)
+	copy(p, base)
+	end := offset + capacity
+	for pageNo := offset / pageSize; pageNo <= (end-1)/pageSize; pageNo++ {
+		page, has := f.pages[pageNo]
+		if !has {
+			continue
+		}
+		beg := pageNo * pageSize
+		if beg < offset {
+			copy(p, page[offset-beg:])
+		} else {
+			copy(p[beg-offset:], page)
+		}
+	}
+	return
+}
+
+type memRegion struct {
+	data []byte
+}
+
+func (r *memRegion) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= int64(len(r.data)) {
+		err = io.EOF
+		return
+	}
+	n = copy(p, r.data[off:])
+	return
+}
+
+func (r *memRegion) Read(p []byte) (n int, err error) {
+	n = copy(p, r.data)
+	return
+}
+
+func (r *memRegion) Bytes() (p []byte) {
+	p = r.data
+	return
+}
+
+func (r *memRegion) Close() (err error) {
+	return
+}
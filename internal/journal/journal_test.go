@@ -0,0 +1,94 @@
+package journal_test
+
+import (
+	"bytes"
+	"github.com/aacfactory/tapedb/internal/journal"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile_Flush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	f, err := journal.New(journal.Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a flushed operation
+	f.Begin()
+	if err = f.WriteAt(0, bytes.Repeat([]byte{1}, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// an operation which is only in memory
+	f.Begin()
+	if err = f.WriteAt(4090, []byte("committed")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.WriteAt(9000, []byte("tail")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := f.ReadAt(4090, 9)
+	if string(p) != "committed" {
+		t.Fatal("expected written pages are read before flush", string(p))
+	}
+	region, regionErr := f.ReadRegion(9000, 4)
+	if regionErr != nil || string(region.Bytes()) != "tail" {
+		t.Fatal("unexpected region", regionErr)
+	}
+	if stat, _ := os.Stat(path); stat.Size() != 5000 {
+		t.Fatal("expected written pages are not in the data file before flush", stat.Size())
+	}
+	size, pages := f.Pages()
+	if size != 9004 || len(pages) != 3 || pages[0].Offset != 0 || pages[2].Offset != 8192 || len(pages[2].P) != 9004-8192 {
+		t.Fatal("unexpected pages", size, len(pages))
+	}
+	// pages which were not flushed are dropped by close, and written again by restore
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := os.Stat(path); stat.Size() != 5000 {
+		t.Fatal("expected not flushed pages are dropped", stat.Size())
+	}
+	if err = journal.Restore(path, size, pages); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = journal.New(journal.Options{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	p, _ = f.ReadAt(4090, 9)
+	if string(p) != "committed" {
+		t.Fatal("expected restored pages", string(p))
+	}
+	p, _ = f.ReadAt(4999, 2)
+	if !bytes.Equal(p, []byte{1, 0}) {
+		t.Fatal("unexpected bytes between writes", p)
+	}
+	if size, _ = f.Size(); size != 9004 {
+		t.Fatal("unexpected size", size)
+	}
+	// truncate drops pages after size, and the data file is truncated by flush
+	if err = f.Truncate(4095); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ = f.ReadAt(4090, 9); !bytes.Equal(p, []byte("commi")) {
+		t.Fatal("unexpected bytes after truncate", p)
+	}
+	if err = f.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if stat, _ := os.Stat(path); stat.Size() != 4095 {
+		t.Fatal("expected truncated data file", stat.Size())
+	}
+}
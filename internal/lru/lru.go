@@ -3,11 +3,13 @@ package lru
 import (
 	"container/list"
 	"errors"
+	"sync"
 )
 
 type EvictCallback func(key interface{}, value interface{})
 
 type LRU struct {
+	mutex     sync.Mutex
 	size      int64
 	evictList *list.List
 	items     map[interface{}]*list.Element
@@ -33,6 +35,8 @@ func NewLRU(size int64, onEvict EvictCallback) (*LRU, error) {
 }
 
 func (c *LRU) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	for k, v := range c.items {
 		if c.onEvict != nil {
 			c.onEvict(k, v.Value.(*entry).value)
@@ -43,6 +47,8 @@ func (c *LRU) Purge() {
 }
 
 func (c *LRU) Add(key, value interface{}) (evicted bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if ent, ok := c.items[key]; ok {
 		c.evictList.MoveToFront(ent)
 		ent.Value.(*entry).value = value
@@ -61,6 +67,8 @@ func (c *LRU) Add(key, value interface{}) (evicted bool) {
 }
 
 func (c *LRU) Get(key interface{}) (value interface{}, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if ent, ok := c.items[key]; ok {
 		c.evictList.MoveToFront(ent)
 		if ent.Value.(*entry) == nil {
@@ -72,11 +80,15 @@ func (c *LRU) Get(key interface{}) (value interface{}, ok bool) {
 }
 
 func (c *LRU) Contains(key interface{}) (ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	_, ok = c.items[key]
 	return ok
 }
 
 func (c *LRU) Peek(key interface{}) (value interface{}, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	var ent *list.Element
 	if ent, ok = c.items[key]; ok {
 		return ent.Value.(*entry).value, true
@@ -85,6 +97,8 @@ func (c *LRU) Peek(key interface{}) (value interface{}, ok bool) {
 }
 
 func (c *LRU) Remove(key interface{}) (present bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	if ent, ok := c.items[key]; ok {
 		c.removeElement(ent)
 		return true
@@ -93,6 +107,8 @@ func (c *LRU) Remove(key interface{}) (present bool) {
 }
 
 func (c *LRU) RemoveOldest() (key, value interface{}, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	ent := c.evictList.Back()
 	if ent != nil {
 		c.removeElement(ent)
@@ -103,6 +119,8 @@ func (c *LRU) RemoveOldest() (key, value interface{}, ok bool) {
 }
 
 func (c *LRU) GetOldest() (key, value interface{}, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	ent := c.evictList.Back()
 	if ent != nil {
 		kv := ent.Value.(*entry)
@@ -112,6 +130,8 @@ func (c *LRU) GetOldest() (key, value interface{}, ok bool) {
 }
 
 func (c *LRU) Keys() []interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	keys := make([]interface{}, len(c.items))
 	i := 0
 	for ent := c.evictList.Back(); ent != nil; ent = ent.Prev() {
@@ -122,11 +142,15 @@ func (c *LRU) Keys() []interface{} {
 }
 
 func (c *LRU) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	return c.evictList.Len()
 }
 
 func (c *LRU) Resize(size int64) (evicted int64) {
-	diff := int64(c.Len()) - size
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	diff := int64(c.evictList.Len()) - size
 	if diff < 0 {
 		diff = 0
 	}
@@ -0,0 +1,485 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentVersion     = 1
+	segmentHeadSize    = 8
+	segmentExt         = ".wal"
+	frameHeadSize      = 8
+	defaultSegmentSize = 64 * ioutils.MEGABYTE
+)
+
+var (
+	ClosedErr = fmt.Errorf("write-ahead log was closed")
+)
+
+// Checkpointer makes frames durable in the files which they were applied to.
+type Checkpointer interface {
+	// Snapshot returns a frame which is logged before Flush, such as pages which Flush writes, nil means none.
+	Snapshot() (p []byte, err error)
+	// Flush writes and syncs files which frames were applied to.
+	Flush() (err error)
+}
+
+type Options struct {
+	Dir string
+	// SegmentSize is the size of a segment which triggers a checkpoint, default is 64M.
+	SegmentSize int64
+	// SyncInterval is the interval of background fsync, default is 1s, and negative means no background fsync.
+	SyncInterval time.Duration
+	Checkpointer Checkpointer
+}
+
+// Recovery is what was found in the log when it was opened.
+type Recovery struct {
+	Path string
+	// Frames is the number of complete frames which can be replayed.
+	Frames int64
+	// Discarded is the size of frames which were not written completely, they were dropped.
+	Discarded int64
+}
+
+// Open opens the log in dir, frames after the first broken one are dropped, so they are not replayed.
+func Open(opts Options) (l *Log, err error) {
+	if opts.Dir == "" {
+		err = fmt.Errorf("open write-ahead log failed, dir is required")
+		return
+	}
+	if mkdirErr := os.MkdirAll(opts.Dir, 0700); mkdirErr != nil {
+		err = fmt.Errorf("open write-ahead log failed, %v", mkdirErr)
+		return
+	}
+	segmentSize := opts.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+	syncInterval := opts.SyncInterval
+	if syncInterval == 0 {
+		syncInterval = 1 * time.Second
+	}
+	l = &Log{
+		mutex:        new(sync.RWMutex),
+		op:           new(sync.RWMutex),
+		dir:          opts.Dir,
+		segmentSize:  segmentSize,
+		checkpointer: opts.Checkpointer,
+		nos:          nil,
+		file:         nil,
+		size:         0,
+		frames:       0,
+		err:          nil,
+		closed:       false,
+		recovery:     Recovery{Path: opts.Dir},
+		counter:      new(sync.WaitGroup),
+		syncInterval: syncInterval,
+		closeCh:      make(chan struct{}, 1),
+		checkpointCh: make(chan struct{}, 1),
+	}
+	if err = l.load(); err != nil {
+		if l.file != nil {
+			_ = l.file.Close()
+		}
+		l = nil
+		err = fmt.Errorf("open write-ahead log failed, %v", err)
+		return
+	}
+	l.counter.Add(1)
+	l.run()
+	return
+}
+
+// Log is a write-ahead log of segment files, a frame is [body_len][crc32][body], and a segment is [version][...frames].
+// Operations log their frames between Begin and End, and a checkpoint waits for them,
+// so frames which were logged before the checkpoint were applied when it flushes, then segments before it are removed.
+type Log struct {
+	mutex        *sync.RWMutex
+	op           *sync.RWMutex
+	dir          string
+	segmentSize  int64
+	checkpointer Checkpointer
+	nos          []int64
+	file         *os.File
+	size         int64
+	frames       int64
+	err          error
+	closed       bool
+	recovery     Recovery
+	counter      *sync.WaitGroup
+	syncInterval time.Duration
+	closeCh      chan struct{}
+	checkpointCh chan struct{}
+}
+
+// Recovery returns what was found in the log when it was opened.
+func (l *Log) Recovery() (r Recovery) {
+	r = l.recovery
+	return
+}
+
+// Replay calls fn with each frame in order, it is called before frames are appended, and p must not be used after fn returns.
+func (l *Log) Replay(fn func(p []byte) (err error)) (err error) {
+	for _, no := range l.nos {
+		p, readErr := os.ReadFile(l.segmentPath(no))
+		if readErr != nil {
+			err = fmt.Errorf("replay write-ahead log failed, %v", readErr)
+			return
+		}
+		if len(p) < segmentHeadSize {
+			continue
+		}
+		for off := segmentHeadSize; ; {
+			body, n, ok := decodeFrame(p[off:])
+			if !ok {
+				break
+			}
+			if err = fn(body); err != nil {
+				return
+			}
+			off = off + n
+		}
+	}
+	return
+}
+
+// Begin starts an operation, frames which are appended until End are not removed by checkpoints before they were applied.
+func (l *Log) Begin() {
+	l.op.RLock()
+}
+
+func (l *Log) End() {
+	l.op.RUnlock()
+}
+
+// Append appends p as a frame, it must be called between Begin and End, and a checkpoint is notified when the segment is full.
+func (l *Log) Append(p []byte) (err error) {
+	frame := make([]byte, frameHeadSize, frameHeadSize+len(p))
+	frame = append(frame, p...)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(p)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(p))
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		err = ClosedErr
+		return
+	}
+	if l.err != nil {
+		err = l.err
+		l.mutex.Unlock()
+		return
+	}
+	if writeErr := ioutils.WriteRegion(l.file, l.size, frame); writeErr != nil {
+		// frames after a partly written one can not be replayed, so the log refuses appends
+		l.err = fmt.Errorf("write-ahead log is broken, %v", writeErr)
+		err = l.err
+		l.mutex.Unlock()
+		return
+	}
+	l.size = l.size + int64(len(frame))
+	l.frames++
+	full := l.size >= l.segmentSize
+	l.mutex.Unlock()
+	if full {
+		l.Notify()
+	}
+	return
+}
+
+// Notify requests a checkpoint in background, it does not block.
+func (l *Log) Notify() {
+	select {
+	case l.checkpointCh <- struct{}{}:
+		break
+	default:
+		break
+	}
+}
+
+// Sync makes appended frames durable.
+func (l *Log) Sync() (err error) {
+	l.mutex.RLock()
+	file := l.file
+	l.mutex.RUnlock()
+	err = file.Sync()
+	if err != nil && errors.Is(err, os.ErrClosed) {
+		// the segment was synced before it was replaced by a checkpoint
+		err = nil
+	}
+	return
+}
+
+// Checkpoint waits for operations, logs the snapshot of the checkpointer, and flushes it,
+// then starts a new segment and removes the others.
+func (l *Log) Checkpoint() (err error) {
+	l.op.Lock()
+	defer l.op.Unlock()
+	if l.closed {
+		err = ClosedErr
+		return
+	}
+	if l.err != nil {
+		err = l.err
+		return
+	}
+	if l.checkpointer == nil {
+		return
+	}
+	p, snapshotErr := l.checkpointer.Snapshot()
+	if snapshotErr != nil {
+		err = fmt.Errorf("checkpoint write-ahead log failed, %v", snapshotErr)
+		return
+	}
+	if p == nil && l.frames == 0 {
+		return
+	}
+	if p != nil {
+		if err = l.Append(p); err != nil {
+			err = fmt.Errorf("checkpoint write-ahead log failed, %v", err)
+			return
+		}
+	}
+	if err = l.file.Sync(); err != nil {
+		err = fmt.Errorf("checkpoint write-ahead log failed, %v", err)
+		return
+	}
+	if err = l.checkpointer.Flush(); err != nil {
+		err = fmt.Errorf("checkpoint write-ahead log failed, %v", err)
+		return
+	}
+	if err = l.roll(); err != nil {
+		err = fmt.Errorf("checkpoint write-ahead log failed, %v", err)
+		return
+	}
+	return
+}
+
+// Close stops background fsync and checkpoints the log, so it has no frames to replay when it is opened again.
+func (l *Log) Close() (err error) {
+	close(l.closeCh)
+	l.counter.Wait()
+	err = l.Checkpoint()
+	closeErr := l.close()
+	if err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// Abandon stops background fsync and closes the log without a checkpoint, so frames are replayed when it is opened again.
+func (l *Log) Abandon() (err error) {
+	close(l.closeCh)
+	l.counter.Wait()
+	err = l.close()
+	return
+}
+
+func (l *Log) close() (err error) {
+	l.op.Lock()
+	defer l.op.Unlock()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	err = l.file.Close()
+	return
+}
+
+func (l *Log) run() {
+	go func(l *Log) {
+		for {
+			stop := false
+			var tick <-chan time.Time
+			if l.syncInterval > 0 {
+				tick = time.After(l.syncInterval)
+			}
+			select {
+			case <-l.closeCh:
+				stop = true
+				break
+			case <-tick:
+				_ = l.Sync()
+			case <-l.checkpointCh:
+				_ = l.Checkpoint()
+			}
+			if stop {
+				break
+			}
+		}
+		l.counter.Done()
+	}(l)
+}
+
+// load scans segments, frames after the first broken one are truncated, and the last segment is opened for appending.
+func (l *Log) load() (err error) {
+	entries, readErr := os.ReadDir(l.dir)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	nos := make([]int64, 0, 1)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		no, parseErr := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if parseErr != nil || no <= 0 {
+			continue
+		}
+		nos = append(nos, no)
+	}
+	sort.Slice(nos, func(i, j int) bool {
+		return nos[i] < nos[j]
+	})
+	for i, no := range nos {
+		path := l.segmentPath(no)
+		p, segmentErr := os.ReadFile(path)
+		if segmentErr != nil {
+			err = segmentErr
+			return
+		}
+		if len(p) < segmentHeadSize || binary.BigEndian.Uint64(p[0:segmentHeadSize]) != segmentVersion {
+			// the segment was created but its head was not written
+			if err = l.drop(nos[i:]); err != nil {
+				return
+			}
+			break
+		}
+		off := segmentHeadSize
+		for {
+			_, n, ok := decodeFrame(p[off:])
+			if !ok {
+				break
+			}
+			off = off + n
+			l.recovery.Frames++
+		}
+		l.nos = append(l.nos, no)
+		if off < len(p) {
+			l.recovery.Discarded = l.recovery.Discarded + int64(len(p)-off)
+			if err = os.Truncate(path, int64(off)); err != nil {
+				return
+			}
+			if err = l.drop(nos[i+1:]); err != nil {
+				return
+			}
+			break
+		}
+	}
+	if len(l.nos) == 0 {
+		err = l.create(1)
+		return
+	}
+	no := l.nos[len(l.nos)-1]
+	l.file, err = os.OpenFile(l.segmentPath(no), os.O_RDWR, 0600)
+	if err != nil {
+		return
+	}
+	stat, statErr := l.file.Stat()
+	if statErr != nil {
+		err = statErr
+		return
+	}
+	l.size = stat.Size()
+	l.frames = l.recovery.Frames
+	return
+}
+
+// drop removes segments after a broken frame, their sizes are discarded.
+func (l *Log) drop(nos []int64) (err error) {
+	for _, no := range nos {
+		path := l.segmentPath(no)
+		if stat, statErr := os.Stat(path); statErr == nil {
+			l.recovery.Discarded = l.recovery.Discarded + stat.Size()
+		}
+		if err = os.Remove(path); err != nil {
+			return
+		}
+	}
+	if len(nos) > 0 {
+		err = ioutils.SyncDir(l.dir)
+	}
+	return
+}
+
+// create creates the segment no and opens it for appending.
+func (l *Log) create(no int64) (err error) {
+	file, openErr := os.OpenFile(l.segmentPath(no), os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if openErr != nil {
+		err = openErr
+		return
+	}
+	head := make([]byte, segmentHeadSize)
+	binary.BigEndian.PutUint64(head, segmentVersion)
+	err = ioutils.WriteRegion(file, 0, head)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = ioutils.SyncDir(l.dir)
+	}
+	if err != nil {
+		_ = file.Close()
+		return
+	}
+	l.nos = append(l.nos, no)
+	l.file = file
+	l.size = segmentHeadSize
+	l.frames = 0
+	return
+}
+
+// roll creates the next segment, and removes the others which frames were checkpointed, l.op must be held.
+func (l *Log) roll() (err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	nos := l.nos
+	old := l.file
+	if err = l.create(nos[len(nos)-1] + 1); err != nil {
+		return
+	}
+	_ = old.Close()
+	for _, no := range nos {
+		if err = os.Remove(l.segmentPath(no)); err != nil {
+			return
+		}
+	}
+	l.nos = l.nos[len(nos):]
+	err = ioutils.SyncDir(l.dir)
+	return
+}
+
+func (l *Log) segmentPath(no int64) (path string) {
+	path = filepath.Join(l.dir, fmt.Sprintf("%08d%s", no, segmentExt))
+	return
+}
+
+func decodeFrame(p []byte) (body []byte, n int, ok bool) {
+	if len(p) < frameHeadSize {
+		return
+	}
+	bodyLen := int(binary.BigEndian.Uint32(p[0:4]))
+	if bodyLen == 0 || len(p) < frameHeadSize+bodyLen {
+		return
+	}
+	body = p[frameHeadSize : frameHeadSize+bodyLen]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(p[4:8]) {
+		body = nil
+		return
+	}
+	n = frameHeadSize + bodyLen
+	ok = true
+	return
+}
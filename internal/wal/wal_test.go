@@ -0,0 +1,104 @@
+package wal_test
+
+import (
+	"github.com/aacfactory/tapedb/internal/wal"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type checkpointer struct {
+	flushed int
+}
+
+func (c *checkpointer) Snapshot() (p []byte, err error) {
+	p = []byte("snapshot")
+	return
+}
+
+func (c *checkpointer) Flush() (err error) {
+	c.flushed++
+	return
+}
+
+func replay(t *testing.T, l *wal.Log) (frames []string) {
+	if err := l.Replay(func(p []byte) (err error) {
+		frames = append(frames, string(p))
+		return
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestLog_Replay(t *testing.T) {
+	dir := t.TempDir()
+	c := &checkpointer{}
+	l, err := wal.Open(wal.Options{Dir: dir, SyncInterval: -1, Checkpointer: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checkpointed frames are removed
+	l.Begin()
+	if err = l.Append([]byte("checkpointed")); err != nil {
+		t.Fatal(err)
+	}
+	l.End()
+	if err = l.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if c.flushed != 1 {
+		t.Fatal("expected flushed by checkpoint")
+	}
+	for _, frame := range []string{"a", "b", "torn"} {
+		l.Begin()
+		if err = l.Append([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		l.End()
+	}
+	if err = l.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// crash without checkpoint, and the last frame was not written completely
+	if err = l.Abandon(); err != nil {
+		t.Fatal(err)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	if len(segments) != 1 {
+		t.Fatal("expected one segment after checkpoint", segments)
+	}
+	stat, _ := os.Stat(segments[0])
+	if err = os.Truncate(segments[0], stat.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = wal.Open(wal.Options{Dir: dir, SyncInterval: -1, Checkpointer: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovery := l.Recovery()
+	if recovery.Frames != 2 || recovery.Discarded != 8+4-2 {
+		t.Fatal("unexpected recovery", recovery)
+	}
+	if frames := replay(t, l); len(frames) != 2 || frames[0] != "a" || frames[1] != "b" {
+		t.Fatal("unexpected frames", frames)
+	}
+	l.Begin()
+	if err = l.Append([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	l.End()
+	if err = l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = wal.Open(wal.Options{Dir: dir, SyncInterval: -1, Checkpointer: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if frames := replay(t, l); len(frames) != 0 {
+		t.Fatal("expected no frames after closing", frames)
+	}
+}
@@ -0,0 +1,191 @@
+package tapedb
+
+import (
+	"context"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/blocks"
+	"github.com/aacfactory/tapedb/internal/index/blist"
+)
+
+// Iterator streams values of a key, only the current value is held in memory.
+//
+//	it, _ := player.Iterator(ctx, 0)
+//	defer it.Close()
+//	for it.Next() {
+//		value := it.Value()
+//	}
+//	err := it.Err()
+type Iterator interface {
+	Next() (ok bool)
+	Value() (value []byte)
+	// Headers returns headers of the current value, they are read when it is called.
+	Headers() (headers map[string][]byte, err error)
+	Position() (pos Position)
+	Err() (err error)
+	Close() (err error)
+}
+
+func newIterator(ctx context.Context, t *tape, key []byte, from int64) (it *iterator) {
+	it = &iterator{
+		ctx:    ctx,
+		tape:   t,
+		key:    key,
+		seq:    from,
+		end:    from,
+		items:  nil,
+		item:   nil,
+		value:  nil,
+		pos:    Position{},
+		err:    nil,
+		closed: false,
+	}
+	return
+}
+
+type iterator struct {
+	ctx  context.Context
+	tape *tape
+	key  []byte
+	seq  int64
+	// end is the committed length of key when it was checked, values from it are not read until it is checked again.
+	end    int64
+	items  *blist.Iterator
+	item   []byte
+	value  []byte
+	pos    Position
+	err    error
+	closed bool
+}
+
+func (it *iterator) Next() (ok bool) {
+	if it.closed || it.err != nil {
+		return
+	}
+	if ctxErr := it.ctx.Err(); ctxErr != nil {
+		it.err = ctxErr
+		return
+	}
+	if it.err = it.tape.acquire(); it.err != nil {
+		return
+	}
+	defer it.tape.release()
+	if it.items == nil {
+		items, has, getErr := it.tape.records.Iterator(it.key, it.seq)
+		if getErr != nil {
+			it.err = fmt.Errorf("iterate %s failed, %w", it.key, getErr)
+			return
+		}
+		if !has {
+			return
+		}
+		it.items = items
+	}
+	for {
+		if it.seq >= it.end {
+			committed, committedErr := it.tape.committed(it.key)
+			if committedErr != nil {
+				it.err = fmt.Errorf("iterate %s failed, %w", it.key, committedErr)
+				return
+			}
+			it.end = committed
+			if it.seq >= it.end {
+				return
+			}
+		}
+		item, has, nextErr := it.items.Next()
+		if nextErr != nil {
+			it.err = fmt.Errorf("iterate %s failed, %w", it.key, nextErr)
+			return
+		}
+		if !has {
+			return
+		}
+		value, readErr := it.tape.read(item)
+		if readErr != nil {
+			skip, quarantineErr := it.tape.skipCorrupted(item, readErr)
+			if quarantineErr != nil {
+				it.err = fmt.Errorf("iterate %s failed, %v", it.key, quarantineErr)
+				return
+			}
+			if !skip {
+				it.err = fmt.Errorf("iterate %s failed, %w", it.key, readErr)
+				return
+			}
+			it.seq++
+			continue
+		}
+		it.item = item
+		it.value = value
+		it.pos = newPosition(it.seq, blocks.Position(item))
+		it.seq++
+		ok = true
+		return
+	}
+}
+
+func (it *iterator) Value() (value []byte) {
+	value = it.value
+	return
+}
+
+func (it *iterator) Headers() (headers map[string][]byte, err error) {
+	if it.item == nil {
+		return
+	}
+	if err = it.tape.acquire(); err != nil {
+		return
+	}
+	defer it.tape.release()
+	headers, err = it.tape.readHeaders(it.item)
+	if err != nil {
+		err = fmt.Errorf("get headers of %s failed, %w", it.key, err)
+		return
+	}
+	return
+}
+
+func (it *iterator) Position() (pos Position) {
+	pos = it.pos
+	return
+}
+
+func (it *iterator) Err() (err error) {
+	err = it.err
+	return
+}
+
+func (it *iterator) Close() (err error) {
+	it.closed = true
+	it.items = nil
+	it.item = nil
+	it.value = nil
+	return
+}
+
+// follower is an iterator which waits for new values at the end.
+type follower struct {
+	*iterator
+}
+
+func (f *follower) Next() (ok bool) {
+	for {
+		if f.closed || f.err != nil {
+			return
+		}
+		committed := f.tape.watermark.wait(f.key)
+		if f.iterator.Next() {
+			ok = true
+			return
+		}
+		if f.err != nil {
+			return
+		}
+		select {
+		case <-committed:
+			break
+		case <-f.ctx.Done():
+			f.err = f.ctx.Err()
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package tapedb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/index/btree"
+)
+
+// KeyIterator streams keys of a tape in order.
+//
+//	it, _ := tape.ScanKeys(ctx, []byte("order:"), nil)
+//	defer it.Close()
+//	for it.Next() {
+//		key := it.Key()
+//	}
+//	err := it.Err()
+type KeyIterator interface {
+	Next() (ok bool)
+	Key() (key []byte)
+	Err() (err error)
+	Close() (err error)
+}
+
+type keyIterator struct {
+	ctx        context.Context
+	tape       *tape
+	prefix     []byte
+	startAfter []byte
+	cursor     *btree.Cursor
+	err        error
+	closed     bool
+}
+
+func (it *keyIterator) Next() (ok bool) {
+	if it.closed || it.err != nil {
+		return
+	}
+	if ctxErr := it.ctx.Err(); ctxErr != nil {
+		it.err = ctxErr
+		return
+	}
+	if it.err = it.tape.acquire(); it.err != nil {
+		return
+	}
+	defer it.tape.release()
+	var moveErr error
+	if it.cursor == nil {
+		it.cursor = it.tape.records.Keys()
+		if bytes.Compare(it.startAfter, it.prefix) >= 0 && len(it.startAfter) > 0 {
+			ok, moveErr = it.cursor.Seek(it.startAfter)
+			if ok && bytes.Equal(it.cursor.Key(), it.startAfter) {
+				ok, moveErr = it.cursor.Next()
+			}
+		} else if len(it.prefix) > 0 {
+			ok, moveErr = it.cursor.Seek(it.prefix)
+		} else {
+			ok, moveErr = it.cursor.First()
+		}
+	} else {
+		ok, moveErr = it.cursor.Next()
+	}
+	if moveErr != nil {
+		ok = false
+		it.err = fmt.Errorf("scan keys failed, %v", moveErr)
+		return
+	}
+	if ok && !bytes.HasPrefix(it.cursor.Key(), it.prefix) {
+		ok = false
+		it.closed = true
+	}
+	return
+}
+
+func (it *keyIterator) Key() (key []byte) {
+	if it.cursor == nil || !it.cursor.Valid() {
+		return
+	}
+	key = it.cursor.Key()
+	return
+}
+
+func (it *keyIterator) Err() (err error) {
+	err = it.err
+	return
+}
+
+func (it *keyIterator) Close() (err error) {
+	it.closed = true
+	return
+}
@@ -0,0 +1,64 @@
+package tapedb_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/aacfactory/tapedb"
+	"testing"
+)
+
+func TestTape_Keys(t *testing.T) {
+	db, openErr := tapedb.Open(t.TempDir(), tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	tape := defaultTape(t, db)
+	for i := 0; i < 300; i++ {
+		for _, kind := range []string{"order", "user"} {
+			if _, err := tape.Recorder([]byte(fmt.Sprintf("%s:%03d", kind, i))).Record([]byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	ctx := context.Background()
+	keys, keysErr := tape.Keys(ctx, []byte("order:"), nil, 1000)
+	if keysErr != nil {
+		t.Fatal(keysErr)
+	}
+	if len(keys) != 300 || string(keys[0]) != "order:000" || string(keys[299]) != "order:299" {
+		t.Fatal("unexpected keys", len(keys))
+	}
+	keys, _ = tape.Keys(ctx, []byte("order:"), []byte("order:100"), 2)
+	if len(keys) != 2 || string(keys[0]) != "order:101" || string(keys[1]) != "order:102" {
+		t.Fatal("unexpected page of keys", keys)
+	}
+	keys, _ = tape.Keys(ctx, []byte("user:"), []byte("order:999"), 1)
+	if len(keys) != 1 || string(keys[0]) != "user:000" {
+		t.Fatal("unexpected keys when start after is before prefix", keys)
+	}
+	keys, _ = tape.Keys(ctx, nil, []byte("order:299"), 1)
+	if len(keys) != 1 || string(keys[0]) != "user:000" {
+		t.Fatal("unexpected keys without prefix", keys)
+	}
+	if keys, _ = tape.Keys(ctx, []byte("none"), nil, 10); len(keys) != 0 {
+		t.Fatal("expected no keys", keys)
+	}
+	it, itErr := tape.ScanKeys(ctx, nil, nil)
+	if itErr != nil {
+		t.Fatal(itErr)
+	}
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if it.Err() != nil || n != 600 {
+		t.Fatal("unexpected scanned keys", n, it.Err())
+	}
+	_ = it.Close()
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := tape.Keys(canceled, nil, nil, 10); err == nil {
+		t.Fatal("expected canceled error")
+	}
+}
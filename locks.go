@@ -0,0 +1,38 @@
+package tapedb
+
+import (
+	"github.com/aacfactory/tapedb/internal/hash"
+	"sort"
+	"sync"
+)
+
+const keyLockSlots = 256
+
+// keyLocks serializes writes of a key, keys are hashed into a fixed number of mutexes,
+// so writes of different keys mostly do not wait for each other.
+type keyLocks struct {
+	mutexes [keyLockSlots]sync.Mutex
+}
+
+// lock locks slots of keys in order, so locking keys of batches can not deadlock, unlock must be called after writing.
+func (l *keyLocks) lock(keys ...[]byte) (unlock func()) {
+	slots := make([]int, 0, len(keys))
+	for _, key := range keys {
+		slots = append(slots, int(hash.Hash(key)%keyLockSlots))
+	}
+	sort.Ints(slots)
+	locked := make([]int, 0, len(slots))
+	for i, slot := range slots {
+		if i > 0 && slot == slots[i-1] {
+			continue
+		}
+		l.mutexes[slot].Lock()
+		locked = append(locked, slot)
+	}
+	unlock = func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			l.mutexes[locked[i]].Unlock()
+		}
+	}
+	return
+}
@@ -0,0 +1,155 @@
+package tapedb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"os"
+	"sync"
+)
+
+const (
+	manifestVersion = 1
+	manifestSize    = 64
+)
+
+// [closed][version][block_capacity][volume_max_blocks][volumes]
+type manifest struct {
+	mutex           *sync.Mutex
+	file            *ioutils.File
+	version         int64
+	blockCapacity   int64
+	volumeMaxBlocks int64
+	volumes         int64
+	// unclean is true when the manifest was not closed before it was opened.
+	unclean bool
+}
+
+func openManifest(path string, blockCapacity int64, volumeMaxBlocks int64) (m *manifest, err error) {
+	file, openErr := ioutils.OpenFile(path)
+	if openErr != nil {
+		err = fmt.Errorf("open manifest failed, %v", openErr)
+		return
+	}
+	m = &manifest{
+		mutex:           new(sync.Mutex),
+		file:            file,
+		version:         manifestVersion,
+		blockCapacity:   blockCapacity,
+		volumeMaxBlocks: volumeMaxBlocks,
+		volumes:         0,
+	}
+	err = m.load()
+	if err != nil {
+		_ = file.Close()
+		err = fmt.Errorf("open manifest failed, %v", err)
+		return
+	}
+	return
+}
+
+func (m *manifest) load() (err error) {
+	size, sizeErr := m.file.Size()
+	if sizeErr != nil {
+		err = sizeErr
+		return
+	}
+	if size > 0 {
+		p, readErr := m.file.ReadAt(0, manifestSize)
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		err = m.decode(p)
+		if err != nil {
+			return
+		}
+	}
+	// mark open
+	err = m.write(false)
+	return
+}
+
+// readManifest reads the manifest at path without marking it open, the file is not changed.
+func readManifest(path string) (m *manifest, err error) {
+	p, readErr := os.ReadFile(path)
+	if readErr != nil {
+		err = fmt.Errorf("read manifest failed, %v", readErr)
+		return
+	}
+	m = &manifest{
+		mutex: new(sync.Mutex),
+	}
+	err = m.decode(p)
+	if err != nil {
+		m = nil
+		err = fmt.Errorf("read manifest failed, %v", err)
+		return
+	}
+	return
+}
+
+func (m *manifest) decode(p []byte) (err error) {
+	if len(p) < manifestSize {
+		err = fmt.Errorf("manifest is broken")
+		return
+	}
+	m.unclean = binary.BigEndian.Uint64(p[0:8]) != 1
+	m.version = int64(binary.BigEndian.Uint64(p[8:16]))
+	if m.version != manifestVersion {
+		err = fmt.Errorf("version %d of manifest is not supported", m.version)
+		return
+	}
+	m.blockCapacity = int64(binary.BigEndian.Uint64(p[16:24]))
+	m.volumeMaxBlocks = int64(binary.BigEndian.Uint64(p[24:32]))
+	m.volumes = int64(binary.BigEndian.Uint64(p[32:40]))
+	return
+}
+
+func (m *manifest) write(closed bool) (err error) {
+	p := make([]byte, manifestSize)
+	if closed {
+		binary.BigEndian.PutUint64(p[0:8], 1)
+	}
+	binary.BigEndian.PutUint64(p[8:16], uint64(m.version))
+	binary.BigEndian.PutUint64(p[16:24], uint64(m.blockCapacity))
+	binary.BigEndian.PutUint64(p[24:32], uint64(m.volumeMaxBlocks))
+	binary.BigEndian.PutUint64(p[32:40], uint64(m.volumes))
+	err = m.file.WriteAt(0, p)
+	if err != nil {
+		return
+	}
+	err = m.file.Sync()
+	return
+}
+
+func (m *manifest) setVolumeMaxBlocks(n int64) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.volumeMaxBlocks == n {
+		return
+	}
+	m.volumeMaxBlocks = n
+	err = m.write(false)
+	return
+}
+
+func (m *manifest) setVolumes(n int64) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.volumes = n
+	err = m.write(false)
+	return
+}
+
+func (m *manifest) Close() (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err = m.write(true)
+	if err != nil {
+		_ = m.file.Close()
+		return
+	}
+	err = m.file.Close()
+	return
+}
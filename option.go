@@ -0,0 +1,233 @@
+package tapedb
+
+import (
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBlockCapacity = 512
+	minBlockCapacity     = 64
+	maxBlockCapacity     = 1 * ioutils.MEGABYTE
+	defaultPageBlocks    = 64
+	maxPageBlocks        = 64 * 1024
+	defaultVolumeMaxSize = 1 * ioutils.GIGABYTE
+	minVolumeMaxSize     = 1 * ioutils.MEGABYTE
+	defaultPageCacheSize = 64 * ioutils.MEGABYTE
+	defaultSyncInterval  = 1 * time.Second
+	defaultCommitWindow  = 2 * time.Millisecond
+	maxCommitWindow      = 1 * time.Second
+	defaultWriteTimeout  = 10 * time.Second
+	defaultTimeInterval  = 1 * time.Second
+)
+
+type SyncMode int
+
+const (
+	// SyncInterval fsyncs files in background every Option.SyncInterval,
+	// so a crash can lose values which were recorded in the latest interval.
+	SyncInterval SyncMode = iota
+	// SyncNone never fsyncs files until closing, it leaves durability to the os.
+	SyncNone
+	// SyncAlways fsyncs written files before Record and Save return,
+	// so acknowledged values are never lost, but each write pays for its own fsync.
+	SyncAlways
+	// SyncGroupCommit collects concurrent writes in Option.GroupCommitWindow and fsyncs their files once,
+	// writes return after the fsync, so acknowledged values are never lost.
+	SyncGroupCommit
+)
+
+type CorruptionPolicy int
+
+const (
+	// CorruptionFail returns an ErrCorrupted from Play and iterators when a value is corrupted.
+	CorruptionFail CorruptionPolicy = iota
+	// CorruptionSkip skips corrupted values, so Play and iterators return the values after them.
+	CorruptionSkip
+	// CorruptionQuarantine skips corrupted values like CorruptionSkip,
+	// and copies their blocks into the quarantine directory of volumes, so they can be inspected later.
+	CorruptionQuarantine
+)
+
+type Option struct {
+	// BlockCapacity is the size of a block, such as 512B or 4K, default is 512B.
+	// It can not be changed after the db was created.
+	BlockCapacity string
+	// PageBlocks is the number of blocks in a read page, default is 64.
+	PageBlocks int64
+	// VolumeMaxSize is the max size of a volume file, such as 1G, default is 1G.
+	VolumeMaxSize string
+	// PageCacheSize is the memory budget of cached pages, such as 64M, default is 64M.
+	PageCacheSize string
+	// MaxCacheNodes is the number of cached btree nodes per index, default is 2048.
+	MaxCacheNodes int64
+	// MaxCacheLists is the number of cached blist lists per index, default is 262144.
+	MaxCacheLists int64
+	// SyncMode is the fsync policy, default is SyncInterval.
+	SyncMode SyncMode
+	// SyncInterval is the interval of background fsync when SyncMode is not SyncNone, default is 1s.
+	SyncInterval time.Duration
+	// GroupCommitWindow is the time to collect writes when SyncMode is SyncGroupCommit, default is 2ms.
+	GroupCommitWindow time.Duration
+	// WriteTimeout bounds the time of waiting for concurrent writes before the written blocks, default is 10s.
+	WriteTimeout time.Duration
+	// SavedHistoryRetention is the number of saved entries of a key which can be listed and restored, default is 0 which means all.
+	SavedHistoryRetention int64
+	// TimeIndexInterval is the granularity of the time index, default is 1s.
+	// A key gets an entry of the time index when it was not indexed in the interval or in the last 4096 values,
+	// so Player.SeekTime may return a pos of a value which was recorded up to the interval before the time.
+	TimeIndexInterval time.Duration
+	// CorruptionPolicy is what to do when blocks of a value are corrupted during playing, default is CorruptionFail.
+	// Corrupted index files always fail.
+	CorruptionPolicy CorruptionPolicy
+}
+
+type options struct {
+	blockCapacity      int64
+	blockCapacityFixed bool
+	pageBlocks         int64
+	volumeMaxSize      int64
+	pageCacheSize      int64
+	maxCacheNodes      int64
+	maxCacheLists      int64
+	syncMode           SyncMode
+	syncInterval       time.Duration
+	commitWindow       time.Duration
+	writeTimeout       time.Duration
+	savedRetention     int64
+	timeIndexInterval  time.Duration
+	corruption         CorruptionPolicy
+}
+
+func newOptions(opt Option) (opts *options, err error) {
+	blockCapacity, blockCapacityErr := parseSize(opt.BlockCapacity, defaultBlockCapacity)
+	if blockCapacityErr != nil {
+		err = fmt.Errorf("invalid block capacity, %v", blockCapacityErr)
+		return
+	}
+	if blockCapacity < minBlockCapacity || blockCapacity > maxBlockCapacity {
+		err = fmt.Errorf("invalid block capacity, it must be in [%s, %s]", ioutils.ByteSize(minBlockCapacity), ioutils.ByteSize(maxBlockCapacity))
+		return
+	}
+	pageBlocks := opt.PageBlocks
+	if pageBlocks == 0 {
+		pageBlocks = defaultPageBlocks
+	}
+	if pageBlocks < 0 || pageBlocks > maxPageBlocks {
+		err = fmt.Errorf("invalid page blocks, it must be in [1, %d]", maxPageBlocks)
+		return
+	}
+	volumeMaxSize, volumeMaxSizeErr := parseSize(opt.VolumeMaxSize, defaultVolumeMaxSize)
+	if volumeMaxSizeErr != nil {
+		err = fmt.Errorf("invalid volume max size, %v", volumeMaxSizeErr)
+		return
+	}
+	if volumeMaxSize < minVolumeMaxSize {
+		err = fmt.Errorf("invalid volume max size, it must not be less than %s", ioutils.ByteSize(minVolumeMaxSize))
+		return
+	}
+	if volumeMaxSize < blockCapacity*pageBlocks {
+		err = fmt.Errorf("invalid volume max size, it must not be less than size of a page")
+		return
+	}
+	pageCacheSize, pageCacheSizeErr := parseSize(opt.PageCacheSize, defaultPageCacheSize)
+	if pageCacheSizeErr != nil {
+		err = fmt.Errorf("invalid page cache size, %v", pageCacheSizeErr)
+		return
+	}
+	if opt.MaxCacheNodes < 0 {
+		err = fmt.Errorf("invalid max cache nodes, it must not be negative")
+		return
+	}
+	if opt.MaxCacheLists < 0 {
+		err = fmt.Errorf("invalid max cache lists, it must not be negative")
+		return
+	}
+	switch opt.SyncMode {
+	case SyncInterval, SyncNone, SyncAlways, SyncGroupCommit:
+		break
+	default:
+		err = fmt.Errorf("invalid sync mode")
+		return
+	}
+	syncInterval := opt.SyncInterval
+	if syncInterval == 0 {
+		syncInterval = defaultSyncInterval
+	}
+	if syncInterval < 0 {
+		err = fmt.Errorf("invalid sync interval, it must not be negative")
+		return
+	}
+	if opt.SyncMode == SyncNone {
+		syncInterval = -1
+	}
+	commitWindow := opt.GroupCommitWindow
+	if commitWindow == 0 {
+		commitWindow = defaultCommitWindow
+	}
+	if commitWindow < 0 || commitWindow > maxCommitWindow {
+		err = fmt.Errorf("invalid group commit window, it must be in (0, %s]", maxCommitWindow)
+		return
+	}
+	writeTimeout := opt.WriteTimeout
+	if writeTimeout == 0 {
+		writeTimeout = defaultWriteTimeout
+	}
+	if writeTimeout < 0 {
+		err = fmt.Errorf("invalid write timeout, it must not be negative")
+		return
+	}
+	if opt.SavedHistoryRetention < 0 {
+		err = fmt.Errorf("invalid saved history retention, it must not be negative")
+		return
+	}
+	timeIndexInterval := opt.TimeIndexInterval
+	if timeIndexInterval == 0 {
+		timeIndexInterval = defaultTimeInterval
+	}
+	if timeIndexInterval < 0 {
+		err = fmt.Errorf("invalid time index interval, it must not be negative")
+		return
+	}
+	switch opt.CorruptionPolicy {
+	case CorruptionFail, CorruptionSkip, CorruptionQuarantine:
+		break
+	default:
+		err = fmt.Errorf("invalid corruption policy")
+		return
+	}
+	opts = &options{
+		blockCapacity:      blockCapacity,
+		blockCapacityFixed: strings.TrimSpace(opt.BlockCapacity) != "",
+		pageBlocks:         pageBlocks,
+		volumeMaxSize:      volumeMaxSize,
+		pageCacheSize:      pageCacheSize,
+		maxCacheNodes:      opt.MaxCacheNodes,
+		maxCacheLists:      opt.MaxCacheLists,
+		syncMode:           opt.SyncMode,
+		syncInterval:       syncInterval,
+		commitWindow:       commitWindow,
+		writeTimeout:       writeTimeout,
+		savedRetention:     opt.SavedHistoryRetention,
+		timeIndexInterval:  timeIndexInterval,
+		corruption:         opt.CorruptionPolicy,
+	}
+	return
+}
+
+func parseSize(s string, defaultValue int64) (n int64, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		n = defaultValue
+		return
+	}
+	v, parseErr := ioutils.ToBytes(s)
+	if parseErr != nil {
+		err = parseErr
+		return
+	}
+	n = int64(v)
+	return
+}
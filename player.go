@@ -1,8 +1,475 @@
 package tapedb
 
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
 type Player interface {
 	Key() (key []byte)
+	// Play returns at most size values of the key from pos, pos is the offset of values of the key and starts at 0.
+	// Corrupted values fail it with an ErrCorrupted or are skipped, see Option.CorruptionPolicy.
 	Play(pos int64, size int64) (values [][]byte, err error)
+	// Headers returns headers of the value at pos, the value is not read, it is nil when the value has no headers.
+	Headers(pos int64) (headers map[string][]byte, err error)
+	// Iterator returns an iterator of values of the key from pos, values are read lazily.
+	Iterator(ctx context.Context, from int64) (it Iterator, err error)
+	// SeekTime returns the pos of the first value which was recorded at or after t,
+	// it is the number of values when all values were recorded before t.
+	// The time index is sparse, pos may be of a value which was recorded up to Option.TimeIndexInterval before t.
+	SeekTime(t time.Time) (pos int64, err error)
+	// PlayTimeRange returns at most size values from SeekTime(begin) to SeekTime(end), so the range is as approximate as SeekTime,
+	// it may have values which were recorded up to Option.TimeIndexInterval before begin, and miss those before end.
+	PlayTimeRange(begin time.Time, end time.Time, size int64) (values [][]byte, err error)
+	// Follow returns an iterator of values of the key from pos, Next of it blocks until new values are recorded or ctx is done.
+	Follow(ctx context.Context, from int64) (it Iterator, err error)
 	Save(pos int64, comment []byte) (err error)
+	// LatestSavedPos returns -1 as pos when nothing was saved.
 	LatestSavedPos() (pos int64, comment []byte, err error)
+	// SavedHistory returns at most limit saved entries from the latest, limit <= 0 means all retained entries.
+	SavedHistory(limit int64) (entries []SavedEntry, err error)
+	// RestoreSaved saves the nth entry of SavedHistory again, so it becomes the latest, 0 is the latest.
+	RestoreSaved(n int64) (err error)
+	// SaveSnapshot saves state of the aggregate of the key which covers values until pos,
+	// so it can be loaded by the snapshot and values after pos.
+	SaveSnapshot(pos int64, state []byte) (err error)
+	// LatestSnapshot returns -1 as pos when there is no snapshot.
+	LatestSnapshot() (pos int64, state []byte, err error)
+	// PruneSnapshots keeps the latest keep snapshots and drops others, states in volumes are not reclaimed.
+	PruneSnapshots(keep int64) (err error)
+	// Consumer returns the named consumer of the key, it is registered at its first Save.
+	Consumer(name string) (c Consumer, err error)
+	// Consumers returns registered consumers of the key in registration order.
+	Consumers() (infos []ConsumerInfo, err error)
+	// DeleteConsumer removes the consumer, ConsumerNotFoundErr is returned when it does not exist.
+	DeleteConsumer(name string) (err error)
+}
+
+type SavedEntry struct {
+	Pos     int64
+	Comment []byte
+	SavedAt time.Time
+}
+
+type player struct {
+	key  []byte
+	tape *tape
+}
+
+func (p *player) Key() (key []byte) {
+	key = p.key
+	return
+}
+
+func (p *player) Play(pos int64, size int64) (values [][]byte, err error) {
+	if pos < 0 || size <= 0 {
+		err = fmt.Errorf("play %s failed, pos must not be negative and size must be greater than 0", p.key)
+		return
+	}
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("play failed, %v", keyErr)
+		return
+	}
+	it := newIterator(context.Background(), p.tape, p.key, pos)
+	values = make([][]byte, 0, 1)
+	for int64(len(values)) < size && it.Next() {
+		values = append(values, it.Value())
+	}
+	if err = it.Err(); err != nil {
+		values = nil
+		err = fmt.Errorf("play failed, %w", err)
+		return
+	}
+	return
+}
+
+func (p *player) Headers(pos int64) (headers map[string][]byte, err error) {
+	if pos < 0 {
+		err = fmt.Errorf("get headers of %s failed, pos must not be negative", p.key)
+		return
+	}
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("get headers failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	n, lenErr := p.tape.committed(p.key)
+	if lenErr != nil {
+		err = fmt.Errorf("get headers of %s failed, %v", p.key, lenErr)
+		return
+	}
+	items, has, getErr := p.tape.records.Iterator(p.key, pos)
+	if getErr != nil {
+		err = fmt.Errorf("get headers of %s failed, %v", p.key, getErr)
+		return
+	}
+	if !has || pos >= n {
+		err = fmt.Errorf("get headers of %s failed, %d is out of range", p.key, pos)
+		return
+	}
+	item, ok, nextErr := items.Next()
+	if nextErr != nil {
+		err = fmt.Errorf("get headers of %s failed, %v", p.key, nextErr)
+		return
+	}
+	if !ok {
+		err = fmt.Errorf("get headers of %s failed, %d is out of range", p.key, pos)
+		return
+	}
+	headers, err = p.tape.readHeaders(item)
+	if err != nil {
+		err = fmt.Errorf("get headers of %s failed, %w", p.key, err)
+		return
+	}
+	return
+}
+
+func (p *player) SeekTime(t time.Time) (pos int64, err error) {
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("seek time failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	pos, err = p.tape.seekTime(p.key, t.UnixNano())
+	if err != nil {
+		err = fmt.Errorf("seek time of %s failed, %v", p.key, err)
+		return
+	}
+	return
+}
+
+func (p *player) PlayTimeRange(begin time.Time, end time.Time, size int64) (values [][]byte, err error) {
+	if size <= 0 {
+		err = fmt.Errorf("play %s failed, size must be greater than 0", p.key)
+		return
+	}
+	if !begin.Before(end) {
+		err = fmt.Errorf("play %s failed, begin must be before end", p.key)
+		return
+	}
+	beg, begErr := p.SeekTime(begin)
+	if begErr != nil {
+		err = begErr
+		return
+	}
+	last, lastErr := p.SeekTime(end)
+	if lastErr != nil {
+		err = lastErr
+		return
+	}
+	if last <= beg {
+		values = make([][]byte, 0, 1)
+		return
+	}
+	if last-beg < size {
+		size = last - beg
+	}
+	values, err = p.Play(beg, size)
+	return
+}
+
+func (p *player) Iterator(ctx context.Context, from int64) (it Iterator, err error) {
+	if from < 0 {
+		err = fmt.Errorf("iterate %s failed, from must not be negative", p.key)
+		return
+	}
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("iterate failed, %v", keyErr)
+		return
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	it = newIterator(ctx, p.tape, p.key, from)
+	return
+}
+
+func (p *player) Follow(ctx context.Context, from int64) (it Iterator, err error) {
+	if from < 0 {
+		err = fmt.Errorf("follow %s failed, from must not be negative", p.key)
+		return
+	}
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("follow failed, %v", keyErr)
+		return
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	it = &follower{
+		iterator: newIterator(ctx, p.tape, p.key, from),
+	}
+	return
+}
+
+func (p *player) Save(pos int64, comment []byte) (err error) {
+	if pos < 0 {
+		err = fmt.Errorf("save %s failed, pos must not be negative", p.key)
+		return
+	}
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("save failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	saveErr := p.tape.saveCheckpoint(indexSaves, p.key, pos, comment)
+	if saveErr != nil {
+		err = fmt.Errorf("save %s failed, %v", p.key, saveErr)
+		return
+	}
+	return
+}
+
+func (p *player) LatestSavedPos() (pos int64, comment []byte, err error) {
+	pos = -1
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("get latest saved pos failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	pos, comment, err = p.tape.latestCheckpoint(p.tape.saves, p.key)
+	if err != nil {
+		err = fmt.Errorf("get latest saved pos of %s failed, %v", p.key, err)
+		return
+	}
+	return
+}
+
+func (p *player) SavedHistory(limit int64) (entries []SavedEntry, err error) {
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("get saved history failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	cps, historyErr := p.tape.checkpointHistory(p.tape.saves, p.key, limit)
+	if historyErr != nil {
+		err = fmt.Errorf("get saved history of %s failed, %v", p.key, historyErr)
+		return
+	}
+	entries = make([]SavedEntry, 0, len(cps))
+	for _, cp := range cps {
+		entries = append(entries, SavedEntry{
+			Pos:     cp.pos,
+			Comment: cp.comment,
+			SavedAt: time.Unix(0, cp.savedAt),
+		})
+	}
+	return
+}
+
+func (p *player) RestoreSaved(n int64) (err error) {
+	if n < 0 {
+		err = fmt.Errorf("restore saved of %s failed, n must not be negative", p.key)
+		return
+	}
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("restore saved failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	cps, historyErr := p.tape.checkpointHistory(p.tape.saves, p.key, n+1)
+	if historyErr != nil {
+		err = fmt.Errorf("restore saved of %s failed, %v", p.key, historyErr)
+		return
+	}
+	if int64(len(cps)) <= n {
+		err = fmt.Errorf("restore saved of %s failed, there are only %d retained entries", p.key, len(cps))
+		return
+	}
+	cp := cps[n]
+	saveErr := p.tape.saveCheckpoint(indexSaves, p.key, cp.pos, cp.comment)
+	if saveErr != nil {
+		err = fmt.Errorf("restore saved of %s failed, %v", p.key, saveErr)
+		return
+	}
+	return
+}
+
+func (p *player) SaveSnapshot(pos int64, state []byte) (err error) {
+	if pos < 0 {
+		err = fmt.Errorf("save snapshot of %s failed, pos must not be negative", p.key)
+		return
+	}
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("save snapshot failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	n, lenErr := p.tape.committed(p.key)
+	if lenErr != nil {
+		err = fmt.Errorf("save snapshot of %s failed, %v", p.key, lenErr)
+		return
+	}
+	if pos >= n {
+		err = fmt.Errorf("save snapshot of %s failed, %d is out of range", p.key, pos)
+		return
+	}
+	saveErr := p.tape.saveCheckpoint(indexSnapshots, p.key, pos, state)
+	if saveErr != nil {
+		err = fmt.Errorf("save snapshot of %s failed, %v", p.key, saveErr)
+		return
+	}
+	return
+}
+
+func (p *player) LatestSnapshot() (pos int64, state []byte, err error) {
+	pos = -1
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("get latest snapshot failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	pos, state, err = p.tape.latestCheckpoint(p.tape.snapshots, p.key)
+	if err != nil {
+		err = fmt.Errorf("get latest snapshot of %s failed, %v", p.key, err)
+		return
+	}
+	return
+}
+
+func (p *player) PruneSnapshots(keep int64) (err error) {
+	if keep < 0 {
+		err = fmt.Errorf("prune snapshots of %s failed, keep must not be negative", p.key)
+		return
+	}
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("prune snapshots failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	op := p.tape.operation(nil, nil)
+	op.retain(indexSnapshots, p.key, keep)
+	unlock := p.tape.locks.lock(p.key)
+	retainErr := p.tape.apply(op)
+	unlock()
+	if retainErr != nil {
+		err = fmt.Errorf("prune snapshots of %s failed, %v", p.key, retainErr)
+		return
+	}
+	commitErr := p.tape.commit()
+	if commitErr != nil {
+		err = fmt.Errorf("prune snapshots of %s failed, %v", p.key, commitErr)
+		return
+	}
+	return
+}
+
+func (p *player) Consumer(name string) (c Consumer, err error) {
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("get consumer failed, %v", keyErr)
+		return
+	}
+	nameErr := validateConsumerName(name)
+	if nameErr != nil {
+		err = fmt.Errorf("get consumer failed, %v", nameErr)
+		return
+	}
+	c = &consumer{
+		name:   name,
+		player: p,
+	}
+	return
+}
+
+func (p *player) Consumers() (infos []ConsumerInfo, err error) {
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("list consumers failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	head, lenErr := p.tape.committed(p.key)
+	if lenErr != nil {
+		err = fmt.Errorf("list consumers of %s failed, %v", p.key, lenErr)
+		return
+	}
+	entries := p.tape.consumers.list(p.key)
+	infos = make([]ConsumerInfo, 0, len(entries))
+	for _, entry := range entries {
+		pos, comment, latestErr := p.tape.latestCheckpoint(p.tape.checkpoints, consumerIndexKey(p.key, entry.name))
+		if latestErr != nil {
+			infos = nil
+			err = fmt.Errorf("list consumers of %s failed, %v", p.key, latestErr)
+			return
+		}
+		infos = append(infos, ConsumerInfo{
+			Name:      entry.name,
+			CreatedAt: time.Unix(0, entry.createdAt),
+			Pos:       pos,
+			Comment:   comment,
+			Lag:       consumerLag(head, pos),
+		})
+	}
+	return
+}
+
+func (p *player) DeleteConsumer(name string) (err error) {
+	keyErr := validateKey(p.key)
+	if keyErr != nil {
+		err = fmt.Errorf("delete consumer failed, %v", keyErr)
+		return
+	}
+	if err = p.tape.acquire(); err != nil {
+		return
+	}
+	defer p.tape.release()
+	has, removeErr := p.tape.consumers.remove(p.key, name)
+	if removeErr != nil {
+		err = fmt.Errorf("delete consumer %s of %s failed, %v", name, p.key, removeErr)
+		return
+	}
+	if !has {
+		err = ConsumerNotFoundErr
+		return
+	}
+	dropErr := p.tape.dropCheckpoints(indexConsumers, consumerIndexKey(p.key, name))
+	if dropErr != nil {
+		err = fmt.Errorf("delete consumer %s of %s failed, %v", name, p.key, dropErr)
+		return
+	}
+	return
 }
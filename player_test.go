@@ -0,0 +1,578 @@
+package tapedb_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aacfactory/tapedb"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPlayer_Iterator(t *testing.T) {
+	db, openErr := tapedb.Open(t.TempDir(), tapedb.Option{PageBlocks: 4, PageCacheSize: "8K"})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	tape := defaultTape(t, db)
+	key := []byte("aggregate")
+	r := tape.Recorder(key)
+	for i := 0; i < 1000; i++ {
+		if _, err := r.Record([]byte(fmt.Sprintf("event:%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, from := range []int64{0, 13, 14, 28, 999, 1000, 2000} {
+		it, itErr := tape.Player(key).Iterator(context.Background(), from)
+		if itErr != nil {
+			t.Fatal(itErr)
+		}
+		n := from
+		for it.Next() {
+			if string(it.Value()) != fmt.Sprintf("event:%d", n) || it.Position().Seq != n {
+				t.Fatal("unexpected value", n, string(it.Value()), it.Position())
+			}
+			n++
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if from < 1000 && n != 1000 {
+			t.Fatal("expected iterating to 1000, got", n)
+		}
+		_ = it.Close()
+	}
+	it, _ := tape.Player(key).Iterator(context.Background(), 990)
+	for it.Next() {
+	}
+	if _, err := r.Record([]byte("event:1000")); err != nil {
+		t.Fatal(err)
+	}
+	if !it.Next() || string(it.Value()) != "event:1000" {
+		t.Fatal("expected recorded value after the end")
+	}
+	_ = it.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	it, _ = tape.Player(key).Iterator(ctx, 0)
+	cancel()
+	if it.Next() || it.Err() == nil {
+		t.Fatal("expected canceled error")
+	}
+}
+
+func TestPlayer_Follow(t *testing.T) {
+	db, openErr := tapedb.Open(t.TempDir(), tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	tape := defaultTape(t, db)
+	key := []byte("stream")
+	r := tape.Recorder(key)
+	if _, err := r.Record([]byte("event:0")); err != nil {
+		t.Fatal(err)
+	}
+	it, itErr := tape.Player(key).Follow(context.Background(), 0)
+	if itErr != nil {
+		t.Fatal(itErr)
+	}
+	go func() {
+		for i := 1; i < 10; i++ {
+			time.Sleep(time.Millisecond)
+			if _, err := r.Record([]byte(fmt.Sprintf("event:%d", i))); err != nil {
+				return
+			}
+			_, _ = tape.Recorder([]byte("other")).Record([]byte("other"))
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if !it.Next() {
+			t.Fatal("expected followed value", i, it.Err())
+		}
+		if string(it.Value()) != fmt.Sprintf("event:%d", i) || it.Position().Seq != int64(i) {
+			t.Fatal("unexpected followed value", i, string(it.Value()))
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	waiting, _ := tape.Player(key).Follow(ctx, 10)
+	if waiting.Next() || waiting.Err() != context.DeadlineExceeded {
+		t.Fatal("expected deadline exceeded error, got", waiting.Err())
+	}
+	done := make(chan bool)
+	go func() {
+		done <- it.Next()
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if <-done || it.Err() == nil {
+		t.Fatal("expected closed tape error")
+	}
+}
+
+func TestPlayer_Consumer(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	key := []byte("orders")
+	r := defaultTape(t, db).Recorder(key)
+	for i := 0; i < 10; i++ {
+		if _, err := r.Record([]byte(fmt.Sprintf("event:%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := defaultTape(t, db).Player(key)
+	billing, _ := p.Consumer("billing")
+	shipping, _ := p.Consumer("shipping")
+	if pos, _, err := billing.Latest(); err != nil || pos != -1 {
+		t.Fatal("expected nothing saved", pos, err)
+	}
+	if err := billing.Save(3, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := billing.Save(6, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := shipping.Save(9, []byte("s")); err != nil {
+		t.Fatal(err)
+	}
+	if lag, err := billing.Lag(); err != nil || lag != 3 {
+		t.Fatal("unexpected lag of billing", lag, err)
+	}
+	if pos, _, _ := p.LatestSavedPos(); pos != -1 {
+		t.Fatal("consumers must not change saved pos of player", pos)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, openErr = tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	p = defaultTape(t, db).Player(key)
+	infos, listErr := p.Consumers()
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+	if len(infos) != 2 || infos[0].Name != "billing" || infos[0].Pos != 6 || infos[0].Lag != 3 ||
+		infos[1].Name != "shipping" || infos[1].Pos != 9 || infos[1].Lag != 0 || string(infos[1].Comment) != "s" {
+		t.Fatal("unexpected consumers", infos)
+	}
+	if err := p.DeleteConsumer("billing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.DeleteConsumer("billing"); err != tapedb.ConsumerNotFoundErr {
+		t.Fatal("expected consumer not found error, got", err)
+	}
+	billing, _ = p.Consumer("billing")
+	if pos, _, err := billing.Latest(); err != nil || pos != -1 {
+		t.Fatal("expected deleted consumer has no checkpoint", pos, err)
+	}
+	if lag, _ := billing.Lag(); lag != 10 {
+		t.Fatal("unexpected lag of deleted consumer", lag)
+	}
+	if err := billing.Save(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if pos, _, _ := billing.Latest(); pos != 1 {
+		t.Fatal("unexpected pos of recreated consumer", pos)
+	}
+	infos, _ = p.Consumers()
+	if len(infos) != 2 || infos[0].Name != "shipping" || infos[1].Name != "billing" {
+		t.Fatal("unexpected consumers after deleting", infos)
+	}
+	if _, err := p.Consumer(""); err == nil {
+		t.Fatal("expected invalid consumer name error")
+	}
+}
+
+func TestPlayer_ConsumersLog(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	p := defaultTape(t, db).Player([]byte("order"))
+	for i := 0; i < 100; i++ {
+		c, _ := p.Consumer(fmt.Sprintf("c%d", i))
+		if err := c.Save(int64(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 95; i++ {
+		if err := p.DeleteConsumer(fmt.Sprintf("c%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	last, _ := p.Consumer("last")
+	if err := last.Save(1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "tapes", tapedb.DefaultTapeName, "consumers")
+	stat, statErr := os.Stat(path)
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	// records of deleted consumers are compacted
+	if stat.Size() > 64+152*100 {
+		t.Fatal("expected compacted consumers, size is", stat.Size())
+	}
+	// the last record is torn by a crash
+	if err := os.Truncate(path, stat.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	db, openErr = tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	p = defaultTape(t, db).Player([]byte("order"))
+	infos, listErr := p.Consumers()
+	if listErr != nil {
+		t.Fatal(listErr)
+	}
+	if len(infos) != 5 || infos[0].Name != "c95" || infos[4].Name != "c99" || infos[4].Pos != 99 {
+		t.Fatal("unexpected consumers", infos)
+	}
+	last, _ = p.Consumer("last")
+	if err := last.Save(2, nil); err != nil {
+		t.Fatal(err)
+	}
+	if infos, _ = p.Consumers(); len(infos) != 6 || infos[5].Name != "last" || infos[5].Pos != 2 {
+		t.Fatal("unexpected consumers after registering again", infos)
+	}
+}
+
+func TestPlayer_SavedHistory(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	tape, tapeErr := db.CreateTape("audit", tapedb.TapeOptions{SavedHistoryRetention: 5})
+	if tapeErr != nil {
+		t.Fatal(tapeErr)
+	}
+	key := []byte("account")
+	p := tape.Player(key)
+	if entries, err := p.SavedHistory(0); err != nil || len(entries) != 0 {
+		t.Fatal("expected empty history", len(entries), err)
+	}
+	begin := time.Now()
+	for i := 0; i < 8; i++ {
+		if err := p.Save(int64(i), []byte(fmt.Sprintf("save:%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, historyErr := p.SavedHistory(3)
+	if historyErr != nil {
+		t.Fatal(historyErr)
+	}
+	if len(entries) != 3 || entries[0].Pos != 7 || entries[2].Pos != 5 || string(entries[1].Comment) != "save:6" {
+		t.Fatal("unexpected history", entries)
+	}
+	if entries[0].SavedAt.Before(begin) || entries[0].SavedAt.Before(entries[2].SavedAt) {
+		t.Fatal("unexpected saved at", entries[0].SavedAt, entries[2].SavedAt)
+	}
+	if entries, _ = p.SavedHistory(0); len(entries) != 5 || entries[4].Pos != 3 {
+		t.Fatal("expected 5 retained entries", entries)
+	}
+	if err := p.RestoreSaved(5); err == nil {
+		t.Fatal("expected out of retained entries error")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, openErr = tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	tape, _ = db.Tape("audit")
+	p = tape.Player(key)
+	if err := p.RestoreSaved(2); err != nil {
+		t.Fatal(err)
+	}
+	pos, comment, _ := p.LatestSavedPos()
+	if pos != 5 || string(comment) != "save:5" {
+		t.Fatal("unexpected restored pos", pos, string(comment))
+	}
+	if entries, _ = p.SavedHistory(0); len(entries) != 5 || entries[0].Pos != 5 || entries[1].Pos != 7 {
+		t.Fatal("unexpected history after restoring", entries)
+	}
+}
+
+func TestPlayer_SavedHistoryRetained(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	tape, tapeErr := db.CreateTape("audit", tapedb.TapeOptions{SavedHistoryRetention: 5})
+	if tapeErr != nil {
+		t.Fatal(tapeErr)
+	}
+	p := tape.Player([]byte("account"))
+	c, _ := p.Consumer("billing")
+	for i := 0; i < 100; i++ {
+		if err := p.Save(int64(i), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Save(int64(i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _ := p.SavedHistory(0); len(entries) != 5 || entries[0].Pos != 99 || entries[4].Pos != 95 {
+		t.Fatal("unexpected retained history", entries)
+	}
+	if pos, _, err := c.Latest(); err != nil || pos != 99 {
+		t.Fatal("unexpected latest of consumer", pos, err)
+	}
+	if err := p.DeleteConsumer("billing"); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = p.Consumer("billing")
+	if pos, _, err := c.Latest(); err != nil || pos != -1 {
+		t.Fatal("expected recreated consumer has no checkpoint", pos, err)
+	}
+	if err := c.Save(3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if pos, _, err := c.Latest(); err != nil || pos != 3 {
+		t.Fatal("unexpected latest of recreated consumer", pos, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, checkErr := tapedb.Check(dir)
+	if checkErr != nil {
+		t.Fatal(checkErr)
+	}
+	// lists are cut to the retention when they have twice of it, the consumer has one checkpoint after recreating
+	if !report.OK() || report.Positions >= 2*5+1 {
+		t.Fatal("expected saved lists are capped", report.Positions, report.Issues)
+	}
+}
+
+func TestPlayer_SeekTime(t *testing.T) {
+	dir := t.TempDir()
+	// marks are more than the interval after the previous record, so seeking them is exact
+	option := tapedb.Option{TimeIndexInterval: time.Millisecond}
+	db, openErr := tapedb.Open(dir, option)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	key := []byte("incident")
+	r := defaultTape(t, db).Recorder(key)
+	marks := make([]time.Time, 0, 20)
+	for i := 0; i < 20; i++ {
+		time.Sleep(2 * time.Millisecond)
+		marks = append(marks, time.Now())
+		time.Sleep(2 * time.Millisecond)
+		if _, err := r.Record([]byte(fmt.Sprintf("event:%d:a", i)), []byte(fmt.Sprintf("event:%d:b", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(2 * time.Millisecond)
+	end := time.Now()
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, openErr = tapedb.Open(dir, option)
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	p := defaultTape(t, db).Player(key)
+	for i, mark := range marks {
+		pos, seekErr := p.SeekTime(mark)
+		if seekErr != nil {
+			t.Fatal(seekErr)
+		}
+		if pos != int64(i*2) {
+			t.Fatal("unexpected pos of mark", i, pos)
+		}
+	}
+	if pos, _ := p.SeekTime(end); pos != 40 {
+		t.Fatal("expected pos after all values, got", pos)
+	}
+	if pos, _ := p.SeekTime(marks[0].Add(-time.Hour)); pos != 0 {
+		t.Fatal("expected the first pos, got", pos)
+	}
+	values, playErr := p.PlayTimeRange(marks[3], marks[6], 100)
+	if playErr != nil {
+		t.Fatal(playErr)
+	}
+	if len(values) != 6 || string(values[0]) != "event:3:a" || string(values[5]) != "event:5:b" {
+		t.Fatal("unexpected values in time range", len(values))
+	}
+	if values, _ = p.PlayTimeRange(marks[3], marks[6], 3); len(values) != 3 {
+		t.Fatal("expected 3 values, got", len(values))
+	}
+	if pos, _ := defaultTape(t, db).Player([]byte("absent")).SeekTime(end); pos != 0 {
+		t.Fatal("unexpected pos of absent key", pos)
+	}
+}
+
+func TestPlayer_SeekTimeSparse(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{TimeIndexInterval: time.Hour})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	key := []byte("burst")
+	r := defaultTape(t, db).Recorder(key)
+	begin := time.Now()
+	for i := 0; i < 10000; i++ {
+		if _, err := r.Record([]byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := defaultTape(t, db).Player(key)
+	if pos, _ := p.SeekTime(begin.Add(-time.Second)); pos != 0 {
+		t.Fatal("expected the first pos, got", pos)
+	}
+	// values in the interval share entries which are added every 4096 values
+	if pos, _ := p.SeekTime(time.Now()); pos != 8192 {
+		t.Fatal("expected the pos of the last entry, got", pos)
+	}
+	if pos, _ := p.SeekTime(time.Now().Add(2 * time.Hour)); pos != 10000 {
+		t.Fatal("expected pos after all values, got", pos)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stat, statErr := os.Stat(filepath.Join(dir, "tapes", tapedb.DefaultTapeName, "timeline.bl"))
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	if lists := (stat.Size() - 4096) / 256; lists != 3 {
+		t.Fatal("expected 3 entries in the timeline, got", lists)
+	}
+}
+
+func TestPlayer_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	key := []byte("counter")
+	r := defaultTape(t, db).Recorder(key)
+	p := defaultTape(t, db).Player(key)
+	if err := p.SaveSnapshot(0, []byte("0")); err == nil {
+		t.Fatal("expected out of range error")
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := r.Record([]byte("+1")); err != nil {
+			t.Fatal(err)
+		}
+		if i%10 == 9 {
+			if err := p.SaveSnapshot(int64(i), []byte(fmt.Sprintf("%d", i+1))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := r.Record([]byte("+1"), []byte("+1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.PruneSnapshots(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, openErr = tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	p = defaultTape(t, db).Player(key)
+	pos, state, snapshotErr := p.LatestSnapshot()
+	if snapshotErr != nil {
+		t.Fatal(snapshotErr)
+	}
+	if pos != 49 || string(state) != "50" {
+		t.Fatal("unexpected snapshot", pos, string(state))
+	}
+	rest, _ := p.Play(pos+1, 100)
+	if len(rest) != 2 {
+		t.Fatal("expected 2 values after the snapshot, got", len(rest))
+	}
+	if err := p.SaveSnapshot(51, []byte("52")); err != nil {
+		t.Fatal(err)
+	}
+	if pos, state, _ = p.LatestSnapshot(); pos != 51 || string(state) != "52" {
+		t.Fatal("unexpected snapshot after pruning", pos, string(state))
+	}
+	if err := p.PruneSnapshots(0); err != nil {
+		t.Fatal(err)
+	}
+	if pos, _, _ = p.LatestSnapshot(); pos != -1 {
+		t.Fatal("expected no snapshot", pos)
+	}
+}
+
+func TestPlayer_Corruption(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	key := []byte("corrupted")
+	r := defaultTape(t, db).Recorder(key)
+	for i := 0; i < 3; i++ {
+		if _, err := r.Record([]byte(fmt.Sprintf("event:%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "volumes", "00000001.vol")
+	p, _ := os.ReadFile(path)
+	if err := os.WriteFile(path, bytes.ReplaceAll(p, []byte("event:1"), []byte("EVENT:1")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range []tapedb.CorruptionPolicy{tapedb.CorruptionFail, tapedb.CorruptionSkip, tapedb.CorruptionQuarantine} {
+		db, openErr = tapedb.Open(dir, tapedb.Option{CorruptionPolicy: policy})
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		values, playErr := defaultTape(t, db).Player(key).Play(0, 10)
+		_ = db.Close()
+		if policy == tapedb.CorruptionFail {
+			var corrupted *tapedb.ErrCorrupted
+			if !errors.As(playErr, &corrupted) || corrupted.File != path || corrupted.Structure != "block" {
+				t.Fatal("expected corrupted block", playErr)
+			}
+			continue
+		}
+		if playErr != nil {
+			t.Fatal(playErr)
+		}
+		if len(values) != 2 || string(values[0]) != "event:0" || string(values[1]) != "event:2" {
+			t.Fatal("expected corrupted value skipped", policy, len(values))
+		}
+	}
+	quarantined, _ := filepath.Glob(filepath.Join(dir, "volumes", "quarantine", "*.blocks"))
+	if len(quarantined) != 1 {
+		t.Fatal("expected quarantined blocks", quarantined)
+	}
+}
@@ -0,0 +1,33 @@
+package tapedb
+
+import (
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/blocks"
+)
+
+// Position is where a recorded value is.
+type Position struct {
+	// Seq is the offset of the value in its key, it is the pos of Player.Play.
+	Seq int64
+	// Volume is the no of the volume which holds the value.
+	Volume int64
+	// Block is the no of the first block of the value in the volume.
+	Block int64
+	// Blocks is the number of blocks of the value.
+	Blocks int64
+}
+
+func (pos Position) String() (v string) {
+	v = fmt.Sprintf("%d@%d:%d:%d", pos.Seq, pos.Volume, pos.Block, pos.Blocks)
+	return
+}
+
+func newPosition(seq int64, p blocks.Position) (pos Position) {
+	pos = Position{
+		Seq:    seq,
+		Volume: int64(p.Idx()),
+		Block:  p.No(),
+		Blocks: int64(p.Size()),
+	}
+	return
+}
@@ -1,7 +1,128 @@
 package tapedb
 
+import (
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/blocks"
+)
+
 type Recorder interface {
 	Key() (key []byte)
-	Record(values ...[]byte) (err error)
+	// Record appends values to the key, poss are positions of values in order.
+	// When it fails after values were logged, values can still be recorded, because they are redone when the tape is opened again.
+	Record(values ...[]byte) (poss []Position, err error)
+	// RecordExpect appends values only when the pos of the last value of the key is expectedLastPos, -1 means the key has no values.
+	// *ErrConflict is returned when another value was appended first, values are not recorded then.
+	RecordExpect(expectedLastPos int64, values ...[]byte) (poss []Position, err error)
+	// RecordWithHeaders appends the value with headers to the key, headers can be read without reading the value.
+	RecordWithHeaders(headers map[string][]byte, value []byte) (pos Position, err error)
 	Player() (p Player, err error)
 }
+
+type recorder struct {
+	key  []byte
+	tape *tape
+}
+
+func (r *recorder) Key() (key []byte) {
+	key = r.key
+	return
+}
+
+func (r *recorder) Record(values ...[]byte) (poss []Position, err error) {
+	if len(values) == 0 {
+		return
+	}
+	segments := make([]blocks.Segment, 0, len(values))
+	for _, value := range values {
+		segments = append(segments, blocks.NewSegment(value, r.tape.blockCapacity))
+	}
+	poss, err = r.record(segments, -1)
+	return
+}
+
+func (r *recorder) RecordExpect(expectedLastPos int64, values ...[]byte) (poss []Position, err error) {
+	if expectedLastPos < -1 {
+		err = fmt.Errorf("record %s failed, expected last pos must not be less than -1", r.key)
+		return
+	}
+	if len(values) == 0 {
+		return
+	}
+	segments := make([]blocks.Segment, 0, len(values))
+	for _, value := range values {
+		segments = append(segments, blocks.NewSegment(value, r.tape.blockCapacity))
+	}
+	poss, err = r.record(segments, expectedLastPos+1)
+	return
+}
+
+func (r *recorder) RecordWithHeaders(headers map[string][]byte, value []byte) (pos Position, err error) {
+	for name := range headers {
+		if name == "" {
+			err = fmt.Errorf("record %s failed, name of header is required", r.key)
+			return
+		}
+	}
+	poss, recordErr := r.record([]blocks.Segment{blocks.NewSegmentWithHeaders(blocks.EncodeHeaders(headers), value, r.tape.blockCapacity)}, -1)
+	if recordErr != nil {
+		err = recordErr
+		return
+	}
+	pos = poss[0]
+	return
+}
+
+// record writes segments and adds them to the key, expected is the expected number of values of the key, negative means any.
+func (r *recorder) record(segments []blocks.Segment, expected int64) (poss []Position, err error) {
+	keyErr := validateKey(r.key)
+	if keyErr != nil {
+		err = fmt.Errorf("record failed, %v", keyErr)
+		return
+	}
+	if err = r.tape.acquire(); err != nil {
+		return
+	}
+	defer r.tape.release()
+	if expected >= 0 {
+		// fail fast before writing values, the check is done again when adding them.
+		n, lenErr := r.tape.records.Len(r.key)
+		if lenErr != nil {
+			err = fmt.Errorf("record %s failed, %v", r.key, lenErr)
+			return
+		}
+		if n != expected {
+			err = &ErrConflict{Key: r.key, Expected: expected - 1, Actual: n - 1}
+			return
+		}
+	}
+	written, writeErr := r.tape.writeSegments(segments)
+	if writeErr != nil {
+		err = fmt.Errorf("record %s failed, %v", r.key, writeErr)
+		return
+	}
+	seq, ok, setErr := r.tape.record(r.key, segments, written, expected)
+	if setErr != nil {
+		err = fmt.Errorf("record %s failed, %v", r.key, setErr)
+		return
+	}
+	if !ok {
+		err = &ErrConflict{Key: r.key, Expected: expected - 1, Actual: seq - 1}
+		return
+	}
+	commitErr := r.tape.commit()
+	r.tape.watermark.end(r.key, seq+int64(len(written)), commitErr == nil)
+	if commitErr != nil {
+		err = fmt.Errorf("record %s failed, %v", r.key, commitErr)
+		return
+	}
+	poss = make([]Position, 0, len(written))
+	for i, pos := range written {
+		poss = append(poss, newPosition(seq+int64(i), pos))
+	}
+	return
+}
+
+func (r *recorder) Player() (p Player, err error) {
+	p = r.tape.Player(r.key)
+	return
+}
@@ -0,0 +1,208 @@
+package tapedb_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/aacfactory/tapedb"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRecorder_Record(t *testing.T) {
+	db, openErr := tapedb.Open(t.TempDir(), tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	r := defaultTape(t, db).Recorder([]byte("order:1"))
+	seq := int64(0)
+	for i := 0; i < 10; i++ {
+		poss, err := r.Record([]byte("a"), bytes.Repeat([]byte("b"), 1024), []byte("c"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(poss) != 3 {
+			t.Fatal("expected 3 positions, got", len(poss))
+		}
+		for _, pos := range poss {
+			if pos.Seq != seq {
+				t.Fatal("expected seq", seq, "got", pos)
+			}
+			seq++
+		}
+		if poss[1].Blocks != 3 || poss[2].Block != poss[1].Block+poss[1].Blocks {
+			t.Fatal("unexpected blocks", poss[1], poss[2])
+		}
+	}
+	p, _ := r.Player()
+	values, playErr := p.Play(16, 1)
+	if playErr != nil {
+		t.Fatal(playErr)
+	}
+	if len(values) != 1 || !bytes.Equal(values[0], bytes.Repeat([]byte("b"), 1024)) {
+		t.Fatal("unexpected value of seq 16")
+	}
+}
+
+func TestRecorder_RecordSyncMode(t *testing.T) {
+	for _, mode := range []tapedb.SyncMode{tapedb.SyncAlways, tapedb.SyncGroupCommit} {
+		dir := t.TempDir()
+		db, openErr := tapedb.Open(dir, tapedb.Option{SyncMode: mode})
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		tape := defaultTape(t, db)
+		wg := new(sync.WaitGroup)
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := tape.Recorder([]byte(fmt.Sprintf("key:%d", i%4))).Record([]byte("value")); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, openErr = tapedb.Open(dir, tapedb.Option{SyncMode: mode})
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		for i := 0; i < 4; i++ {
+			values, playErr := defaultTape(t, db).Player([]byte(fmt.Sprintf("key:%d", i))).Play(0, 100)
+			if playErr != nil {
+				t.Fatal(playErr)
+			}
+			if len(values) != 8 {
+				t.Fatal("expected 8 values, got", len(values))
+			}
+		}
+		_ = db.Close()
+	}
+}
+
+func TestRecorder_RecordWithHeaders(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{BlockCapacity: "64B", PageBlocks: 4})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	r := defaultTape(t, db).Recorder([]byte("order:1"))
+	if _, err := r.Record([]byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string][]byte{
+		"type":           []byte("created"),
+		"correlation-id": []byte("c-1"),
+		"schema":         []byte("3"),
+	}
+	large := bytes.Repeat([]byte("x"), 1000)
+	pos, recordErr := r.RecordWithHeaders(headers, large)
+	if recordErr != nil {
+		t.Fatal(recordErr)
+	}
+	if pos.Seq != 1 {
+		t.Fatal("unexpected pos", pos)
+	}
+	if _, err := r.RecordWithHeaders(map[string][]byte{"big": bytes.Repeat([]byte("h"), 500)}, []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.RecordWithHeaders(map[string][]byte{"": nil}, nil); err == nil {
+		t.Fatal("expected invalid header error")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, openErr = tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	p := defaultTape(t, db).Player([]byte("order:1"))
+	values, playErr := p.Play(0, 10)
+	if playErr != nil {
+		t.Fatal(playErr)
+	}
+	if len(values) != 3 || string(values[0]) != "plain" || !bytes.Equal(values[1], large) || string(values[2]) != "small" {
+		t.Fatal("unexpected values", len(values))
+	}
+	if got, err := p.Headers(0); err != nil || got != nil {
+		t.Fatal("expected no headers", got, err)
+	}
+	got, headersErr := p.Headers(1)
+	if headersErr != nil {
+		t.Fatal(headersErr)
+	}
+	if len(got) != 3 || string(got["type"]) != "created" || string(got["correlation-id"]) != "c-1" || string(got["schema"]) != "3" {
+		t.Fatal("unexpected headers", got)
+	}
+	if got, _ = p.Headers(2); len(got["big"]) != 500 {
+		t.Fatal("unexpected large headers", len(got["big"]))
+	}
+	if _, err := p.Headers(3); err == nil {
+		t.Fatal("expected out of range error")
+	}
+	it, _ := p.Iterator(context.Background(), 1)
+	defer it.Close()
+	if !it.Next() {
+		t.Fatal("expected value", it.Err())
+	}
+	if got, _ = it.Headers(); string(got["schema"]) != "3" || !bytes.Equal(it.Value(), large) {
+		t.Fatal("unexpected headers of iterator", got)
+	}
+}
+
+func TestRecorder_RecordExpect(t *testing.T) {
+	db, openErr := tapedb.Open(t.TempDir(), tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	r := defaultTape(t, db).Recorder([]byte("aggregate"))
+	if _, err := r.RecordExpect(-1, []byte("created")); err != nil {
+		t.Fatal(err)
+	}
+	poss, recordErr := r.RecordExpect(0, []byte("updated"), []byte("updated"))
+	if recordErr != nil {
+		t.Fatal(recordErr)
+	}
+	if len(poss) != 2 || poss[1].Seq != 2 {
+		t.Fatal("unexpected positions", poss)
+	}
+	_, recordErr = r.RecordExpect(0, []byte("stale"))
+	conflict, isConflict := recordErr.(*tapedb.ErrConflict)
+	if !isConflict || conflict.Expected != 0 || conflict.Actual != 2 {
+		t.Fatal("expected conflict, got", recordErr)
+	}
+	wg := new(sync.WaitGroup)
+	succeeded := int64(0)
+	conflicts := int64(0)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := r.RecordExpect(2, []byte(fmt.Sprintf("racer:%d", i)))
+			if err == nil {
+				atomic.AddInt64(&succeeded, 1)
+				return
+			}
+			if _, ok := err.(*tapedb.ErrConflict); ok {
+				atomic.AddInt64(&conflicts, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if succeeded != 1 || conflicts != 15 {
+		t.Fatal("expected only one racer succeeded", succeeded, conflicts)
+	}
+	p, _ := r.Player()
+	all, _ := p.Play(0, 100)
+	if len(all) != 4 {
+		t.Fatal("expected 4 values, got", len(all))
+	}
+}
@@ -0,0 +1,49 @@
+package tapedb_test
+
+import (
+	"fmt"
+	"github.com/aacfactory/tapedb"
+	"github.com/aacfactory/tapedb/internal/crashtest"
+	"testing"
+)
+
+func TestOpen_Recovery(t *testing.T) {
+	key := []byte("crash")
+	if dir, child := crashtest.Child(); child {
+		db, openErr := tapedb.Open(dir, tapedb.Option{SyncMode: tapedb.SyncNone})
+		if openErr != nil {
+			t.Fatal(openErr)
+		}
+		r := defaultTape(t, db).Recorder(key)
+		for i := 0; i < 10; i++ {
+			if _, err := r.Record([]byte(fmt.Sprintf("event:%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// crash without closing
+		crashtest.Ready()
+	}
+	dir := t.TempDir()
+	crashtest.Kill(t, "TestOpen_Recovery", dir)
+	db, openErr := tapedb.Open(dir, tapedb.Option{SyncMode: tapedb.SyncNone})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	recovery := db.Recovery()
+	if !recovery.Unclean || len(recovery.Files) == 0 {
+		t.Fatal("unexpected recovery", recovery)
+	}
+	values, playErr := defaultTape(t, db).Player(key).Play(0, 100)
+	if playErr != nil {
+		t.Fatal(playErr)
+	}
+	if len(values) != 10 {
+		t.Fatal("expected 10 values, got", len(values))
+	}
+	for i, v := range values {
+		if string(v) != fmt.Sprintf("event:%d", i) {
+			t.Fatal("unexpected value", i, string(v))
+		}
+	}
+}
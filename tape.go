@@ -1,7 +1,670 @@
 package tapedb
 
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/blocks"
+	"github.com/aacfactory/tapedb/internal/index"
+	"github.com/aacfactory/tapedb/internal/index/blist"
+	"github.com/aacfactory/tapedb/internal/index/btree"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
 type Tape interface {
-	Name() (name []byte)
+	Name() (name string)
 	Recorder(key []byte) (r Recorder)
 	Player(key []byte) (p Player)
+	// Keys returns at most limit keys which have prefix and are after startAfter in order.
+	Keys(ctx context.Context, prefix []byte, startAfter []byte, limit int64) (keys [][]byte, err error)
+	// ScanKeys returns an iterator of keys which have prefix and are after startAfter in order.
+	ScanKeys(ctx context.Context, prefix []byte, startAfter []byte) (it KeyIterator, err error)
+	// Batch returns a batch which records values of many keys all or nothing.
+	Batch() (b Batch)
+	// Update calls fn with a batch, and commits it when fn returns nil, otherwise discards it.
+	Update(fn func(tx Batch) (err error)) (err error)
+	// Vacuum shrinks index files of the tape by reusing freed slots, the tape stays open,
+	// but each index is blocked while it is vacuumed, so reads and writes of it wait until its pass is done.
+	Vacuum() (err error)
+}
+
+// TapeOptions are settings of a tape, zero values are replaced by the values of Option.
+type TapeOptions struct {
+	// MaxCacheNodes is the number of cached btree nodes of each index of the tape.
+	MaxCacheNodes int64
+	// MaxCacheLists is the number of cached blist lists of each index of the tape.
+	MaxCacheLists int64
+	// SavedHistoryRetention is the number of saved entries of a key which can be listed and restored.
+	SavedHistoryRetention int64
+}
+
+func (opts TapeOptions) validate() (err error) {
+	if opts.MaxCacheNodes < 0 {
+		err = fmt.Errorf("invalid max cache nodes, it must not be negative")
+		return
+	}
+	if opts.MaxCacheLists < 0 {
+		err = fmt.Errorf("invalid max cache lists, it must not be negative")
+		return
+	}
+	if opts.SavedHistoryRetention < 0 {
+		err = fmt.Errorf("invalid saved history retention, it must not be negative")
+		return
+	}
+	return
+}
+
+func validateTapeName(name string) (err error) {
+	if name == "" || len(name) > maxTapeNameLen {
+		err = fmt.Errorf("invalid tape name, length of name must be in [1, %d]", maxTapeNameLen)
+		return
+	}
+	if name == "." || name == ".." {
+		err = fmt.Errorf("invalid tape name, %s is reserved", name)
+		return
+	}
+	for _, c := range name {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-' || c == '.' {
+			continue
+		}
+		err = fmt.Errorf("invalid tape name, only letters, digits, '_', '-' and '.' are allowed")
+		return
+	}
+	return
+}
+
+func openTape(dir string, name string, volumes *volumes, committer *committer, log *writeAheadLog, opts *options, tapeOpts TapeOptions) (t *tape, err error) {
+	maxCacheNodes := tapeOpts.MaxCacheNodes
+	if maxCacheNodes == 0 {
+		maxCacheNodes = opts.maxCacheNodes
+	}
+	maxCacheLists := tapeOpts.MaxCacheLists
+	if maxCacheLists == 0 {
+		maxCacheLists = opts.maxCacheLists
+	}
+	savedRetention := tapeOpts.SavedHistoryRetention
+	if savedRetention == 0 {
+		savedRetention = opts.savedRetention
+	}
+	tapeDir := filepath.Join(dir, name)
+	records, recordsErr := openTapeIndex(tapeDir, "records", maxCacheNodes, maxCacheLists, log.Notify)
+	if recordsErr != nil {
+		err = fmt.Errorf("open %s tape failed, %v", name, recordsErr)
+		return
+	}
+	saves, savesErr := openTapeIndex(tapeDir, "saves", maxCacheNodes, maxCacheLists, log.Notify)
+	if savesErr != nil {
+		_ = records.Close()
+		err = fmt.Errorf("open %s tape failed, %v", name, savesErr)
+		return
+	}
+	checkpoints, checkpointsErr := openTapeIndex(tapeDir, "consumers", maxCacheNodes, maxCacheLists, log.Notify)
+	if checkpointsErr != nil {
+		_ = records.Close()
+		_ = saves.Close()
+		err = fmt.Errorf("open %s tape failed, %v", name, checkpointsErr)
+		return
+	}
+	snapshots, snapshotsErr := openTapeIndex(tapeDir, "snapshots", maxCacheNodes, maxCacheLists, log.Notify)
+	if snapshotsErr != nil {
+		_ = records.Close()
+		_ = saves.Close()
+		_ = checkpoints.Close()
+		err = fmt.Errorf("open %s tape failed, %v", name, snapshotsErr)
+		return
+	}
+	timeline, timelineErr := openTapeIndex(tapeDir, "timeline", maxCacheNodes, maxCacheLists, log.Notify)
+	if timelineErr != nil {
+		_ = records.Close()
+		_ = saves.Close()
+		_ = checkpoints.Close()
+		_ = snapshots.Close()
+		err = fmt.Errorf("open %s tape failed, %v", name, timelineErr)
+		return
+	}
+	registry, registryErr := openConsumers(filepath.Join(tapeDir, "consumers"))
+	if registryErr != nil {
+		_ = records.Close()
+		_ = saves.Close()
+		_ = checkpoints.Close()
+		_ = snapshots.Close()
+		_ = timeline.Close()
+		err = fmt.Errorf("open %s tape failed, %v", name, registryErr)
+		return
+	}
+	t = &tape{
+		mutex:          new(sync.RWMutex),
+		name:           name,
+		dir:            tapeDir,
+		records:        records,
+		saves:          saves,
+		checkpoints:    checkpoints,
+		snapshots:      snapshots,
+		timeline:       timeline,
+		locks:          new(keyLocks),
+		consumers:      registry,
+		volumes:        volumes,
+		committer:      committer,
+		log:            log,
+		createdAt:      0,
+		watermark:      newWatermark(),
+		blockCapacity:  opts.blockCapacity,
+		writeTimeout:   opts.writeTimeout,
+		savedRetention: savedRetention,
+		timeInterval:   opts.timeIndexInterval,
+		corruption:     opts.corruption,
+		closed:         false,
+	}
+	return
+}
+
+// openTapeIndex opens an index which files are flushed by checkpoints of the write-ahead log, full requests a checkpoint.
+func openTapeIndex(dir string, name string, maxCacheNodes int64, maxCacheLists int64, full func()) (idx *index.Indexer, err error) {
+	idx, err = index.New(index.Options{
+		BTree: btree.Options{
+			Path:          filepath.Join(dir, name+".bt"),
+			MaxCacheNodes: maxCacheNodes,
+			Full:          full,
+		},
+		BList: blist.Options{
+			Path:          filepath.Join(dir, name+".bl"),
+			MaxCacheLists: maxCacheLists,
+			Full:          full,
+		},
+	})
+	return
+}
+
+type tape struct {
+	mutex          *sync.RWMutex
+	name           string
+	dir            string
+	records        *index.Indexer
+	saves          *index.Indexer
+	checkpoints    *index.Indexer
+	snapshots      *index.Indexer
+	timeline       *index.Indexer
+	locks          *keyLocks
+	consumers      *consumers
+	volumes        *volumes
+	committer      *committer
+	log            *writeAheadLog
+	createdAt      int64
+	watermark      *watermark
+	blockCapacity  int64
+	writeTimeout   time.Duration
+	savedRetention int64
+	timeInterval   time.Duration
+	corruption     CorruptionPolicy
+	closed         bool
+	// logged is called between logging and applying an operation, it is only set by tests to crash there.
+	logged func()
+}
+
+func (t *tape) Name() (name string) {
+	name = t.name
+	return
+}
+
+func (t *tape) Recorder(key []byte) (r Recorder) {
+	r = &recorder{
+		key:  key,
+		tape: t,
+	}
+	return
+}
+
+func (t *tape) Player(key []byte) (p Player) {
+	p = &player{
+		key:  key,
+		tape: t,
+	}
+	return
+}
+
+func (t *tape) Keys(ctx context.Context, prefix []byte, startAfter []byte, limit int64) (keys [][]byte, err error) {
+	if limit <= 0 {
+		err = fmt.Errorf("list keys failed, limit must be greater than 0")
+		return
+	}
+	it, itErr := t.ScanKeys(ctx, prefix, startAfter)
+	if itErr != nil {
+		err = itErr
+		return
+	}
+	keys = make([][]byte, 0, 1)
+	for int64(len(keys)) < limit && it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err = it.Err(); err != nil {
+		keys = nil
+		err = fmt.Errorf("list keys failed, %v", err)
+	}
+	_ = it.Close()
+	return
+}
+
+func (t *tape) ScanKeys(ctx context.Context, prefix []byte, startAfter []byte) (it KeyIterator, err error) {
+	if len(prefix) > maxKeyLen || len(startAfter) > maxKeyLen {
+		err = fmt.Errorf("scan keys failed, prefix and start after must not be longer than %d", maxKeyLen)
+		return
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	it = &keyIterator{
+		ctx:        ctx,
+		tape:       t,
+		prefix:     prefix,
+		startAfter: startAfter,
+		cursor:     nil,
+		err:        nil,
+		closed:     false,
+	}
+	return
+}
+
+func (t *tape) Batch() (b Batch) {
+	b = &batch{
+		tape:    t,
+		entries: make([]*batchEntry, 0, 1),
+		done:    false,
+	}
+	return
+}
+
+func (t *tape) Update(fn func(tx Batch) (err error)) (err error) {
+	b := t.Batch()
+	if err = fn(b); err != nil {
+		b.Discard()
+		return
+	}
+	_, err = b.Commit()
+	return
+}
+
+func (t *tape) Vacuum() (err error) {
+	if err = t.acquire(); err != nil {
+		return
+	}
+	defer t.release()
+	// vacuum moves btree nodes and blist lists, but keeps keys and values of indexes, so it is not logged as an operation,
+	// its writes are deferred like others and the checkpoint after it makes them durable, a crash before leaves the files as they were.
+	t.log.Begin()
+	for _, idx := range t.indexes() {
+		if vacuumErr := idx.Vacuum(); vacuumErr != nil {
+			t.log.End()
+			err = fmt.Errorf("vacuum %s tape failed, %v", t.name, vacuumErr)
+			return
+		}
+	}
+	t.log.End()
+	if checkpointErr := t.log.Checkpoint(); checkpointErr != nil {
+		err = fmt.Errorf("vacuum %s tape failed, %v", t.name, checkpointErr)
+		return
+	}
+	return
+}
+
+// indexes returns indexes of the tape in order of their ids in frames of the write-ahead log.
+func (t *tape) indexes() (idxs []*index.Indexer) {
+	idxs = []*index.Indexer{t.records, t.saves, t.checkpoints, t.snapshots, t.timeline}
+	return
+}
+
+// acquire holds the tape until release, so the tape can not be closed or dropped while using.
+func (t *tape) acquire() (err error) {
+	t.mutex.RLock()
+	if t.closed {
+		t.mutex.RUnlock()
+		err = fmt.Errorf("%s tape was closed", t.name)
+		return
+	}
+	return
+}
+
+func (t *tape) release() {
+	t.mutex.RUnlock()
+}
+
+func (t *tape) writeSegments(segments []blocks.Segment) (poss [][]byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.writeTimeout)
+	written, writeErr := t.volumes.write(ctx, segments)
+	cancel()
+	if writeErr != nil {
+		err = writeErr
+		return
+	}
+	poss = make([][]byte, 0, len(written))
+	for _, pos := range written {
+		poss = append(poss, pos)
+	}
+	return
+}
+
+// commit makes operations which were logged durable, blocks and index mutations are synced with the write-ahead log.
+func (t *tape) commit() (err error) {
+	err = t.committer.commit(t.log)
+	return
+}
+
+// operation returns an operation of the tape which logs segments which were written at poss.
+func (t *tape) operation(segments []blocks.Segment, poss [][]byte) (op *logOperation) {
+	op = &logOperation{
+		tape:      t.name,
+		createdAt: t.createdAt,
+		blocks:    make([]logBlock, 0, len(poss)),
+		mutations: make([]logMutation, 0, 2),
+	}
+	for i, pos := range poss {
+		op.blocks = append(op.blocks, logBlock{
+			pos:     pos,
+			segment: segments[i],
+		})
+	}
+	return
+}
+
+// apply logs op and applies its mutations, t.locks of keys of op must be held, so mutations of a key are applied in the order of the log.
+// When applying fails after op was logged, op is not removed from the log, so it is redone when the tape is opened again.
+func (t *tape) apply(op *logOperation) (err error) {
+	t.log.Begin()
+	defer t.log.End()
+	if err = t.log.Append(op.encode()); err != nil {
+		return
+	}
+	if t.logged != nil {
+		t.logged()
+	}
+	err = t.redo(op)
+	return
+}
+
+// redo applies mutations of op to indexes.
+func (t *tape) redo(op *logOperation) (err error) {
+	idxs := t.indexes()
+	for _, m := range op.mutations {
+		if m.index < 1 || int(m.index) > len(idxs) {
+			err = fmt.Errorf("index %d of operation was not found", m.index)
+			return
+		}
+		idx := idxs[m.index-1]
+		switch m.kind {
+		case mutationAppend:
+			_, err = idx.Set(m.key, m.items)
+		case mutationRetain:
+			err = idx.Retain(m.key, m.keep)
+		default:
+			err = fmt.Errorf("kind %d of mutation is unknown", m.kind)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// record adds poss of segments to the list of key with the commit time, seq is the offset of the first one.
+// When expected is not negative, poss are added only when the list has expected values, otherwise ok is false and seq is the length.
+// An entry of the timeline is only added when the last one of key does not cover the commit time, see timeEntry.
+func (t *tape) record(key []byte, segments []blocks.Segment, poss [][]byte, expected int64) (seq int64, ok bool, err error) {
+	unlock := t.locks.lock(key)
+	defer unlock()
+	seq, err = t.records.Len(key)
+	if err != nil {
+		return
+	}
+	if expected >= 0 && seq != expected {
+		return
+	}
+	entryKey, entry, entryErr := t.timeEntry(key, seq, poss, time.Now().UnixNano())
+	if entryErr != nil {
+		err = entryErr
+		return
+	}
+	op := t.operation(segments, poss)
+	op.append(indexRecords, key, poss)
+	if entryKey != nil {
+		op.append(indexTimeline, entryKey, [][]byte{entry})
+	}
+	// poss are not read until the caller ends them in the watermark after the commit
+	t.watermark.begin(key, seq)
+	if err = t.apply(op); err != nil {
+		t.watermark.end(key, seq, false)
+		return
+	}
+	ok = true
+	return
+}
+
+// committed returns the number of values of key which can be read, values which were applied but not committed are excluded.
+func (t *tape) committed(key []byte) (n int64, err error) {
+	n, err = t.records.Len(key)
+	if err != nil {
+		return
+	}
+	n = t.watermark.limit(key, n)
+	return
+}
+
+// checkpoint is a saved pos of a key, it is saved as [pos][saved_at][comment].
+type checkpoint struct {
+	pos     int64
+	comment []byte
+	savedAt int64
+}
+
+func encodeCheckpoint(pos int64, comment []byte, savedAt int64) (p []byte) {
+	p = make([]byte, 16+len(comment))
+	binary.BigEndian.PutUint64(p[0:8], uint64(pos))
+	binary.BigEndian.PutUint64(p[8:16], uint64(savedAt))
+	copy(p[16:], comment)
+	return
+}
+
+func decodeCheckpoint(p []byte) (cp checkpoint, err error) {
+	if len(p) < 16 {
+		err = fmt.Errorf("saved value is broken")
+		return
+	}
+	cp.pos = int64(binary.BigEndian.Uint64(p[0:8]))
+	cp.savedAt = int64(binary.BigEndian.Uint64(p[8:16]))
+	cp.comment = p[16:]
+	return
+}
+
+// saveCheckpoint writes the checkpoint into volumes and appends it to the list of key in the index of id.
+// When the tape has a saved history retention, the list is cut to the retention once it has twice of it,
+// so the retained checkpoints are copied once for retention saves instead of each save.
+func (t *tape) saveCheckpoint(id byte, key []byte, pos int64, comment []byte) (err error) {
+	segments := []blocks.Segment{blocks.NewSegment(encodeCheckpoint(pos, comment, time.Now().UnixNano()), t.blockCapacity)}
+	poss, writeErr := t.writeSegments(segments)
+	if writeErr != nil {
+		err = writeErr
+		return
+	}
+	op := t.operation(segments, poss)
+	op.append(id, key, poss)
+	unlock := t.locks.lock(key)
+	if t.savedRetention > 0 {
+		n, lenErr := t.indexes()[id-1].Len(key)
+		if lenErr != nil {
+			unlock()
+			err = lenErr
+			return
+		}
+		if n+1 >= 2*t.savedRetention {
+			op.retain(id, key, t.savedRetention)
+		}
+	}
+	err = t.apply(op)
+	unlock()
+	if err != nil {
+		return
+	}
+	err = t.commit()
+	return
+}
+
+// dropCheckpoints removes all checkpoints of key in the index of id.
+func (t *tape) dropCheckpoints(id byte, key []byte) (err error) {
+	op := t.operation(nil, nil)
+	op.retain(id, key, 0)
+	unlock := t.locks.lock(key)
+	err = t.apply(op)
+	unlock()
+	if err != nil {
+		return
+	}
+	err = t.commit()
+	return
+}
+
+// latestCheckpoint returns the last checkpoint of key in idx, pos is -1 when there is none.
+func (t *tape) latestCheckpoint(idx *index.Indexer, key []byte) (pos int64, comment []byte, err error) {
+	pos = -1
+	last, has, getErr := idx.Last(key)
+	if getErr != nil {
+		err = getErr
+		return
+	}
+	if !has {
+		return
+	}
+	saved, readErr := t.read(last)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	cp, decodeErr := decodeCheckpoint(saved)
+	if decodeErr != nil {
+		err = decodeErr
+		return
+	}
+	pos = cp.pos
+	comment = cp.comment
+	return
+}
+
+// checkpointHistory returns at most limit retained checkpoints of key in idx from the latest, limit <= 0 means all.
+func (t *tape) checkpointHistory(idx *index.Indexer, key []byte, limit int64) (cps []checkpoint, err error) {
+	n, lenErr := idx.Len(key)
+	if lenErr != nil {
+		err = lenErr
+		return
+	}
+	from := int64(0)
+	if t.savedRetention > 0 && n-t.savedRetention > from {
+		from = n - t.savedRetention
+	}
+	if limit > 0 && n-limit > from {
+		from = n - limit
+	}
+	cps = make([]checkpoint, 0, n-from)
+	if n == from {
+		return
+	}
+	items, has, itErr := idx.Iterator(key, from)
+	if itErr != nil {
+		err = itErr
+		return
+	}
+	if !has {
+		return
+	}
+	for int64(len(cps)) < n-from {
+		item, ok, nextErr := items.Next()
+		if nextErr != nil {
+			err = nextErr
+			return
+		}
+		if !ok {
+			break
+		}
+		saved, readErr := t.read(item)
+		if readErr != nil {
+			err = readErr
+			return
+		}
+		cp, decodeErr := decodeCheckpoint(saved)
+		if decodeErr != nil {
+			err = decodeErr
+			return
+		}
+		cps = append(cps, cp)
+	}
+	for i, j := 0, len(cps)-1; i < j; i, j = i+1, j-1 {
+		cps[i], cps[j] = cps[j], cps[i]
+	}
+	return
+}
+
+func (t *tape) read(pos []byte) (value []byte, err error) {
+	value, err = t.volumes.read(pos)
+	return
+}
+
+// skipCorrupted returns true when the value at pos should be skipped by the corruption policy, err is the read error of it.
+func (t *tape) skipCorrupted(pos []byte, err error) (skip bool, quarantineErr error) {
+	var corrupted *ErrCorrupted
+	if t.corruption == CorruptionFail || !errors.As(err, &corrupted) {
+		return
+	}
+	if t.corruption == CorruptionQuarantine {
+		quarantineErr = t.volumes.quarantine(pos)
+		if quarantineErr != nil {
+			return
+		}
+	}
+	skip = true
+	return
+}
+
+func (t *tape) readHeaders(pos []byte) (headers map[string][]byte, err error) {
+	p, readErr := t.volumes.readHeaders(pos)
+	if readErr != nil {
+		err = readErr
+		return
+	}
+	if p == nil {
+		return
+	}
+	headers, err = blocks.DecodeHeaders(p)
+	return
+}
+
+func (t *tape) Close() (err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+	t.watermark.Close()
+	recordsErr := t.records.Close()
+	savesErr := t.saves.Close()
+	checkpointsErr := t.checkpoints.Close()
+	snapshotsErr := t.snapshots.Close()
+	timelineErr := t.timeline.Close()
+	if recordsErr != nil {
+		err = recordsErr
+		return
+	}
+	if savesErr != nil {
+		err = savesErr
+		return
+	}
+	if checkpointsErr != nil {
+		err = checkpointsErr
+		return
+	}
+	if snapshotsErr != nil {
+		err = snapshotsErr
+		return
+	}
+	err = timelineErr
+	return
 }
@@ -0,0 +1,203 @@
+package tapedb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// timeIndexValues is the max number of values of a key between two entries of the timeline.
+const timeIndexValues = 4096
+
+// The timeline of a tape is a sparse time index of keys, its btree keys are [id][time] and their lists have entries of [seq][until].
+// id is the position of the first value of a key, so it is fixed and short, and entries of a key are binary searched by the btree.
+// An entry is only written when the key was not indexed since until or since timeIndexValues values,
+// values from seq to the next entry were recorded in [time, until).
+const (
+	timelineIDLen  = 16
+	timelineKeyLen = timelineIDLen + 8
+)
+
+type timelineEntry struct {
+	time  int64
+	seq   int64
+	until int64
+}
+
+func timelineKey(id []byte, nanos int64) (k []byte) {
+	k = make([]byte, timelineKeyLen)
+	copy(k, id)
+	binary.BigEndian.PutUint64(k[timelineIDLen:], uint64(nanos))
+	return
+}
+
+func encodeTimelineEntry(seq int64, until int64) (p []byte) {
+	p = make([]byte, 16)
+	binary.BigEndian.PutUint64(p[0:8], uint64(seq))
+	binary.BigEndian.PutUint64(p[8:16], uint64(until))
+	return
+}
+
+// timelineID returns the id of key in the timeline, poss are the positions of values which are being recorded from seq.
+func (t *tape) timelineID(key []byte, seq int64, poss [][]byte) (id []byte, has bool, err error) {
+	if seq == 0 {
+		if len(poss) > 0 {
+			id = poss[0]
+			has = true
+		}
+		return
+	}
+	items, hasItems, itErr := t.records.Iterator(key, 0)
+	if itErr != nil {
+		err = itErr
+		return
+	}
+	if !hasItems {
+		return
+	}
+	id, has, err = items.Next()
+	return
+}
+
+// timeEntry returns the entry of the timeline for values of key which are recorded from seq at now,
+// k is nil when the last entry of key still covers them. t.locks of key must be held.
+func (t *tape) timeEntry(key []byte, seq int64, poss [][]byte, now int64) (k []byte, entry []byte, err error) {
+	id, has, idErr := t.timelineID(key, seq, poss)
+	if idErr != nil {
+		err = idErr
+		return
+	}
+	if !has {
+		return
+	}
+	last, hasLast, lastErr := t.lastTimelineEntry(id, math.MaxInt64)
+	if lastErr != nil {
+		err = lastErr
+		return
+	}
+	until := now + int64(t.timeInterval)
+	if hasLast {
+		if now < last.time {
+			// times of a key are never decreased, so its entries can be searched
+			now = last.time
+		}
+		if now < last.until {
+			if seq-last.seq < timeIndexValues {
+				return
+			}
+			until = last.until
+		}
+	}
+	k = timelineKey(id, now)
+	entry = encodeTimelineEntry(seq, until)
+	return
+}
+
+// lastTimelineEntry returns the last entry of id which time is not greater than nanos.
+func (t *tape) lastTimelineEntry(id []byte, nanos int64) (e timelineEntry, has bool, err error) {
+	c := t.timeline.Keys()
+	ok, seekErr := c.SeekLast(timelineKey(id, nanos))
+	if seekErr != nil {
+		err = seekErr
+		return
+	}
+	if !ok || !bytes.Equal(c.Key()[:timelineIDLen], id) {
+		return
+	}
+	// entries which have the same time are in the same list, the last one has the latest until
+	p, hasEntry, getErr := t.timeline.Last(c.Key())
+	if getErr != nil {
+		err = getErr
+		return
+	}
+	if !hasEntry {
+		return
+	}
+	e = timelineEntry{
+		time:  int64(binary.BigEndian.Uint64(c.Key()[timelineIDLen:])),
+		seq:   int64(binary.BigEndian.Uint64(p[0:8])),
+		until: int64(binary.BigEndian.Uint64(p[8:16])),
+	}
+	has = true
+	return
+}
+
+// nextTimelineEntry returns the first entry of id which time is not less than nanos.
+func (t *tape) nextTimelineEntry(id []byte, nanos int64) (e timelineEntry, has bool, err error) {
+	c := t.timeline.Keys()
+	ok, seekErr := c.Seek(timelineKey(id, nanos))
+	if seekErr != nil {
+		err = seekErr
+		return
+	}
+	if !ok || !bytes.Equal(c.Key()[:timelineIDLen], id) {
+		return
+	}
+	items, hasItems, itErr := t.timeline.Iterator(c.Key(), 0)
+	if itErr != nil {
+		err = itErr
+		return
+	}
+	if !hasItems {
+		return
+	}
+	p, hasEntry, nextErr := items.Next()
+	if nextErr != nil {
+		err = nextErr
+		return
+	}
+	if !hasEntry {
+		return
+	}
+	e = timelineEntry{
+		time:  int64(binary.BigEndian.Uint64(c.Key()[timelineIDLen:])),
+		seq:   int64(binary.BigEndian.Uint64(p[0:8])),
+		until: int64(binary.BigEndian.Uint64(p[8:16])),
+	}
+	has = true
+	return
+}
+
+// seekTime returns the offset of the first value of key which was recorded at or after nanos.
+// The timeline is sparse, so when the values around nanos share an entry, the offset is the seq of the entry,
+// and it may be up to the time index interval before nanos.
+func (t *tape) seekTime(key []byte, nanos int64) (seq int64, err error) {
+	if nanos < 0 {
+		nanos = 0
+	}
+	n, lenErr := t.records.Len(key)
+	if lenErr != nil {
+		err = lenErr
+		return
+	}
+	id, has, idErr := t.timelineID(key, n, nil)
+	if idErr != nil {
+		err = idErr
+		return
+	}
+	if !has {
+		return
+	}
+	prev, hasPrev := timelineEntry{}, false
+	if nanos > 0 {
+		prev, hasPrev, err = t.lastTimelineEntry(id, nanos-1)
+		if err != nil {
+			return
+		}
+	}
+	if hasPrev && prev.until > nanos {
+		seq = prev.seq
+		return
+	}
+	next, hasNext, nextErr := t.nextTimelineEntry(id, nanos)
+	if nextErr != nil {
+		err = nextErr
+		return
+	}
+	if hasNext {
+		seq = next.seq
+		return
+	}
+	seq = n
+	return
+}
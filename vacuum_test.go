@@ -0,0 +1,84 @@
+package tapedb_test
+
+import (
+	"fmt"
+	"github.com/aacfactory/tapedb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTape_Vacuum(t *testing.T) {
+	dir := t.TempDir()
+	db, openErr := tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	tape := defaultTape(t, db)
+	keys := []string{"a", "b", "c"}
+	for i := 0; i < 60; i++ {
+		for _, key := range keys {
+			p := tape.Player([]byte(key))
+			if _, err := tape.Recorder([]byte(key)).Record([]byte(fmt.Sprintf("%s%d", key, i))); err != nil {
+				t.Fatal(err)
+			}
+			if err := p.SaveSnapshot(int64(i), []byte(fmt.Sprintf("%d", i))); err != nil {
+				t.Fatal(err)
+			}
+			// pruning frees the old list of snapshots
+			if i%15 == 14 {
+				if err := p.PruneSnapshots(1); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	// index files are checkpointed by closing
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, openErr = tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	tape = defaultTape(t, db)
+	path := filepath.Join(dir, "tapes", tapedb.DefaultTapeName, "snapshots.bl")
+	stat, statErr := os.Stat(path)
+	if statErr != nil {
+		t.Fatal(statErr)
+	}
+	size := stat.Size()
+	if err := tape.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	stat, _ = os.Stat(path)
+	if stat.Size() >= size {
+		t.Fatal("expected snapshots shrunk from", size, "got", stat.Size())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, openErr = tapedb.Open(dir, tapedb.Option{})
+	if openErr != nil {
+		t.Fatal(openErr)
+	}
+	defer db.Close()
+	tape = defaultTape(t, db)
+	for _, key := range keys {
+		p := tape.Player([]byte(key))
+		pos, state, snapshotErr := p.LatestSnapshot()
+		if snapshotErr != nil {
+			t.Fatal(snapshotErr)
+		}
+		if pos != 59 || string(state) != "59" {
+			t.Fatal("unexpected snapshot", key, pos, string(state))
+		}
+		values, playErr := p.Play(0, 100)
+		if playErr != nil {
+			t.Fatal(playErr)
+		}
+		if len(values) != 60 || string(values[59]) != fmt.Sprintf("%s59", key) {
+			t.Fatal("unexpected values", key, len(values))
+		}
+	}
+}
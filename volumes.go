@@ -0,0 +1,191 @@
+package tapedb
+
+import (
+	"context"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/blocks"
+	"github.com/aacfactory/tapedb/internal/lru"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+func openVolumes(dir string, manifest *manifest, opts *options, cache *lru.LRU) (vs *volumes, err error) {
+	vs = &volumes{
+		mutex:    new(sync.RWMutex),
+		dir:      dir,
+		manifest: manifest,
+		opts:     opts,
+		cache:    cache,
+		items:    make(map[int64]*blocks.Volume),
+		active:   nil,
+	}
+	for no := int64(1); no <= manifest.volumes; no++ {
+		v, openErr := vs.open(no)
+		if openErr != nil {
+			_ = vs.Close()
+			err = openErr
+			return
+		}
+		vs.items[no] = v
+		vs.active = v
+	}
+	if vs.active == nil {
+		err = vs.roll(nil)
+		if err != nil {
+			_ = vs.Close()
+			return
+		}
+	}
+	return
+}
+
+func volumePath(dir string, no int64) (path string) {
+	path = filepath.Join(dir, fmt.Sprintf("%08d.vol", no))
+	return
+}
+
+type volumes struct {
+	mutex    *sync.RWMutex
+	dir      string
+	manifest *manifest
+	opts     *options
+	cache    *lru.LRU
+	items    map[int64]*blocks.Volume
+	active   *blocks.Volume
+}
+
+func (vs *volumes) open(no int64) (v *blocks.Volume, err error) {
+	v, err = blocks.NewVolume(blocks.VolumeOptions{
+		Path:          volumePath(vs.dir, no),
+		No:            no,
+		BlockCapacity: vs.manifest.blockCapacity,
+		MaxBlocks:     vs.manifest.volumeMaxBlocks,
+		PageBlocks:    vs.opts.pageBlocks,
+		Cache:         vs.cache,
+		SyncInterval:  vs.opts.syncInterval,
+	})
+	return
+}
+
+// roll opens the next volume when the active one is full.
+func (vs *volumes) roll(full *blocks.Volume) (err error) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	if vs.active != full {
+		return
+	}
+	no := int64(1)
+	if full != nil {
+		no = full.No() + 1
+	}
+	v, openErr := vs.open(no)
+	if openErr != nil {
+		err = openErr
+		return
+	}
+	err = vs.manifest.setVolumes(no)
+	if err != nil {
+		_ = v.Close()
+		return
+	}
+	vs.items[no] = v
+	vs.active = v
+	return
+}
+
+func (vs *volumes) write(ctx context.Context, segments []blocks.Segment) (poss []blocks.Position, err error) {
+	for {
+		vs.mutex.RLock()
+		active := vs.active
+		vs.mutex.RUnlock()
+		ok := false
+		poss, ok, err = active.Write(ctx, segments...)
+		if err != nil || ok {
+			return
+		}
+		if active.Blocks() == 0 {
+			err = fmt.Errorf("size of values is larger than volume")
+			return
+		}
+		err = vs.roll(active)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (vs *volumes) read(pos blocks.Position) (p []byte, err error) {
+	vs.mutex.RLock()
+	v, has := vs.items[int64(pos.Idx())]
+	vs.mutex.RUnlock()
+	if !has {
+		err = fmt.Errorf("volume of %s was not found", pos)
+		return
+	}
+	p, err = v.Read(pos)
+	return
+}
+
+// quarantine copies raw blocks of the segment of pos into the quarantine directory, the copy is replaced when it exists.
+func (vs *volumes) quarantine(pos blocks.Position) (err error) {
+	vs.mutex.RLock()
+	v, has := vs.items[int64(pos.Idx())]
+	vs.mutex.RUnlock()
+	if !has {
+		err = fmt.Errorf("quarantine %s failed, volume was not found", pos)
+		return
+	}
+	seg, readErr := v.ReadSegment(pos)
+	if readErr != nil {
+		err = fmt.Errorf("quarantine %s failed, %v", pos, readErr)
+		return
+	}
+	dir := filepath.Join(vs.dir, "quarantine")
+	if mkdirErr := os.MkdirAll(dir, 0700); mkdirErr != nil {
+		err = fmt.Errorf("quarantine %s failed, %v", pos, mkdirErr)
+		return
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%08d-%08d.blocks", pos.Idx(), pos.No()))
+	if writeErr := os.WriteFile(path, seg, 0600); writeErr != nil {
+		err = fmt.Errorf("quarantine %s failed, %v", pos, writeErr)
+		return
+	}
+	return
+}
+
+func (vs *volumes) readHeaders(pos blocks.Position) (headers []byte, err error) {
+	vs.mutex.RLock()
+	v, has := vs.items[int64(pos.Idx())]
+	vs.mutex.RUnlock()
+	if !has {
+		err = fmt.Errorf("volume of %s was not found", pos)
+		return
+	}
+	headers, err = v.ReadHeaders(pos)
+	return
+}
+
+// sync syncs all volumes.
+func (vs *volumes) sync() (err error) {
+	vs.mutex.RLock()
+	defer vs.mutex.RUnlock()
+	for _, v := range vs.items {
+		if syncErr := v.Sync(); syncErr != nil {
+			err = syncErr
+		}
+	}
+	return
+}
+
+func (vs *volumes) Close() (err error) {
+	vs.mutex.Lock()
+	defer vs.mutex.Unlock()
+	for _, v := range vs.items {
+		closeErr := v.Close()
+		if closeErr != nil {
+			err = closeErr
+		}
+	}
+	return
+}
@@ -0,0 +1,440 @@
+package tapedb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/aacfactory/tapedb/internal/blocks"
+	"github.com/aacfactory/tapedb/internal/ioutils"
+	"github.com/aacfactory/tapedb/internal/journal"
+	"github.com/aacfactory/tapedb/internal/wal"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	frameOperation  = byte(1)
+	frameCheckpoint = byte(2)
+)
+
+const (
+	mutationAppend = byte(1)
+	mutationRetain = byte(2)
+)
+
+// ids of indexes of a tape in frames, they are positions in tape.indexes plus 1.
+const (
+	indexRecords = byte(iota + 1)
+	indexSaves
+	indexConsumers
+	indexSnapshots
+	indexTimeline
+)
+
+// logOperation is a frame of an operation of a tape, it has blocks which were written into volumes and mutations of indexes which refer to them.
+// [kind][tape_len][tape][created_at][blocks][...[pos][segment_len][segment]][mutations][...mutations]
+// mutation: [kind][index][key_len][key][keep][items][...[item_len][item]]
+type logOperation struct {
+	tape      string
+	createdAt int64
+	blocks    []logBlock
+	mutations []logMutation
+}
+
+type logBlock struct {
+	pos     blocks.Position
+	segment blocks.Segment
+}
+
+type logMutation struct {
+	kind  byte
+	index byte
+	key   []byte
+	items [][]byte
+	keep  int64
+}
+
+func (op *logOperation) append(index byte, key []byte, items [][]byte) {
+	op.mutations = append(op.mutations, logMutation{
+		kind:  mutationAppend,
+		index: index,
+		key:   key,
+		items: items,
+	})
+}
+
+func (op *logOperation) retain(index byte, key []byte, keep int64) {
+	op.mutations = append(op.mutations, logMutation{
+		kind:  mutationRetain,
+		index: index,
+		key:   key,
+		keep:  keep,
+	})
+}
+
+func (op *logOperation) encode() (p []byte) {
+	size := 1 + 1 + len(op.tape) + 8 + 4 + 4
+	for _, block := range op.blocks {
+		size = size + 16 + 4 + len(block.segment)
+	}
+	for _, m := range op.mutations {
+		size = size + 1 + 1 + 2 + len(m.key) + 8 + 4
+		for _, item := range m.items {
+			size = size + 2 + len(item)
+		}
+	}
+	p = make([]byte, 0, size)
+	p = append(p, frameOperation, byte(len(op.tape)))
+	p = append(p, op.tape...)
+	p = binary.BigEndian.AppendUint64(p, uint64(op.createdAt))
+	p = binary.BigEndian.AppendUint32(p, uint32(len(op.blocks)))
+	for _, block := range op.blocks {
+		p = append(p, block.pos...)
+		p = binary.BigEndian.AppendUint32(p, uint32(len(block.segment)))
+		p = append(p, block.segment...)
+	}
+	p = binary.BigEndian.AppendUint32(p, uint32(len(op.mutations)))
+	for _, m := range op.mutations {
+		p = append(p, m.kind, m.index)
+		p = binary.BigEndian.AppendUint16(p, uint16(len(m.key)))
+		p = append(p, m.key...)
+		p = binary.BigEndian.AppendUint64(p, uint64(m.keep))
+		p = binary.BigEndian.AppendUint32(p, uint32(len(m.items)))
+		for _, item := range m.items {
+			p = binary.BigEndian.AppendUint16(p, uint16(len(item)))
+			p = append(p, item...)
+		}
+	}
+	return
+}
+
+// decodeLogOperation decodes the frame of an operation, values refer to p.
+func decodeLogOperation(p []byte) (op *logOperation, err error) {
+	r := &frameReader{p: p[1:]}
+	op = &logOperation{}
+	op.tape = string(r.next(int(r.uint8())))
+	op.createdAt = int64(r.uint64())
+	n := int(r.uint32())
+	for i := 0; i < n && r.err == nil; i++ {
+		pos := blocks.Position(r.next(16))
+		segment := blocks.Segment(r.next(int(r.uint32())))
+		op.blocks = append(op.blocks, logBlock{pos: pos, segment: segment})
+	}
+	n = int(r.uint32())
+	for i := 0; i < n && r.err == nil; i++ {
+		m := logMutation{
+			kind:  r.uint8(),
+			index: r.uint8(),
+		}
+		m.key = r.next(int(r.uint16()))
+		m.keep = int64(r.uint64())
+		items := int(r.uint32())
+		for k := 0; k < items && r.err == nil; k++ {
+			m.items = append(m.items, r.next(int(r.uint16())))
+		}
+		op.mutations = append(op.mutations, m)
+	}
+	if r.err != nil {
+		op = nil
+		err = fmt.Errorf("operation frame is broken")
+		return
+	}
+	return
+}
+
+// logFile is pages of an index file in a checkpoint frame, path is relative to the dir of the tapedb.
+// [kind][files][...[path_len][path][size][pages][...[offset][page_len][page]]]
+type logFile struct {
+	path  string
+	size  int64
+	pages []journal.Page
+}
+
+func encodeLogCheckpoint(files []logFile) (p []byte) {
+	size := 1 + 4
+	for _, file := range files {
+		size = size + 2 + len(file.path) + 8 + 4
+		for _, page := range file.pages {
+			size = size + 8 + 4 + len(page.P)
+		}
+	}
+	p = make([]byte, 0, size)
+	p = append(p, frameCheckpoint)
+	p = binary.BigEndian.AppendUint32(p, uint32(len(files)))
+	for _, file := range files {
+		p = binary.BigEndian.AppendUint16(p, uint16(len(file.path)))
+		p = append(p, file.path...)
+		p = binary.BigEndian.AppendUint64(p, uint64(file.size))
+		p = binary.BigEndian.AppendUint32(p, uint32(len(file.pages)))
+		for _, page := range file.pages {
+			p = binary.BigEndian.AppendUint64(p, uint64(page.Offset))
+			p = binary.BigEndian.AppendUint32(p, uint32(len(page.P)))
+			p = append(p, page.P...)
+		}
+	}
+	return
+}
+
+// decodeLogCheckpoint decodes the frame of a checkpoint, pages refer to p.
+func decodeLogCheckpoint(p []byte) (files []logFile, err error) {
+	r := &frameReader{p: p[1:]}
+	n := int(r.uint32())
+	for i := 0; i < n && r.err == nil; i++ {
+		file := logFile{}
+		file.path = string(r.next(int(r.uint16())))
+		file.size = int64(r.uint64())
+		pages := int(r.uint32())
+		for k := 0; k < pages && r.err == nil; k++ {
+			offset := int64(r.uint64())
+			file.pages = append(file.pages, journal.Page{
+				Offset: offset,
+				P:      r.next(int(r.uint32())),
+			})
+		}
+		files = append(files, file)
+	}
+	if r.err != nil {
+		files = nil
+		err = fmt.Errorf("checkpoint frame is broken")
+		return
+	}
+	return
+}
+
+type frameReader struct {
+	p   []byte
+	err error
+}
+
+func (r *frameReader) next(n int) (p []byte) {
+	if r.err != nil {
+		return
+	}
+	if n < 0 || len(r.p) < n {
+		r.err = fmt.Errorf("frame is broken")
+		return
+	}
+	p = r.p[:n]
+	r.p = r.p[n:]
+	return
+}
+
+func (r *frameReader) uint8() (v uint8) {
+	if p := r.next(1); p != nil {
+		v = p[0]
+	}
+	return
+}
+
+func (r *frameReader) uint16() (v uint16) {
+	if p := r.next(2); p != nil {
+		v = binary.BigEndian.Uint16(p)
+	}
+	return
+}
+
+func (r *frameReader) uint32() (v uint32) {
+	if p := r.next(4); p != nil {
+		v = binary.BigEndian.Uint32(p)
+	}
+	return
+}
+
+func (r *frameReader) uint64() (v uint64) {
+	if p := r.next(8); p != nil {
+		v = binary.BigEndian.Uint64(p)
+	}
+	return
+}
+
+func openWriteAheadLog(dir string, opts *options) (w *writeAheadLog, err error) {
+	w = &writeAheadLog{
+		dir:     dir,
+		volumes: nil,
+		mutex:   new(sync.Mutex),
+		tapes:   make(map[string]*tape),
+	}
+	w.Log, err = wal.Open(wal.Options{
+		Dir:          filepath.Join(dir, "wal"),
+		SyncInterval: opts.syncInterval,
+		Checkpointer: w,
+	})
+	if err != nil {
+		w = nil
+		return
+	}
+	return
+}
+
+// writeAheadLog logs blocks and index mutations of operations of tapes, so a crash never leaves indexes which refer to lost blocks.
+// Index files keep written pages in memory, a checkpoint logs them all at once and then flushes them with volumes,
+// so index files on disk are always at the same point of the log.
+type writeAheadLog struct {
+	*wal.Log
+	dir     string
+	volumes *volumes
+	mutex   *sync.Mutex
+	tapes   map[string]*tape
+}
+
+func (w *writeAheadLog) attach(vs *volumes) {
+	w.mutex.Lock()
+	w.volumes = vs
+	w.mutex.Unlock()
+}
+
+func (w *writeAheadLog) add(t *tape) {
+	w.mutex.Lock()
+	w.tapes[t.name] = t
+	w.mutex.Unlock()
+}
+
+func (w *writeAheadLog) remove(t *tape) {
+	w.mutex.Lock()
+	if w.tapes[t.name] == t {
+		delete(w.tapes, t.name)
+	}
+	w.mutex.Unlock()
+}
+
+// Snapshot returns pages of index files of tapes which were changed since the last checkpoint.
+func (w *writeAheadLog) Snapshot() (p []byte, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	files := make([]logFile, 0, 1)
+	for _, t := range w.tapes {
+		for _, idx := range t.indexes() {
+			for _, file := range idx.Files() {
+				size, pages := file.Pages()
+				if pages == nil {
+					continue
+				}
+				path, relErr := filepath.Rel(w.dir, file.Path())
+				if relErr != nil {
+					err = relErr
+					return
+				}
+				files = append(files, logFile{
+					path:  filepath.ToSlash(path),
+					size:  size,
+					pages: pages,
+				})
+			}
+		}
+	}
+	if len(files) == 0 {
+		return
+	}
+	p = encodeLogCheckpoint(files)
+	return
+}
+
+// Flush syncs volumes and writes pages of index files.
+func (w *writeAheadLog) Flush() (err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.volumes != nil {
+		if err = w.volumes.sync(); err != nil {
+			return
+		}
+	}
+	for _, t := range w.tapes {
+		for _, idx := range t.indexes() {
+			for _, file := range idx.Files() {
+				if err = file.Flush(); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// redoFiles restores pages of the last checkpoint and writes blocks of operations after it into volumes,
+// it is called before volumes and tapes are opened, and from is the number of frames which are not redone by redo.
+func (w *writeAheadLog) redoFiles(blockCapacity int64) (from int64, err error) {
+	var checkpoint []byte
+	n := int64(0)
+	err = w.Replay(func(p []byte) (err error) {
+		n++
+		if p[0] == frameCheckpoint {
+			checkpoint = append(checkpoint[:0], p...)
+			from = n
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	if checkpoint != nil {
+		files, decodeErr := decodeLogCheckpoint(checkpoint)
+		if decodeErr != nil {
+			err = decodeErr
+			return
+		}
+		for _, file := range files {
+			if err = journal.Restore(filepath.Join(w.dir, filepath.FromSlash(file.path)), file.size, file.pages); err != nil {
+				return
+			}
+		}
+	}
+	volumeFiles := make(map[uint32]*ioutils.File)
+	n = 0
+	err = w.Replay(func(p []byte) (err error) {
+		n++
+		if n <= from || p[0] != frameOperation {
+			return
+		}
+		op, decodeErr := decodeLogOperation(p)
+		if decodeErr != nil {
+			err = decodeErr
+			return
+		}
+		for _, block := range op.blocks {
+			file, has := volumeFiles[block.pos.Idx()]
+			if !has {
+				file, err = ioutils.OpenFile(volumePath(filepath.Join(w.dir, "volumes"), int64(block.pos.Idx())))
+				if err != nil {
+					return
+				}
+				volumeFiles[block.pos.Idx()] = file
+			}
+			if err = file.WriteAt((block.pos.No()-1)*blockCapacity, block.segment); err != nil {
+				return
+			}
+		}
+		return
+	})
+	for _, file := range volumeFiles {
+		if syncErr := file.Sync(); syncErr != nil && err == nil {
+			err = syncErr
+		}
+		_ = file.Close()
+	}
+	return
+}
+
+// redo applies mutations of operations after the frame from to indexes of tapes, operations of dropped tapes are skipped.
+func (w *writeAheadLog) redo(from int64) (operations int64, err error) {
+	n := int64(0)
+	err = w.Replay(func(p []byte) (err error) {
+		n++
+		if n <= from || p[0] != frameOperation {
+			return
+		}
+		op, decodeErr := decodeLogOperation(p)
+		if decodeErr != nil {
+			err = decodeErr
+			return
+		}
+		t, has := w.tapes[op.tape]
+		if !has || t.createdAt != op.createdAt {
+			return
+		}
+		if err = t.redo(op); err != nil {
+			return
+		}
+		operations++
+		return
+	})
+	return
+}
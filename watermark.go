@@ -0,0 +1,107 @@
+package tapedb
+
+import "sync"
+
+func newWatermark() (w *watermark) {
+	w = &watermark{
+		mutex:   new(sync.Mutex),
+		keys:    make(map[string]chan struct{}),
+		pending: make(map[string]*pendingKey),
+		closed:  false,
+	}
+	return
+}
+
+// watermark is the number of committed values of each key, readers do not read values which were applied but not committed,
+// and it wakes up followers of a key when values of the key were committed.
+type watermark struct {
+	mutex *sync.Mutex
+	keys  map[string]chan struct{}
+	// pending are keys which have values that were applied but not committed.
+	pending map[string]*pendingKey
+	closed  bool
+}
+
+// pendingKey is the committed length of a key and the number of writers which applied values of the key but did not commit them.
+type pendingKey struct {
+	committed int64
+	writers   int
+}
+
+// begin is called before values of key are applied, n is the length of key before them, t.locks of key must be held.
+func (w *watermark) begin(key []byte, n int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	pk, has := w.pending[string(key)]
+	if !has {
+		pk = &pendingKey{
+			committed: n,
+		}
+		w.pending[string(key)] = pk
+	}
+	pk.writers++
+}
+
+// end is called after the commit of values of key which were begun, n is the length of key after them,
+// and ok is false when they were not committed. Once key has no writers, all of its values are read,
+// so values of a failed commit are read when they were applied.
+func (w *watermark) end(key []byte, n int64, ok bool) {
+	w.mutex.Lock()
+	if pk, has := w.pending[string(key)]; has {
+		if ok && n > pk.committed {
+			pk.committed = n
+		}
+		pk.writers--
+		if pk.writers == 0 {
+			delete(w.pending, string(key))
+		}
+	}
+	c, has := w.keys[string(key)]
+	if has {
+		delete(w.keys, string(key))
+	}
+	w.mutex.Unlock()
+	if has {
+		close(c)
+	}
+}
+
+// limit returns the number of values of key which can be read, n is the length of key which must be got before calling it.
+func (w *watermark) limit(key []byte, n int64) (committed int64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	committed = n
+	if pk, has := w.pending[string(key)]; has && pk.committed < n {
+		committed = pk.committed
+	}
+	return
+}
+
+// wait returns a channel which is closed at the next commit of key, it must be got before checking values.
+func (w *watermark) wait(key []byte) (ch <-chan struct{}) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		closed := make(chan struct{})
+		close(closed)
+		ch = closed
+		return
+	}
+	c, has := w.keys[string(key)]
+	if !has {
+		c = make(chan struct{})
+		w.keys[string(key)] = c
+	}
+	ch = c
+	return
+}
+
+func (w *watermark) Close() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.closed = true
+	for key, c := range w.keys {
+		close(c)
+		delete(w.keys, key)
+	}
+}